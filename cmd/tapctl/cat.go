@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"log/slog"
+	"os"
+
+	"github.com/marcenggist/kitchen-printer-tap/internal/config"
+	"github.com/marcenggist/kitchen-printer-tap/internal/job"
+)
+
+// loadJob opens the store holding a job argument and reads the job. A path
+// is read from the job tree it is in, an ID from the configured store. The
+// caller closes the returned store.
+func loadJob(e *env, arg string) (jobReader, *job.StoredJob, error) {
+	jobID, tree, err := resolveJob(arg)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var store jobReader
+	if tree != "" {
+		keys, err := e.keyring()
+		if err != nil {
+			return nil, nil, err
+		}
+		logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+		store, err = job.OpenStoreReadOnly(&config.StorageConfig{BasePath: tree}, keys, logger)
+		if err != nil {
+			return nil, nil, err
+		}
+	} else if store, err = e.openStore(); err != nil {
+		return nil, nil, err
+	}
+
+	stored, err := store.Get(jobID)
+	if err != nil {
+		store.Close()
+		return nil, nil, err
+	}
+	return store, stored, nil
+}
+
+func runCat(e *env, args []string) error {
+	fs := flag.NewFlagSet("cat", flag.ExitOnError)
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errUsage
+	}
+
+	store, stored, err := loadJob(e, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	_, err = os.Stdout.Write(stored.Payload)
+	return err
+}
+
+func runMeta(e *env, args []string) error {
+	fs := flag.NewFlagSet("meta", flag.ExitOnError)
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errUsage
+	}
+
+	store, stored, err := loadJob(e, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(stored.Metadata)
+}
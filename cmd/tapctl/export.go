@@ -0,0 +1,139 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/marcenggist/kitchen-printer-tap/internal/escpos"
+	"github.com/marcenggist/kitchen-printer-tap/internal/job"
+	"github.com/marcenggist/kitchen-printer-tap/internal/payload"
+)
+
+func runExport(e *env, args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	out := fs.String("o", "", "output file, - for stdout (default <device_id>-<time>.tar.gz)")
+	from := fs.String("from", "", "earliest capture start (RFC 3339, or YYYY-MM-DD for midnight UTC)")
+	to := fs.String("to", "", "capture start before this time (RFC 3339, or YYYY-MM-DD for midnight UTC)")
+	printer := fs.String("printer", "", "printer IP")
+	site := fs.String("site", "", "site ID")
+	fs.Parse(args)
+	if fs.NArg() != 0 {
+		return errUsage
+	}
+
+	cfg, err := e.config()
+	if err != nil {
+		return err
+	}
+
+	opts := job.BundleOptions{
+		PrinterIP: *printer,
+		SiteID:    *site,
+		Render: func(meta *job.Metadata, data []byte) string {
+			if meta.ContentType != payload.ESCPOS && meta.ContentType != payload.Text {
+				return ""
+			}
+			return escpos.Text(data, cfg.Analysis.CodePage)
+		},
+	}
+	if opts.From, err = job.ParseQueryTime(*from); err != nil {
+		return err
+	}
+	if opts.To, err = job.ParseQueryTime(*to); err != nil {
+		return err
+	}
+
+	store, err := e.openStore()
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	if *out == "-" {
+		_, err := job.WriteBundle(os.Stdout, store, opts)
+		return err
+	}
+
+	path := *out
+	if path == "" {
+		path = fmt.Sprintf("%s-%s.tar.gz", cfg.DeviceID, time.Now().Format("20060102-150405"))
+	}
+	manifest, err := writeBundleFile(path, store, opts)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "exported %d jobs to %s\n", len(manifest.Jobs), path)
+	if len(manifest.Skipped) > 0 {
+		fmt.Fprintf(os.Stderr, "skipped %d unreadable jobs, listed in %s\n", len(manifest.Skipped), job.BundleManifestName)
+	}
+	return nil
+}
+
+// writeBundleFile writes an export bundle to path, leaving nothing behind
+// if it fails.
+func writeBundleFile(path string, store job.BundleStore, opts job.BundleOptions) (*job.BundleManifest, error) {
+	f, err := os.OpenFile(path+".tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0640)
+	if err != nil {
+		return nil, err
+	}
+	manifest, err := job.WriteBundle(f, store, opts)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(path+".tmp", path)
+	}
+	if err != nil {
+		os.Remove(path + ".tmp")
+		return nil, err
+	}
+	return manifest, nil
+}
+
+func runExportFiles(e *env, args []string) error {
+	fs := flag.NewFlagSet("export-files", flag.ExitOnError)
+	dir := fs.String("dir", "", "directory to write the job tree to (required)")
+	fs.Parse(args)
+	if fs.NArg() != 0 || *dir == "" {
+		return errUsage
+	}
+
+	cfg, err := e.config()
+	if err != nil {
+		return err
+	}
+	keys, err := e.keyring()
+	if err != nil {
+		return err
+	}
+	segmentDir := filepath.Join(cfg.Storage.BasePath, job.SegmentDir)
+	if _, err := os.Stat(segmentDir); err != nil {
+		return fmt.Errorf("no segment store: %w", err)
+	}
+
+	// Sign the day manifests like tapd would
+	var signer *job.Signer
+	if cfg.Storage.DeviceKeyFile != "" {
+		if signer, err = job.LoadSigner(cfg.Storage.DeviceKeyFile); err != nil {
+			return err
+		}
+	}
+
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	store, err := job.OpenSegmentStoreReadOnly(&cfg.Storage, keys, logger)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	n, err := store.ExportFiles(*dir, signer)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("exported %d jobs to %s\n", n, *dir)
+	return nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"log/slog"
+	"os"
+
+	"github.com/marcenggist/kitchen-printer-tap/internal/job"
+)
+
+func runFsck(e *env, args []string) error {
+	fs := flag.NewFlagSet("fsck", flag.ExitOnError)
+	pubkey := fs.String("pubkey", "", "trusted public key (base64 or PEM file), default the configured device key")
+	fs.Parse(args)
+	if fs.NArg() != 0 {
+		return errUsage
+	}
+
+	cfg, err := e.config()
+	if err != nil {
+		return err
+	}
+	keys, err := e.keyring()
+	if err != nil {
+		return err
+	}
+
+	pub, err := e.trustedKey(*pubkey)
+	if err != nil {
+		return err
+	}
+
+	var report *job.FsckReport
+	if cfg.Storage.Backend == "segments" {
+		store, err := job.OpenSegmentStoreReadOnly(&cfg.Storage, keys, slog.New(slog.NewTextHandler(os.Stderr, nil)))
+		if err != nil {
+			return err
+		}
+		defer store.Close()
+		report, err = store.Check(pub)
+		if err != nil {
+			return err
+		}
+	} else if report, err = job.CheckStore(cfg.Storage.BasePath, keys, pub); err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(report); err != nil {
+		return err
+	}
+	if !report.OK() {
+		return errProblems
+	}
+	return nil
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/marcenggist/kitchen-printer-tap/internal/job"
+)
+
+func runKeygen(e *env, args []string) error {
+	fs := flag.NewFlagSet("keygen", flag.ExitOnError)
+	id := fs.String("id", "k"+time.Now().UTC().Format("20060102"), "key ID recorded in the metadata of jobs encrypted with the key")
+	fs.Parse(args)
+
+	key, err := job.GenerateKey()
+	if err != nil {
+		return fmt.Errorf("generating key: %w", err)
+	}
+	fmt.Printf("%s %s\n", *id, key)
+	return nil
+}
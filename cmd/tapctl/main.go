@@ -0,0 +1,231 @@
+// Command tapctl inspects the jobs stored by tapd.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/marcenggist/kitchen-printer-tap/internal/config"
+	"github.com/marcenggist/kitchen-printer-tap/internal/job"
+)
+
+var (
+	version   = "dev"
+	buildTime = "unknown"
+)
+
+// command is a tapctl subcommand. run receives the arguments after the
+// command name.
+type command struct {
+	usage   string
+	summary string
+	run     func(env *env, args []string) error
+}
+
+var commands = map[string]command{
+	"cat": {
+		usage:   "cat <job>",
+		summary: "write the decoded payload of a job to stdout",
+		run:     runCat,
+	},
+	"meta": {
+		usage:   "meta <job>",
+		summary: "print the metadata of a job as JSON",
+		run:     runMeta,
+	},
+	"query": {
+		usage:   "query [-from t] [-to t] [-printer ip] [-tag tag] [-limit n]",
+		summary: "list indexed jobs as JSON lines",
+		run:     runQuery,
+	},
+	"reindex": {
+		usage:   "reindex",
+		summary: "rebuild the job index from the job tree (tapd must be stopped)",
+		run:     runReindex,
+	},
+	"verify": {
+		usage:   "verify [-dir path] [-pubkey key]",
+		summary: "check the manifest hash chains against the stored jobs",
+		run:     runVerify,
+	},
+	"fsck": {
+		usage:   "fsck [-pubkey key]",
+		summary: "check every stored job's payload hash, size, metadata and upload status",
+		run:     runFsck,
+	},
+	"export": {
+		usage:   "export [-o file] [-from t] [-to t] [-printer ip] [-site id]",
+		summary: "package the selected jobs with rendered text and checksums into a tar.gz",
+		run:     runExport,
+	},
+	"export-files": {
+		usage:   "export-files -dir path",
+		summary: "write the jobs of the segments backend as a job tree",
+		run:     runExportFiles,
+	},
+	"pcap": {
+		usage:   "pcap [-o file | -save] <job>",
+		summary: "write the captured packets of a job as pcap, or save them next to the job",
+		run:     runPcap,
+	},
+	"pubkey": {
+		usage:   "pubkey",
+		summary: "print the device ID and the public key jobs are signed with",
+		run:     runPubkey,
+	},
+	"sigcheck": {
+		usage:   "sigcheck [-pubkey key] <job>",
+		summary: "verify the device signature and payload hash of a job",
+		run:     runSigcheck,
+	},
+	"keygen": {
+		usage:   "keygen [-id key-id]",
+		summary: "print a new key line for the encryption key file",
+		run:     runKeygen,
+	},
+}
+
+// errUsage is returned by commands called with invalid arguments.
+var errUsage = errors.New("invalid arguments")
+
+// errProblems is returned by checks that printed a report with problems,
+// so that tapctl exits non-zero.
+var errProblems = errors.New("problems found")
+
+// env holds what commands need from the tapd configuration. It is loaded
+// lazily so that commands such as keygen work without a config file.
+type env struct {
+	configPath string
+	cfg        *config.Config
+	keys       *job.Keyring
+}
+
+func (e *env) config() (*config.Config, error) {
+	if e.cfg == nil {
+		cfg, err := config.Load(e.configPath)
+		if err != nil {
+			return nil, fmt.Errorf("loading config: %w", err)
+		}
+		e.cfg = cfg
+	}
+	return e.cfg, nil
+}
+
+func (e *env) keyring() (*job.Keyring, error) {
+	cfg, err := e.config()
+	if err != nil {
+		return nil, err
+	}
+	if e.keys == nil {
+		keys, err := job.LoadKeyring(cfg.Storage.EncryptionKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading encryption keys: %w", err)
+		}
+		e.keys = keys
+	}
+	return e.keys, nil
+}
+
+func main() {
+	configPath := flag.String("config", "/etc/kitchen-printer-tap/config.yaml", "path to config file")
+	showVersion := flag.Bool("version", false, "show version and exit")
+	flag.Usage = usage
+	flag.Parse()
+
+	if *showVersion {
+		fmt.Printf("tapctl version %s (built %s)\n", version, buildTime)
+		os.Exit(0)
+	}
+
+	if flag.NArg() == 0 {
+		usage()
+		os.Exit(2)
+	}
+
+	cmd, ok := commands[flag.Arg(0)]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "tapctl: unknown command %q\n", flag.Arg(0))
+		usage()
+		os.Exit(2)
+	}
+
+	err := cmd.run(&env{configPath: *configPath}, flag.Args()[1:])
+	if errors.Is(err, errProblems) {
+		os.Exit(1)
+	}
+	if errors.Is(err, errUsage) {
+		fmt.Fprintf(os.Stderr, "Usage: tapctl %s\n", cmd.usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "tapctl %s: %v\n", flag.Arg(0), err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: tapctl [-config path] <command> [arguments]\n\nCommands:\n")
+
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %s\n        %s\n", commands[name].usage, commands[name].summary)
+	}
+
+	fmt.Fprintf(os.Stderr, "\nA <job> is a job ID or the path of one of its files.\n\nFlags:\n")
+	flag.PrintDefaults()
+}
+
+// jobReader is a job store opened read-only by tapctl.
+type jobReader interface {
+	job.BundleStore
+	Close() error
+}
+
+// openStore opens the configured job store read-only. The segments backend
+// cannot be opened while tapd runs.
+func (e *env) openStore() (jobReader, error) {
+	cfg, err := e.config()
+	if err != nil {
+		return nil, err
+	}
+	keys, err := e.keyring()
+	if err != nil {
+		return nil, err
+	}
+
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	if cfg.Storage.Backend == "segments" {
+		return job.OpenSegmentStoreReadOnly(&cfg.Storage, keys, logger)
+	}
+	return job.OpenStoreReadOnly(&cfg.Storage, keys, logger)
+}
+
+// resolveJob returns the ID of a job given its ID or the path of one of its
+// files. For a path it also returns the job tree holding the file, which
+// need not be the configured one.
+func resolveJob(arg string) (jobID, tree string, err error) {
+	if !strings.ContainsRune(arg, os.PathSeparator) {
+		return arg, "", nil
+	}
+
+	base := arg
+	for _, ext := range []string{".upload.json", ".json", ".bin"} {
+		base = strings.TrimSuffix(base, ext)
+	}
+	if _, err := os.Stat(base + ".json"); err != nil {
+		return "", "", fmt.Errorf("no job metadata at %s.json", base)
+	}
+	// Jobs are stored in YYYY/MM/DD below the tree
+	tree = filepath.Dir(filepath.Dir(filepath.Dir(filepath.Dir(base))))
+	return filepath.Base(base), tree, nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/marcenggist/kitchen-printer-tap/internal/job"
+)
+
+func runPcap(e *env, args []string) error {
+	fs := flag.NewFlagSet("pcap", flag.ExitOnError)
+	out := fs.String("o", "", "output file, - for stdout (default <job>.pcap in the current directory)")
+	save := fs.Bool("save", false, "have tapd save the packets next to the job instead")
+	fs.Parse(args)
+	if fs.NArg() != 1 || (*save && *out != "") {
+		return errUsage
+	}
+
+	cfg, err := e.config()
+	if err != nil {
+		return err
+	}
+
+	jobID := filepath.Base(fs.Arg(0))
+	for _, ext := range []string{".upload.json", ".json", ".bin"} {
+		jobID = strings.TrimSuffix(jobID, ext)
+	}
+	if *out == "" {
+		*out = jobID + ".pcap"
+	}
+
+	// Jobs with stream anomalies were saved with their packets. A job
+	// that is not stored may still be in the ring.
+	store, stored, err := loadJob(e, fs.Arg(0))
+	switch {
+	case errors.Is(err, job.ErrJobNotFound):
+	case err != nil:
+		return fmt.Errorf("reading job: %w", err)
+	default:
+		defer store.Close()
+		if meta := stored.Metadata; meta.PcapFile != "" {
+			if *save {
+				fmt.Fprintf(os.Stderr, "packets of job %s already saved as %s\n", jobID, meta.PcapFile)
+				return nil
+			}
+			data, err := savedPackets(store, &meta)
+			if err != nil {
+				return err
+			}
+			return writePcapFile(*out, data)
+		}
+	}
+
+	// Otherwise they may still be in the packet ring of the running tapd
+	if !cfg.Health.Enabled {
+		return errors.New("the packet ring is read through the health endpoint, which is disabled")
+	}
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	endpoint := "http://" + cfg.Health.Address + "/pcap?" + url.Values{"job": {jobID}}.Encode()
+	var resp *http.Response
+	if *save {
+		resp, err = client.Post(endpoint, "", nil)
+	} else {
+		resp, err = client.Get(endpoint)
+	}
+	if err != nil {
+		return fmt.Errorf("requesting packets from tapd: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("tapd has no packets of job %s (packet ring disabled, or the packets have aged out)", jobID)
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("requesting packets from tapd: status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	if *save {
+		var saved struct {
+			Packets int `json:"packets"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&saved); err != nil {
+			return fmt.Errorf("reading tapd response: %w", err)
+		}
+		fmt.Fprintf(os.Stderr, "saved %d packets of job %s as %s.pcap next to the job\n", saved.Packets, jobID, jobID)
+		return nil
+	}
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("reading packets: %w", err)
+	}
+	return writePcapFile(*out, data)
+}
+
+// savedPackets returns the packets saved with a job.
+func savedPackets(store job.BundleStore, meta *job.Metadata) ([]byte, error) {
+	_, attachments, err := store.Contents(meta)
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range attachments {
+		if a.Name == meta.PcapFile {
+			return a.Data, nil
+		}
+	}
+	return nil, fmt.Errorf("packets %s not found", meta.PcapFile)
+}
+
+// writePcapFile writes pcap data to path, or to stdout if path is "-".
+func writePcapFile(path string, data []byte) error {
+	if path == "-" {
+		_, err := os.Stdout.Write(data)
+		return err
+	}
+	if err := os.WriteFile(path, data, 0640); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "wrote %s (%d bytes)\n", path, len(data))
+	return nil
+}
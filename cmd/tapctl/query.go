@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/marcenggist/kitchen-printer-tap/internal/job"
+)
+
+func runQuery(e *env, args []string) error {
+	fs := flag.NewFlagSet("query", flag.ExitOnError)
+	from := fs.String("from", "", "earliest capture start (RFC 3339, or YYYY-MM-DD for midnight UTC)")
+	to := fs.String("to", "", "capture start before this time (RFC 3339, or YYYY-MM-DD for midnight UTC)")
+	printer := fs.String("printer", "", "printer IP")
+	tag := fs.String("tag", "", "job tag, e.g. reprint or void")
+	limit := fs.Int("limit", 0, "maximum number of jobs")
+	fs.Parse(args)
+	if fs.NArg() != 0 {
+		return errUsage
+	}
+
+	cfg, err := e.config()
+	if err != nil {
+		return err
+	}
+	if cfg.Storage.IndexFile == "" {
+		return fmt.Errorf("indexing is disabled (storage.index_file is empty)")
+	}
+
+	var q job.IndexQuery
+	if q.From, err = job.ParseQueryTime(*from); err != nil {
+		return err
+	}
+	if q.To, err = job.ParseQueryTime(*to); err != nil {
+		return err
+	}
+	q.PrinterIP, q.Tag, q.Limit = *printer, *tag, *limit
+
+	// tapd holds the index open while it runs; ask it instead
+	var jobs []job.IndexEntry
+	index, err := job.OpenIndexReadOnly(cfg.Storage.IndexFile, cfg.Storage.BasePath)
+	if err == nil {
+		jobs, err = index.Query(q)
+		index.Close()
+	} else {
+		jobs, err = queryDaemon(e, *from, *to, q)
+	}
+	if err != nil {
+		return err
+	}
+
+	// One JSON object per line
+	enc := json.NewEncoder(os.Stdout)
+	for _, j := range jobs {
+		if err := enc.Encode(j); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// queryDaemon runs a query through the /jobs endpoint of the running tapd.
+func queryDaemon(e *env, from, to string, q job.IndexQuery) ([]job.IndexEntry, error) {
+	cfg, err := e.config()
+	if err != nil {
+		return nil, err
+	}
+	if !cfg.Health.Enabled {
+		return nil, errors.New("index is in use and the health endpoint is disabled")
+	}
+
+	params := url.Values{}
+	for key, value := range map[string]string{"from": from, "to": to, "printer": q.PrinterIP, "tag": q.Tag} {
+		if value != "" {
+			params.Set(key, value)
+		}
+	}
+	if q.Limit > 0 {
+		params.Set("limit", strconv.Itoa(q.Limit))
+	}
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Get("http://" + cfg.Health.Address + "/jobs?" + params.Encode())
+	if err != nil {
+		return nil, fmt.Errorf("querying tapd: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("querying tapd: status %d", resp.StatusCode)
+	}
+
+	var jobs []job.IndexEntry
+	if err := json.NewDecoder(resp.Body).Decode(&jobs); err != nil {
+		return nil, fmt.Errorf("parsing tapd response: %w", err)
+	}
+	return jobs, nil
+}
+
+func runReindex(e *env, args []string) error {
+	fs := flag.NewFlagSet("reindex", flag.ExitOnError)
+	fs.Parse(args)
+	if fs.NArg() != 0 {
+		return errUsage
+	}
+
+	cfg, err := e.config()
+	if err != nil {
+		return err
+	}
+	if cfg.Storage.IndexFile == "" {
+		return fmt.Errorf("indexing is disabled (storage.index_file is empty)")
+	}
+	keys, err := e.keyring()
+	if err != nil {
+		return err
+	}
+
+	index, _, err := job.OpenIndex(cfg.Storage.IndexFile, cfg.Storage.BasePath)
+	if err != nil {
+		return fmt.Errorf("%w (stop tapd first)", err)
+	}
+	defer index.Close()
+
+	start := time.Now()
+	n, err := index.Rebuild(keys)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("indexed %d jobs in %s\n", n, time.Since(start).Round(time.Millisecond))
+	return nil
+}
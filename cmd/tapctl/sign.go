@@ -0,0 +1,103 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/marcenggist/kitchen-printer-tap/internal/job"
+)
+
+func runPubkey(e *env, args []string) error {
+	fs := flag.NewFlagSet("pubkey", flag.ExitOnError)
+	fs.Parse(args)
+	if fs.NArg() != 0 {
+		return errUsage
+	}
+
+	cfg, err := e.config()
+	if err != nil {
+		return err
+	}
+	if cfg.Storage.DeviceKeyFile == "" {
+		return fmt.Errorf("signing is disabled (storage.device_key_file is empty)")
+	}
+
+	signer, err := job.LoadSigner(cfg.Storage.DeviceKeyFile)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s %s\n", cfg.DeviceID, signer.PublicKey())
+	return nil
+}
+
+// trustedKey returns the key job signatures are checked against: the
+// -pubkey argument, a base64 key or the path of a PEM public key file, or
+// else the public half of the configured device key. Returns nil if
+// neither is available.
+func (e *env) trustedKey(arg string) (ed25519.PublicKey, error) {
+	if arg != "" {
+		data, err := os.ReadFile(arg)
+		if err != nil {
+			data = []byte(arg)
+		}
+		pub, err := job.ParsePublicKey(data)
+		if err != nil {
+			return nil, fmt.Errorf("parsing -pubkey: %w", err)
+		}
+		return pub, nil
+	}
+
+	cfg, err := e.config()
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Storage.DeviceKeyFile == "" {
+		return nil, nil
+	}
+	signer, err := job.LoadSigner(cfg.Storage.DeviceKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	return signer.Public(), nil
+}
+
+func runSigcheck(e *env, args []string) error {
+	fs := flag.NewFlagSet("sigcheck", flag.ExitOnError)
+	pubkey := fs.String("pubkey", "", "trusted public key (base64 or PEM file), default the configured device key")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errUsage
+	}
+
+	pub, err := e.trustedKey(*pubkey)
+	if err != nil {
+		return err
+	}
+	if pub == nil {
+		return fmt.Errorf("no trusted key: pass -pubkey or set storage.device_key_file")
+	}
+
+	store, stored, err := loadJob(e, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	meta := stored.Metadata
+	if err := job.VerifySignature(meta, pub); err != nil {
+		return err
+	}
+
+	// The signature covers the payload hash, so the payload must match it
+	sum := sha256.Sum256(stored.Payload)
+	if got := hex.EncodeToString(sum[:]); got != meta.SHA256 {
+		return fmt.Errorf("payload sha256 %s does not match the signed sha256 %s", got, meta.SHA256)
+	}
+
+	fmt.Printf("%s: signature and payload valid (device %s, key %s)\n", meta.JobID, meta.DeviceID, meta.SigningKey)
+	return nil
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"os"
+
+	"github.com/marcenggist/kitchen-printer-tap/internal/job"
+)
+
+func runVerify(e *env, args []string) error {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	pubkey := fs.String("pubkey", "", "trusted public key (base64 or PEM file), default the configured device key")
+	dir := fs.String("dir", "", "job tree to verify, such as one written by export-files (default storage.base_path)")
+	fs.Parse(args)
+	if fs.NArg() != 0 {
+		return errUsage
+	}
+
+	cfg, err := e.config()
+	if err != nil {
+		return err
+	}
+	if *dir == "" {
+		if cfg.Storage.Backend == "segments" {
+			return errors.New("the segments backend has no day manifests; check it with fsck, or pass -dir with a tree written by export-files")
+		}
+		*dir = cfg.Storage.BasePath
+	}
+
+	pub, err := e.trustedKey(*pubkey)
+	if err != nil {
+		return err
+	}
+
+	report, err := job.VerifyManifests(*dir, pub)
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(report); err != nil {
+		return err
+	}
+	if !report.OK() {
+		return errProblems
+	}
+	return nil
+}
@@ -6,6 +6,7 @@ import (
 	"log/slog"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"syscall"
 	"time"
 
@@ -13,6 +14,7 @@ import (
 	"github.com/marcenggist/kitchen-printer-tap/internal/config"
 	"github.com/marcenggist/kitchen-printer-tap/internal/health"
 	"github.com/marcenggist/kitchen-printer-tap/internal/job"
+	"github.com/marcenggist/kitchen-printer-tap/internal/order"
 	"github.com/marcenggist/kitchen-printer-tap/internal/upload"
 )
 
@@ -56,26 +58,141 @@ func main() {
 		"port_9100", cfg.Capture.Port9100Enabled,
 		"port_515", cfg.Capture.Port515Enabled)
 
-	// Initialize job store
-	store, err := job.NewStore(cfg.Storage.BasePath, cfg.Storage.MinFreeMB)
+	// Load encryption keys
+	keys, err := job.LoadKeyring(cfg.Storage.EncryptionKeyFile)
 	if err != nil {
-		logger.Error("failed to initialize store",
+		logger.Error("failed to load encryption keys",
 			"error", err)
 		os.Exit(1)
 	}
+	if keys != nil {
+		logger.Info("job encryption enabled",
+			"key_id", keys.ActiveKeyID(),
+			"encrypt_metadata", cfg.Storage.EncryptMetadata)
+	}
+
+	// Load or create the device signing key
+	var signer *job.Signer
+	if cfg.Storage.DeviceKeyFile != "" {
+		var created bool
+		signer, created, err = job.LoadOrCreateSigner(cfg.Storage.DeviceKeyFile)
+		if err != nil {
+			logger.Error("failed to load device key",
+				"error", err)
+			os.Exit(1)
+		}
+		if created {
+			logger.Info("device key generated",
+				"path", cfg.Storage.DeviceKeyFile,
+				"public_key", signer.PublicKey())
+		}
+	}
+
+	// Initialize job store
+	var (
+		store      job.JobStore
+		jobIndex   *job.Index
+		retention  *job.RetentionWorker
+		closeStore func() error
+	)
+	// Expired jobs that were never uploaded are only deleted when
+	// configured. With upload disabled no job is ever uploaded, so all
+	// expired jobs are eligible; retention would delete nothing otherwise.
+	deleteUnuploaded := cfg.Storage.RetentionDeleteUnuploaded || !cfg.Upload.Enabled
+	if deleteUnuploaded && !cfg.Storage.RetentionDeleteUnuploaded && cfg.Storage.RetentionDays > 0 {
+		logger.Info("upload disabled, retention deletes expired jobs that were not uploaded",
+			"retention_days", cfg.Storage.RetentionDays)
+	}
+	switch cfg.Storage.Backend {
+	case "segments":
+		segments, err := job.OpenSegmentStore(&cfg.Storage, deleteUnuploaded, keys, signer, logger)
+		if err != nil {
+			logger.Error("failed to initialize store",
+				"error", err)
+			os.Exit(1)
+		}
+		store, closeStore = segments, segments.Close
+	default:
+		files, err := job.NewStore(&cfg.Storage, keys, signer, logger)
+		if err != nil {
+			logger.Error("failed to initialize store",
+				"error", err)
+			os.Exit(1)
+		}
+		store, jobIndex, closeStore = files, files.Index(), files.Close
+
+		// Repair files left behind by a crash or power cut
+		recovery, err := files.Recover(cfg.DeviceID, cfg.SiteID)
+		if err != nil {
+			logger.Error("job store recovery failed",
+				"error", err)
+		} else if len(recovery.Completed)+len(recovery.Removed)+len(recovery.Regenerated)+len(recovery.Quarantined) > 0 {
+			logger.Warn("job store recovered after unclean shutdown",
+				"completed", recovery.Completed,
+				"removed", recovery.Removed,
+				"regenerated", recovery.Regenerated,
+				"quarantined", recovery.Quarantined,
+				"quarantine_dir", filepath.Join(cfg.Storage.BasePath, job.QuarantineDir))
+		}
+
+		// Start job retention. The segments backend expires whole
+		// segments itself.
+		retention = job.NewRetentionWorker(
+			files,
+			cfg.Storage.RetentionDays,
+			deleteUnuploaded,
+			logger,
+		)
+		retention.Start()
+	}
 
 	// Initialize reprint detector
-	reprintDetector := job.NewReprintDetector(cfg.Storage.ReprintWindowSec)
+	window := time.Duration(cfg.Storage.ReprintWindowSec) * time.Second
+	reprintDetector, err := job.NewReprintDetector(job.ReprintOptions{
+		Window:     window,
+		Masks:      cfg.Storage.ReprintMasks,
+		MaxEntries: cfg.Storage.ReprintMaxEntries,
+	})
+	if err != nil {
+		logger.Error("failed to initialize reprint detector",
+			"error", err)
+		os.Exit(1)
+	}
+
+	// Rebuild the reprint window from jobs saved before a restart
+	if recent, err := store.List(job.ListOptions{Since: time.Now().Add(-window)}); err != nil {
+		logger.Warn("failed to restore reprint state",
+			"error", err)
+	} else {
+		logger.Info("reprint state restored",
+			"jobs", reprintDetector.Restore(recent))
+	}
+
+	// Load order extraction templates
+	var orders *order.Engine
+	if cfg.Analysis.ExtractOrders {
+		templates, err := order.LoadTemplates(cfg.Analysis.TemplatesDir)
+		if err != nil {
+			logger.Warn("order extraction disabled",
+				"templates_dir", cfg.Analysis.TemplatesDir,
+				"error", err)
+		} else {
+			orders = order.NewEngine(templates)
+			logger.Info("order templates loaded",
+				"templates_dir", cfg.Analysis.TemplatesDir,
+				"templates", orders.Templates())
+		}
+	}
 
 	// Initialize statistics
 	stats := &capture.Stats{}
 
 	// Initialize uploader
-	uploader := upload.New(&cfg.Upload, cfg.Storage.BasePath, logger)
+	uploader := upload.New(&cfg.Upload, store, logger)
 	uploader.Start()
 
 	// Initialize capturer
-	capturer := capture.New(cfg, store, reprintDetector, stats, logger)
+	capturer := capture.New(cfg, store, keys, reprintDetector, orders, stats, logger)
 	if err := capturer.Start(); err != nil {
 		logger.Error("failed to start capture",
 			"error", err)
@@ -90,6 +207,8 @@ func main() {
 		capturer.GetActiveSessions,
 		logger,
 	)
+	healthServer.SetJobIndex(jobIndex)
+	healthServer.SetPcapExport(capturer.WriteJobPcap, capturer.SaveJobPcap)
 	if err := healthServer.Start(); err != nil {
 		logger.Error("failed to start health server",
 			"error", err)
@@ -119,7 +238,15 @@ func main() {
 	}
 	healthServer.Stop()
 	capturer.Stop()
+	reprintDetector.Close()
 	uploader.Stop()
+	if retention != nil {
+		retention.Stop()
+	}
+	if err := closeStore(); err != nil {
+		logger.Warn("failed to close job store",
+			"error", err)
+	}
 
 	logger.Info("tapd stopped",
 		"jobs_captured", stats.JobsCaptured.Load(),
@@ -140,7 +267,10 @@ func metricsLoop(logger *slog.Logger, stats *capture.Stats, uploader *upload.Upl
 				"bytes_captured", stats.BytesCaptured.Load(),
 				"upload_queue", uploader.QueueSize(),
 				"active_sessions", capturer.GetActiveSessions(),
-				"parse_errors", stats.ParseErrors.Load())
+				"parse_errors", stats.ParseErrors.Load(),
+				"polls_dropped", stats.PollsDropped.Load(),
+				"polls_stored", stats.PollsStored.Load(),
+				"spool_depth", stats.SpoolDepth.Load())
 		}
 	}
 }
@@ -5,7 +5,12 @@ go 1.22
 require (
 	github.com/google/gopacket v1.1.19
 	github.com/google/uuid v1.6.0
+	github.com/klauspost/compress v1.18.0
+	go.etcd.io/bbolt v1.3.11
 	gopkg.in/yaml.v3 v3.0.1
 )
 
-require golang.org/x/sys v0.0.0-20190412213103-97732733099d // indirect
+require (
+	golang.org/x/net v0.0.0-20190620200207-3b0461eec859 // indirect
+	golang.org/x/sys v0.10.0 // indirect
+)
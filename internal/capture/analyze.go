@@ -0,0 +1,97 @@
+package capture
+
+import (
+	"github.com/marcenggist/kitchen-printer-tap/internal/escpos"
+	"github.com/marcenggist/kitchen-printer-tap/internal/job"
+	"github.com/marcenggist/kitchen-printer-tap/internal/payload"
+)
+
+// analyzeJob decodes the closed job's payload and records what it finds in
+// the job metadata.
+func (c *Capturer) analyzeJob(j *job.Job) {
+	contentType := payload.Classify(j.Data)
+	j.SetContentType(contentType)
+
+	// The decoders below only understand ESC/POS
+	if contentType != payload.ESCPOS && contentType != payload.Text {
+		return
+	}
+
+	if c.cfg.Analysis.ExtractRasters {
+		c.extractRasters(j)
+	}
+	if c.cfg.Analysis.DecodeBarcodes {
+		c.decodeBarcodes(j)
+	}
+
+	text := escpos.Text(j.Data, c.cfg.Analysis.CodePage)
+	if c.reprint != nil && c.cfg.Storage.ReprintNormalized {
+		j.SetNormalizedHash(c.reprint.Fingerprint(text))
+	}
+	if c.orders != nil {
+		if o := c.orders.Extract(text, j.Metadata.PrinterIP); o != nil {
+			j.SetOrder(o)
+			c.trackOrder(j, o)
+		}
+	}
+}
+
+// trackOrder links void tickets to the order they cancel and remembers
+// regular orders for later voids.
+func (c *Capturer) trackOrder(j *job.Job, o *job.Order) {
+	if !o.Void {
+		if o.OrderNumber != "" {
+			c.voids.Record(o.OrderNumber, j.Metadata.PrinterIP, j.Metadata.JobID)
+		}
+		return
+	}
+
+	var originalID string
+	if o.CancelsOrderNumber != "" {
+		originalID = c.voids.Find(o.CancelsOrderNumber, j.Metadata.PrinterIP)
+	}
+	j.SetVoid(originalID)
+	c.logger.Info("void ticket detected",
+		"job_id", j.Metadata.JobID,
+		"order_number", o.CancelsOrderNumber,
+		"cancels_job_id", originalID)
+}
+
+func (c *Capturer) extractRasters(j *job.Job) {
+	for _, r := range escpos.Rasters(j.Data) {
+		pngData, err := r.PNG()
+		if err != nil {
+			c.logger.Warn("failed to encode raster image",
+				"job_id", j.Metadata.JobID,
+				"offset", r.Offset,
+				"error", err)
+			continue
+		}
+
+		bounds := r.Image.Bounds()
+		j.AddRasterImage(job.RasterImage{
+			Command: r.Command,
+			Offset:  r.Offset,
+			Width:   bounds.Dx(),
+			Height:  bounds.Dy(),
+		}, pngData)
+	}
+}
+
+func (c *Capturer) decodeBarcodes(j *job.Job) {
+	found := escpos.Barcodes(j.Data)
+	if len(found) == 0 {
+		return
+	}
+
+	codes := make([]job.Barcode, 0, len(found))
+	for _, bc := range found {
+		codes = append(codes, job.Barcode{
+			Symbology: bc.Symbology,
+			Data:      bc.Data,
+			Command:   bc.Command,
+			Offset:    bc.Offset,
+		})
+	}
+	j.SetBarcodes(codes)
+}
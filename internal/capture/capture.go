@@ -1,7 +1,10 @@
 package capture
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"io"
 	"log/slog"
 	"net"
 	"sync"
@@ -14,6 +17,8 @@ import (
 
 	"github.com/marcenggist/kitchen-printer-tap/internal/config"
 	"github.com/marcenggist/kitchen-printer-tap/internal/job"
+	"github.com/marcenggist/kitchen-printer-tap/internal/order"
+	"github.com/marcenggist/kitchen-printer-tap/internal/payload"
 )
 
 // Stats holds capture statistics.
@@ -21,42 +26,65 @@ type Stats struct {
 	JobsCaptured  atomic.Int64
 	BytesCaptured atomic.Int64
 	ParseErrors   atomic.Int64
+	PollsDropped  atomic.Int64
+	PollsStored   atomic.Int64
+	// SpoolDepth and SpoolBytes describe the jobs waiting in the spool
+	// for the disk to recover; SpoolDropped counts jobs lost because the
+	// spool was full or a spooled job could not be read back and was
+	// quarantined.
+	SpoolDepth   atomic.Int64
+	SpoolBytes   atomic.Int64
+	SpoolDropped atomic.Int64
 }
 
+// ErrNoPackets is returned when the packet ring holds no packets of a job,
+// because the ring is disabled or the packets have aged out.
+var ErrNoPackets = errors.New("no packets of job in ring")
+
 // Capturer handles packet capture and job assembly.
 type Capturer struct {
-	cfg      *config.Config
-	store    *job.Store
-	reprint  *job.ReprintDetector
-	stats    *Stats
-	logger   *slog.Logger
-	handle   *pcap.Handle
-	sessions map[string]*session
-	mu       sync.Mutex
-	done     chan struct{}
-	wg       sync.WaitGroup
+	cfg        *config.Config
+	store      job.JobStore
+	reprint    *job.ReprintDetector
+	orders     *order.Engine
+	voids      *job.OrderTracker
+	spool      *spool
+	ring       *packetRing
+	stats      *Stats
+	logger     *slog.Logger
+	handle     *pcap.Handle
+	linkType   layers.LinkType
+	sessions   map[string]*session
+	mu         sync.Mutex
+	finalizeMu sync.Mutex
+	done       chan struct{}
+	wg         sync.WaitGroup
 }
 
 // session tracks a TCP connection's data.
 type session struct {
-	job         *job.Job
-	lastSeen    time.Time
-	srcIP       string
-	dstIP       string
-	srcPort     uint16
-	dstPort     uint16
-	transport   string
-	seqTracker  map[uint32]bool
-	nextSeq     uint32
-	initialized bool
+	job        *job.Job
+	lastSeen   time.Time
+	srcIP      string
+	dstIP      string
+	srcPort    uint16
+	dstPort    uint16
+	transport  string
+	seqTracker map[uint32]bool
+	nextSeq    uint32
 }
 
-// New creates a new packet capturer.
-func New(cfg *config.Config, store *job.Store, reprint *job.ReprintDetector, stats *Stats, logger *slog.Logger) *Capturer {
+// New creates a new packet capturer. Jobs spooled to disk are encrypted
+// with keys unless it is nil.
+func New(cfg *config.Config, store job.JobStore, keys *job.Keyring, reprint *job.ReprintDetector, orders *order.Engine, stats *Stats, logger *slog.Logger) *Capturer {
 	return &Capturer{
 		cfg:      cfg,
 		store:    store,
 		reprint:  reprint,
+		orders:   orders,
+		voids:    job.NewOrderTracker(cfg.Analysis.VoidWindow),
+		spool:    newSpool(&cfg.Storage, store, keys, stats, logger),
+		ring:     newPacketRing(cfg.Capture.PacketRingMB, cfg.Capture.PacketRingAge),
 		stats:    stats,
 		logger:   logger,
 		sessions: make(map[string]*session),
@@ -84,6 +112,8 @@ func (c *Capturer) Start() error {
 	}
 
 	c.handle = handle
+	c.linkType = handle.LinkType()
+	c.spool.start()
 	c.logger.Info("capture started",
 		"interface", c.cfg.Interface,
 		"filter", filter)
@@ -109,11 +139,17 @@ func (c *Capturer) Stop() {
 
 	// Close all remaining sessions
 	c.mu.Lock()
+	var closed []*session
 	for key, sess := range c.sessions {
-		c.finalizeSession(sess)
+		closed = append(closed, sess)
 		delete(c.sessions, key)
 	}
 	c.mu.Unlock()
+	for _, sess := range closed {
+		c.finalizeSession(sess)
+	}
+
+	c.spool.stop()
 }
 
 func (c *Capturer) buildBPFFilter() string {
@@ -210,45 +246,69 @@ func (c *Capturer) handlePacket(packet gopacket.Packet) {
 		sessionKey = fmt.Sprintf("%s:%d->%s:%d", posIP, dstPort, printerIP, printerPort)
 	}
 
+	// The session is updated under the lock; the ring has a lock of its own
+	// and closed sessions are finalized after releasing it, so that slow
+	// analysis and saving do not hold up other sessions
+	jobID, closed := c.updateSession(sessionKey, packet, tcp, isTowardsPrinter, printerIP, printerPort, posIP, transport)
+	if jobID != "" {
+		// Keep the packets of both directions for pcap export
+		c.ring.add(jobID, packet)
+	}
+	if closed != nil {
+		c.finalizeSession(closed)
+	}
+}
+
+// updateSession applies a packet to its session. It returns the ID of the
+// job the packet belongs to, if any, and the session if the packet closed
+// it.
+func (c *Capturer) updateSession(sessionKey string, packet gopacket.Packet, tcp *layers.TCP, isTowardsPrinter bool, printerIP string, printerPort uint16, posIP, transport string) (string, *session) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
+	sess, ok := c.sessions[sessionKey]
+
 	// Handle connection close
 	if tcp.FIN || tcp.RST {
-		if sess, ok := c.sessions[sessionKey]; ok {
-			c.finalizeSession(sess)
+		if ok {
 			delete(c.sessions, sessionKey)
+			return sess.job.Metadata.JobID, sess
 		}
-		return
+		return "", nil
 	}
 
 	// Only capture data going towards printer
 	if !isTowardsPrinter {
-		return
+		if ok {
+			return sess.job.Metadata.JobID, nil
+		}
+		return "", nil
 	}
 
 	// Get or create session
-	sess, ok := c.sessions[sessionKey]
 	if !ok {
 		if tcp.SYN {
-			// New connection
+			// New connection; data starts after the SYN
 			sess = &session{
 				job:        job.New(c.cfg.DeviceID, c.cfg.SiteID, printerIP, printerPort, posIP, transport),
 				lastSeen:   time.Now(),
 				srcIP:      posIP,
 				dstIP:      printerIP,
-				srcPort:    srcPort,
+				srcPort:    uint16(tcp.SrcPort),
 				dstPort:    printerPort,
 				transport:  transport,
 				seqTracker: make(map[uint32]bool),
+				nextSeq:    tcp.Seq + 1,
 			}
 			c.sessions[sessionKey] = sess
 			c.logger.Debug("new session",
 				"session", sessionKey,
 				"job_id", sess.job.Metadata.JobID)
+			return sess.job.Metadata.JobID, nil
 		}
-		return
+		return "", nil
 	}
+	jobID := sess.job.Metadata.JobID
 
 	// Update last seen time
 	sess.lastSeen = time.Now()
@@ -256,27 +316,36 @@ func (c *Capturer) handlePacket(packet gopacket.Packet) {
 	// Extract payload
 	appLayer := packet.ApplicationLayer()
 	if appLayer == nil || len(appLayer.Payload()) == 0 {
-		return
+		return jobID, nil
 	}
 	payload := appLayer.Payload()
 
 	// Track sequence numbers for ordering (simplified - assumes in-order delivery for MVP)
 	seq := tcp.Seq
-	if !sess.initialized {
-		sess.nextSeq = seq
-		sess.initialized = true
-	}
 
 	// Avoid duplicate data
 	if sess.seqTracker[seq] {
-		return
+		return jobID, nil
 	}
 	sess.seqTracker[seq] = true
 
+	// Data is appended in arrival order; record where that is not the
+	// stream order
+	switch diff := int32(seq - sess.nextSeq); {
+	case diff > 0:
+		sess.job.AddAnomaly(job.AnomalySeqGap)
+	case diff < 0:
+		sess.job.AddAnomaly(job.AnomalyOutOfOrder)
+	}
+	if end := seq + uint32(len(payload)); int32(end-sess.nextSeq) > 0 {
+		sess.nextSeq = end
+	}
+
 	// Append data to job
 	if sess.job.Append(payload) {
 		c.stats.BytesCaptured.Add(int64(len(payload)))
 	}
+	return jobID, nil
 }
 
 func (c *Capturer) isPrinterPort(port uint16) bool {
@@ -318,18 +387,28 @@ func (c *Capturer) sessionTimeoutLoop() {
 
 func (c *Capturer) checkTimeouts() {
 	c.mu.Lock()
-	defer c.mu.Unlock()
-
 	now := time.Now()
+	var closed []*session
 	for key, sess := range c.sessions {
 		if now.Sub(sess.lastSeen) >= c.cfg.Capture.IdleTimeout {
-			c.finalizeSession(sess)
+			closed = append(closed, sess)
 			delete(c.sessions, key)
 		}
 	}
+	c.mu.Unlock()
+
+	for _, sess := range closed {
+		c.finalizeSession(sess)
+	}
 }
 
+// finalizeSession analyzes and saves the job of a closed session. It is
+// called without mu held; finalizeMu keeps jobs finalized one at a time,
+// so that reprints and voids are matched in the order sessions close.
 func (c *Capturer) finalizeSession(sess *session) {
+	c.finalizeMu.Lock()
+	defer c.finalizeMu.Unlock()
+
 	sess.job.Close()
 
 	// Skip empty jobs
@@ -339,20 +418,59 @@ func (c *Capturer) finalizeSession(sess *session) {
 		return
 	}
 
+	c.analyzeJob(sess.job)
+
+	// Status polls are not print jobs
+	if sess.job.Metadata.ContentType == payload.StatusPoll {
+		c.handleStatusPoll(sess.job)
+		return
+	}
+
 	// Check for reprint
 	if c.reprint != nil {
-		originalID := c.reprint.Check(sess.job.GetHash(), sess.dstIP)
-		if originalID != "" {
-			sess.job.SetReprintOf(originalID)
-			c.logger.Info("reprint detected",
-				"job_id", sess.job.Metadata.JobID,
-				"original_id", originalID)
+		hash, normalizedHash := sess.job.GetHash(), sess.job.GetNormalizedHash()
+		if m, ok := c.reprint.Check(hash, normalizedHash, sess.dstIP); ok {
+			if m.PrinterIP == sess.dstIP {
+				sess.job.SetReprintOf(m.JobID, m.Kind)
+				c.logger.Info("reprint detected",
+					"job_id", sess.job.Metadata.JobID,
+					"original_id", m.JobID,
+					"match", m.Kind)
+			} else if c.cfg.Storage.RerouteDetection {
+				sess.job.SetReroutedFrom(m.JobID, m.PrinterIP, m.Kind)
+				c.logger.Info("rerouted job detected",
+					"job_id", sess.job.Metadata.JobID,
+					"original_id", m.JobID,
+					"original_printer_ip", m.PrinterIP,
+					"printer_ip", sess.dstIP,
+					"match", m.Kind)
+			}
 		}
-		c.reprint.Record(sess.job.GetHash(), sess.dstIP, sess.job.Metadata.JobID)
+		c.reprint.Record(hash, normalizedHash, sess.dstIP, sess.job.Metadata.JobID)
 	}
 
-	// Save to disk
+	// Keep the original packets of jobs whose stream was irregular
+	if len(sess.job.Metadata.Anomalies) > 0 {
+		c.logger.Warn("irregular TCP stream",
+			"job_id", sess.job.Metadata.JobID,
+			"anomalies", sess.job.Metadata.Anomalies)
+		if c.cfg.Capture.PcapOnAnomaly && c.ring.enabled() {
+			var buf bytes.Buffer
+			if _, err := c.ring.writePcap(&buf, c.linkType, c.cfg.Capture.SnapLen, sess.job.Metadata.JobID); err != nil {
+				c.logger.Warn("failed to export job packets",
+					"job_id", sess.job.Metadata.JobID,
+					"error", err)
+			} else {
+				sess.job.AttachPcap(buf.Bytes())
+			}
+		}
+	}
+
+	// Save to disk, or hold the job back until the disk recovers
 	if err := c.store.Save(sess.job); err != nil {
+		if c.spool.add(sess.job, err) {
+			return
+		}
 		c.stats.ParseErrors.Add(1)
 		c.logger.Error("failed to save job",
 			"job_id", sess.job.Metadata.JobID,
@@ -366,7 +484,63 @@ func (c *Capturer) finalizeSession(sess *session) {
 		"printer_ip", sess.job.Metadata.PrinterIP,
 		"src_ip", sess.job.Metadata.SrcIP,
 		"bytes", sess.job.Metadata.ByteLen,
-		"transport", sess.job.Metadata.Transport)
+		"transport", sess.job.Metadata.Transport,
+		"content_type", sess.job.Metadata.ContentType)
+}
+
+func (c *Capturer) handleStatusPoll(j *job.Job) {
+	if c.cfg.Capture.StatusPolls != "store" {
+		c.stats.PollsDropped.Add(1)
+		c.logger.Debug("dropping status poll session",
+			"job_id", j.Metadata.JobID,
+			"printer_ip", j.Metadata.PrinterIP,
+			"bytes", j.Metadata.ByteLen)
+		return
+	}
+
+	j.AddTag("poll")
+	if err := c.store.Save(j); err != nil {
+		if c.spool.add(j, err) {
+			return
+		}
+		c.stats.ParseErrors.Add(1)
+		c.logger.Error("failed to save status poll",
+			"job_id", j.Metadata.JobID,
+			"error", err)
+		return
+	}
+
+	c.stats.PollsStored.Add(1)
+	c.logger.Debug("status poll stored",
+		"job_id", j.Metadata.JobID,
+		"printer_ip", j.Metadata.PrinterIP,
+		"bytes", j.Metadata.ByteLen)
+}
+
+// WriteJobPcap writes the captured packets of a recent job in pcap format
+// and returns their number. It returns an error wrapping ErrNoPackets if
+// the packet ring holds none.
+func (c *Capturer) WriteJobPcap(w io.Writer, jobID string) (int, error) {
+	return c.ring.writePcap(w, c.linkType, c.cfg.Capture.SnapLen, jobID)
+}
+
+// SaveJobPcap saves the captured packets of a recent job next to the job
+// in the store, as if pcap_on_anomaly had saved them, and returns their
+// number. It returns an error wrapping ErrNoPackets if the packet ring
+// holds none, and job.ErrPcapExists if the job already has packets.
+func (c *Capturer) SaveJobPcap(jobID string) (int, error) {
+	var buf bytes.Buffer
+	n, err := c.ring.writePcap(&buf, c.linkType, c.cfg.Capture.SnapLen, jobID)
+	if err != nil {
+		return 0, err
+	}
+	if err := c.store.AttachPcap(jobID, buf.Bytes()); err != nil {
+		return 0, err
+	}
+	c.logger.Info("saved job packets",
+		"job_id", jobID,
+		"packets", n)
+	return n, nil
 }
 
 // GetActiveSessions returns the number of active sessions.
@@ -0,0 +1,112 @@
+package capture
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// ringPacketOverhead approximates the memory a ring entry takes besides
+// the packet data.
+const ringPacketOverhead = 128
+
+// packetRing keeps the raw packets of recent sessions, labeled with the
+// job they belong to, so that the packets of a job can be exported as pcap
+// when its reassembled payload looks wrong. Packets are dropped oldest
+// first once they exceed the size bound or the maximum age.
+type packetRing struct {
+	maxBytes int64
+	maxAge   time.Duration
+	packets  []ringPacket
+	bytes    int64
+	mu       sync.Mutex
+}
+
+type ringPacket struct {
+	jobID string
+	ci    gopacket.CaptureInfo
+	data  []byte
+}
+
+func newPacketRing(maxMB int, maxAge time.Duration) *packetRing {
+	return &packetRing{
+		maxBytes: int64(maxMB) * 1024 * 1024,
+		maxAge:   maxAge,
+	}
+}
+
+// enabled reports whether the ring keeps packets.
+func (r *packetRing) enabled() bool {
+	return r.maxBytes > 0
+}
+
+// add records a packet of the job. The packet data is copied, as the
+// packet source reuses its buffers.
+func (r *packetRing) add(jobID string, packet gopacket.Packet) {
+	if !r.enabled() {
+		return
+	}
+
+	p := ringPacket{
+		jobID: jobID,
+		ci:    packet.Metadata().CaptureInfo,
+		data:  append([]byte(nil), packet.Data()...),
+	}
+	p.ci.CaptureLength = len(p.data)
+	if p.ci.Length < p.ci.CaptureLength {
+		p.ci.Length = p.ci.CaptureLength
+	}
+	if p.ci.Timestamp.IsZero() {
+		p.ci.Timestamp = time.Now()
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.packets = append(r.packets, p)
+	r.bytes += int64(len(p.data)) + ringPacketOverhead
+
+	// Drop packets beyond the size bound or older than the maximum age
+	cutoff := p.ci.Timestamp.Add(-r.maxAge)
+	drop := 0
+	for drop < len(r.packets)-1 &&
+		(r.bytes > r.maxBytes || r.packets[drop].ci.Timestamp.Before(cutoff)) {
+		r.bytes -= int64(len(r.packets[drop].data)) + ringPacketOverhead
+		r.packets[drop] = ringPacket{}
+		drop++
+	}
+	r.packets = r.packets[drop:]
+}
+
+// writePcap writes the packets of a job in pcap format and returns their
+// number. It returns an error if the ring holds no packets of the job.
+func (r *packetRing) writePcap(w io.Writer, linkType layers.LinkType, snapLen int, jobID string) (int, error) {
+	r.mu.Lock()
+	var packets []ringPacket
+	for _, p := range r.packets {
+		if p.jobID == jobID {
+			packets = append(packets, p)
+		}
+	}
+	r.mu.Unlock()
+
+	if len(packets) == 0 {
+		return 0, fmt.Errorf("%w: %s", ErrNoPackets, jobID)
+	}
+
+	pw := pcapgo.NewWriterNanos(w)
+	if err := pw.WriteFileHeader(uint32(snapLen), linkType); err != nil {
+		return 0, fmt.Errorf("writing pcap header: %w", err)
+	}
+	for _, p := range packets {
+		if err := pw.WritePacket(p.ci, p.data); err != nil {
+			return 0, fmt.Errorf("writing packet: %w", err)
+		}
+	}
+	return len(packets), nil
+}
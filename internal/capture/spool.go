@@ -0,0 +1,436 @@
+package capture
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/marcenggist/kitchen-printer-tap/internal/config"
+	"github.com/marcenggist/kitchen-printer-tap/internal/job"
+	"github.com/marcenggist/kitchen-printer-tap/internal/payload"
+)
+
+// spool holds jobs that could not be saved, for example because the disk
+// is full or the SD card was remounted read-only, and retries saving them
+// in capture order until the disk recovers. Jobs are kept in memory, or as
+// files in the spool directory if one is configured, up to a total size.
+type spool struct {
+	store    job.JobStore
+	keys     *job.Keyring
+	dir      string
+	maxBytes int64
+	interval time.Duration
+	stats    *Stats
+	logger   *slog.Logger
+	entries  []*spoolEntry
+	bytes    int64
+	mu       sync.Mutex
+	done     chan struct{}
+	wg       sync.WaitGroup
+}
+
+// spoolEntry is a spooled job, held in memory or, if job is nil, in the
+// file at path.
+type spoolEntry struct {
+	id        string
+	job       *job.Job
+	path      string
+	size      int64
+	spooledAt time.Time
+}
+
+// spooledJob is the format of the files in the spool directory.
+type spooledJob struct {
+	Metadata    job.Metadata     `json:"metadata"`
+	Data        []byte           `json:"data"`
+	Attachments []job.Attachment `json:"attachments,omitempty"`
+	SpooledAt   time.Time        `json:"spooled_at"`
+}
+
+// sealedSpooledJob is the format of the files in the spool directory when
+// encryption is configured: a spooledJob encrypted with the active key, so
+// that spooled tickets are protected like stored ones.
+type sealedSpooledJob struct {
+	KeyID  string `json:"key_id"`
+	Sealed []byte `json:"sealed"`
+}
+
+// spoolQuarantineDir is the directory below the spool directory that
+// receives spool files that cannot be read, such as files sealed with a key
+// that was removed from the key file. They are kept for the operator to
+// recover, never deleted.
+const spoolQuarantineDir = "quarantine"
+
+// spoolAAD binds a sealed spool file to its job.
+func spoolAAD(jobID string) string {
+	return "spool/" + jobID
+}
+
+func newSpool(cfg *config.StorageConfig, store job.JobStore, keys *job.Keyring, stats *Stats, logger *slog.Logger) *spool {
+	return &spool{
+		store:    store,
+		keys:     keys,
+		dir:      cfg.SpoolDir,
+		maxBytes: int64(cfg.SpoolMaxMB) * 1024 * 1024,
+		interval: cfg.SpoolRetryInterval,
+		stats:    stats,
+		logger:   logger,
+		done:     make(chan struct{}),
+	}
+}
+
+// start loads the jobs left in the spool directory by a previous run and
+// begins retrying.
+func (s *spool) start() {
+	if s.maxBytes == 0 {
+		return
+	}
+
+	if s.dir != "" {
+		if err := s.load(); err != nil {
+			s.logger.Warn("spool directory unavailable, spooling in memory",
+				"path", s.dir,
+				"error", err)
+			s.dir = ""
+		} else if len(s.entries) > 0 {
+			s.logger.Warn("found spooled jobs from previous run",
+				"path", s.dir,
+				"jobs", len(s.entries),
+				"bytes", s.bytes)
+		}
+	}
+
+	s.wg.Add(1)
+	go s.retryLoop()
+}
+
+// stop halts retrying after a last attempt. Jobs still in memory are lost;
+// jobs in the spool directory are saved on the next start.
+func (s *spool) stop() {
+	if s.maxBytes == 0 {
+		return
+	}
+	close(s.done)
+	s.wg.Wait()
+	s.flush()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var lost []string
+	for _, e := range s.entries {
+		if e.job != nil {
+			lost = append(lost, e.id)
+		}
+	}
+	if len(lost) > 0 {
+		s.logger.Error("spooled jobs lost on shutdown",
+			"jobs", lost)
+	}
+	if kept := len(s.entries) - len(lost); kept > 0 {
+		s.logger.Warn("spooled jobs kept for next start",
+			"path", s.dir,
+			"jobs", kept)
+	}
+}
+
+// add spools a job whose save failed with saveErr. It returns false if
+// the spool is disabled or has no room for the job.
+func (s *spool) add(j *job.Job, saveErr error) bool {
+	if s.maxBytes == 0 {
+		return false
+	}
+
+	e := &spoolEntry{
+		id:        j.Metadata.JobID,
+		job:       j,
+		size:      jobSize(j),
+		spooledAt: time.Now().UTC(),
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.bytes+e.size > s.maxBytes {
+		s.stats.SpoolDropped.Add(1)
+		s.logger.Warn("spool full",
+			"job_id", e.id,
+			"bytes", e.size,
+			"spool_depth", len(s.entries),
+			"spool_bytes", s.bytes)
+		return false
+	}
+
+	if s.dir != "" {
+		if err := s.write(e); err != nil {
+			s.logger.Warn("failed to write spool file, keeping job in memory",
+				"job_id", e.id,
+				"error", err)
+		}
+	}
+
+	s.entries = append(s.entries, e)
+	s.bytes += e.size
+	s.stats.SpoolDepth.Store(int64(len(s.entries)))
+	s.stats.SpoolBytes.Store(s.bytes)
+	s.logger.Warn("job spooled, saving failed",
+		"job_id", e.id,
+		"spool_depth", len(s.entries),
+		"spool_bytes", s.bytes,
+		"error", saveErr)
+	return true
+}
+
+// jobSize approximates the memory a job takes.
+func jobSize(j *job.Job) int64 {
+	size := int64(len(j.Data)) + 1024
+	for _, a := range j.Attachments {
+		size += int64(len(a.Data))
+	}
+	return size
+}
+
+func (s *spool) retryLoop() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		s.flush()
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// flush saves spooled jobs, oldest first, until a save fails.
+func (s *spool) flush() {
+	for {
+		s.mu.Lock()
+		if len(s.entries) == 0 {
+			s.mu.Unlock()
+			return
+		}
+		e := s.entries[0]
+		s.mu.Unlock()
+
+		j, err := e.load(s.keys)
+		if err != nil {
+			s.quarantine(e.path, err)
+			s.stats.SpoolDropped.Add(1)
+			s.drop(e)
+			continue
+		}
+
+		if err := s.store.Save(j); err != nil {
+			s.logger.Debug("saving spooled job failed",
+				"job_id", e.id,
+				"error", err)
+			return
+		}
+
+		s.remove(e)
+		if j.Metadata.ContentType == payload.StatusPoll {
+			s.stats.PollsStored.Add(1)
+		} else {
+			s.stats.JobsCaptured.Add(1)
+		}
+		s.logger.Info("spooled job saved",
+			"job_id", e.id,
+			"spooled_for", time.Since(e.spooledAt).Round(time.Second).String(),
+			"spool_depth", s.stats.SpoolDepth.Load())
+	}
+}
+
+// remove drops the oldest entry, which must be e, and deletes its file.
+func (s *spool) remove(e *spoolEntry) {
+	if e.path != "" {
+		os.Remove(e.path)
+	}
+	s.drop(e)
+}
+
+// drop drops the oldest entry, which must be e, leaving its file alone.
+func (s *spool) drop(e *spoolEntry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries = s.entries[1:]
+	s.bytes -= e.size
+	s.stats.SpoolDepth.Store(int64(len(s.entries)))
+	s.stats.SpoolBytes.Store(s.bytes)
+}
+
+// write moves a job from memory to a file in the spool directory. The file
+// is synced before it replaces the job in memory.
+func (s *spool) write(e *spoolEntry) error {
+	data, err := json.Marshal(spooledJob{
+		Metadata:    e.job.Metadata,
+		Data:        e.job.Data,
+		Attachments: e.job.Attachments,
+		SpooledAt:   e.spooledAt,
+	})
+	if err != nil {
+		return err
+	}
+	if s.keys != nil {
+		keyID, sealed, err := s.keys.Seal(data, spoolAAD(e.id))
+		if err != nil {
+			return err
+		}
+		if data, err = json.Marshal(sealedSpooledJob{KeyID: keyID, Sealed: sealed}); err != nil {
+			return err
+		}
+	}
+
+	path := filepath.Join(s.dir, e.id+".json")
+	if err := writeSynced(path+".tmp", data); err != nil {
+		os.Remove(path + ".tmp")
+		return err
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		os.Remove(path + ".tmp")
+		return err
+	}
+	if dir, err := os.Open(s.dir); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+
+	e.job = nil
+	e.path = path
+	e.size = int64(len(data))
+	return nil
+}
+
+// writeSynced writes data to a new file at path and syncs it to disk.
+func writeSynced(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0640)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// load returns the spooled job.
+func (e *spoolEntry) load(keys *job.Keyring) (*job.Job, error) {
+	if e.job != nil {
+		return e.job, nil
+	}
+	sj, err := readSpoolFile(e.path, keys)
+	if err != nil {
+		return nil, err
+	}
+	return job.NewClosed(sj.Metadata, sj.Data, sj.Attachments), nil
+}
+
+// readSpoolFile reads a spool file, decrypting it if it was sealed.
+func readSpoolFile(path string, keys *job.Keyring) (*spooledJob, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var sealed sealedSpooledJob
+	if err := json.Unmarshal(data, &sealed); err != nil {
+		return nil, fmt.Errorf("parsing spool file: %w", err)
+	}
+	if sealed.KeyID != "" {
+		if keys == nil {
+			return nil, fmt.Errorf("spool file is encrypted with key %q but no key file is configured", sealed.KeyID)
+		}
+		jobID := strings.TrimSuffix(filepath.Base(path), ".json")
+		if data, err = keys.Open(sealed.KeyID, sealed.Sealed, spoolAAD(jobID)); err != nil {
+			return nil, fmt.Errorf("decrypting spool file: %w", err)
+		}
+	}
+
+	var sj spooledJob
+	if err := json.Unmarshal(data, &sj); err != nil {
+		return nil, fmt.Errorf("parsing spool file: %w", err)
+	}
+	return &sj, nil
+}
+
+// load creates the spool directory and picks up the jobs in it.
+func (s *spool) load() error {
+	if err := os.MkdirAll(s.dir, 0750); err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+
+	for _, de := range entries {
+		path := filepath.Join(s.dir, de.Name())
+		if strings.HasSuffix(de.Name(), ".tmp") {
+			os.Remove(path)
+			continue
+		}
+		if de.IsDir() || !strings.HasSuffix(de.Name(), ".json") {
+			continue
+		}
+
+		info, err := de.Info()
+		if err != nil {
+			continue
+		}
+		sj, err := readSpoolFile(path, s.keys)
+		if err != nil {
+			s.quarantine(path, err)
+			continue
+		}
+		s.entries = append(s.entries, &spoolEntry{
+			id:        sj.Metadata.JobID,
+			path:      path,
+			size:      info.Size(),
+			spooledAt: sj.SpooledAt,
+		})
+		s.bytes += info.Size()
+	}
+
+	sort.Slice(s.entries, func(i, k int) bool {
+		return s.entries[i].spooledAt.Before(s.entries[k].spooledAt)
+	})
+	s.stats.SpoolDepth.Store(int64(len(s.entries)))
+	s.stats.SpoolBytes.Store(s.bytes)
+	return nil
+}
+
+// quarantine moves a spool file that cannot be read, because of readErr,
+// to the quarantine directory. If that fails the file is left in place and
+// tried again on the next start.
+func (s *spool) quarantine(path string, readErr error) {
+	dir := filepath.Join(s.dir, spoolQuarantineDir)
+	dest := filepath.Join(dir, filepath.Base(path))
+	err := os.MkdirAll(dir, 0750)
+	if err == nil {
+		err = os.Rename(path, dest)
+	}
+	if err != nil {
+		s.logger.Error("unreadable spool file left in place",
+			"path", path,
+			"error", readErr,
+			"quarantine_error", err)
+		return
+	}
+	s.logger.Error("unreadable spool file quarantined",
+		"path", dest,
+		"error", readErr)
+}
@@ -0,0 +1,228 @@
+package capture
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/marcenggist/kitchen-printer-tap/internal/config"
+	"github.com/marcenggist/kitchen-printer-tap/internal/job"
+)
+
+var errDiskFull = errors.New("disk full")
+
+// failingStore is a job store whose saves fail while failing is set.
+type failingStore struct {
+	failing bool
+	saved   []string
+}
+
+func (s *failingStore) Save(j *job.Job) error {
+	if s.failing {
+		return errDiskFull
+	}
+	s.saved = append(s.saved, j.Metadata.JobID)
+	return nil
+}
+
+func (s *failingStore) Get(jobID string) (*job.StoredJob, error) {
+	return nil, job.ErrJobNotFound
+}
+
+func (s *failingStore) List(opts job.ListOptions) ([]job.Metadata, error) {
+	return nil, nil
+}
+
+func (s *failingStore) Delete(jobID string) error {
+	return job.ErrJobNotFound
+}
+
+func (s *failingStore) MarkUploaded(jobID string, status job.UploadStatus) error {
+	return job.ErrJobNotFound
+}
+
+func (s *failingStore) AttachPcap(jobID string, pcapData []byte) error {
+	return job.ErrJobNotFound
+}
+
+func newTestSpool(dir string, store job.JobStore, keys *job.Keyring) *spool {
+	cfg := config.DefaultConfig().Storage
+	cfg.SpoolDir = dir
+	cfg.SpoolMaxMB = 1
+	cfg.SpoolRetryInterval = time.Hour
+	return newSpool(&cfg, store, keys, &Stats{}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+}
+
+func newTestKeyring(t *testing.T, keyID string) *job.Keyring {
+	t.Helper()
+	key, err := job.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "keys")
+	if err := os.WriteFile(path, []byte(keyID+" "+key+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := job.LoadKeyring(path)
+	if err != nil {
+		t.Fatalf("LoadKeyring: %v", err)
+	}
+	return keys
+}
+
+// spoolTestJobs spools n jobs into a spool whose store is failing and
+// returns their IDs.
+func spoolTestJobs(t *testing.T, s *spool, n int) []string {
+	t.Helper()
+	var ids []string
+	for i := 0; i < n; i++ {
+		j := job.New("kptap-001", "site-1", "10.0.0.5", 9100, "10.0.0.2", "raw")
+		j.Append([]byte(fmt.Sprintf("\x1b@TABLE %d\n2x Schnitzel\n\x1dV\x00", i+1)))
+		j.Close()
+		if !s.add(j, errDiskFull) {
+			t.Fatalf("job %d not spooled", i)
+		}
+		ids = append(ids, j.Metadata.JobID)
+	}
+	return ids
+}
+
+func TestSpoolRetry(t *testing.T) {
+	for _, dir := range []string{"", "dir"} {
+		t.Run(fmt.Sprintf("dir=%q", dir), func(t *testing.T) {
+			if dir != "" {
+				dir = t.TempDir()
+			}
+			store := &failingStore{failing: true}
+			s := newTestSpool(dir, store, nil)
+			ids := spoolTestJobs(t, s, 3)
+
+			s.flush()
+			if len(store.saved) != 0 || len(s.entries) != 3 {
+				t.Fatalf("saved %d, spooled %d while the disk is full; want 0 and 3", len(store.saved), len(s.entries))
+			}
+
+			store.failing = false
+			s.flush()
+			if !slices.Equal(store.saved, ids) {
+				t.Errorf("saved %v, want %v in spool order", store.saved, ids)
+			}
+			if len(s.entries) != 0 || s.bytes != 0 || s.stats.SpoolDepth.Load() != 0 {
+				t.Errorf("spool not empty after flush: %d jobs, %d bytes", len(s.entries), s.bytes)
+			}
+			if dir != "" {
+				if files, _ := filepath.Glob(filepath.Join(dir, "*")); len(files) != 0 {
+					t.Errorf("spool files left after flush: %v", files)
+				}
+			}
+		})
+	}
+}
+
+func TestSpoolRestart(t *testing.T) {
+	keys := newTestKeyring(t, "k1")
+	for _, encrypted := range []bool{false, true} {
+		t.Run(fmt.Sprintf("encrypted=%v", encrypted), func(t *testing.T) {
+			var k *job.Keyring
+			if encrypted {
+				k = keys
+			}
+			dir := t.TempDir()
+			s := newTestSpool(dir, &failingStore{failing: true}, k)
+			ids := spoolTestJobs(t, s, 3)
+			s.start()
+			s.stop()
+
+			store := &failingStore{}
+			restarted := newTestSpool(dir, store, k)
+			restarted.start()
+			restarted.stop()
+			if !slices.Equal(store.saved, ids) {
+				t.Errorf("saved %v after restart, want %v in spool order", store.saved, ids)
+			}
+		})
+	}
+}
+
+func TestSpoolQuarantinesUnreadableFiles(t *testing.T) {
+	tests := []struct {
+		name string
+		// damage makes the spool file at path unreadable and returns the
+		// keys to restart with
+		damage func(t *testing.T, path string) *job.Keyring
+	}{
+		{
+			name: "corrupt",
+			damage: func(t *testing.T, path string) *job.Keyring {
+				if err := os.WriteFile(path, []byte("{\"metadata\":"), 0640); err != nil {
+					t.Fatal(err)
+				}
+				return nil
+			},
+		},
+		{
+			name: "no key file",
+			damage: func(t *testing.T, path string) *job.Keyring {
+				return nil
+			},
+		},
+		{
+			name: "key removed",
+			damage: func(t *testing.T, path string) *job.Keyring {
+				return newTestKeyring(t, "k2")
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			s := newTestSpool(dir, &failingStore{failing: true}, newTestKeyring(t, "k1"))
+			ids := spoolTestJobs(t, s, 2)
+			damaged := filepath.Join(dir, ids[0]+".json")
+			keys := tt.damage(t, damaged)
+
+			store := &failingStore{}
+			restarted := newTestSpool(dir, store, keys)
+			if err := restarted.load(); err != nil {
+				t.Fatalf("load: %v", err)
+			}
+			if _, err := os.Stat(filepath.Join(dir, spoolQuarantineDir, ids[0]+".json")); err != nil {
+				t.Errorf("unreadable spool file not quarantined: %v", err)
+			}
+			if _, err := os.Stat(damaged); !os.IsNotExist(err) {
+				t.Errorf("unreadable spool file left in the spool: %v", err)
+			}
+		})
+	}
+}
+
+func TestSpoolFlushQuarantinesUnreadableFile(t *testing.T) {
+	dir := t.TempDir()
+	store := &failingStore{failing: true}
+	s := newTestSpool(dir, store, nil)
+	ids := spoolTestJobs(t, s, 2)
+
+	// The file is damaged after it was spooled
+	if err := os.WriteFile(filepath.Join(dir, ids[0]+".json"), []byte("garbage"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	store.failing = false
+	s.flush()
+
+	if !slices.Equal(store.saved, ids[1:]) {
+		t.Errorf("saved %v, want %v", store.saved, ids[1:])
+	}
+	if _, err := os.Stat(filepath.Join(dir, spoolQuarantineDir, ids[0]+".json")); err != nil {
+		t.Errorf("unreadable spool file not quarantined: %v", err)
+	}
+	if got := s.stats.SpoolDropped.Load(); got != 1 {
+		t.Errorf("SpoolDropped = %d, want 1", got)
+	}
+}
@@ -3,9 +3,13 @@ package config
 import (
 	"fmt"
 	"os"
+	"slices"
 	"time"
 
 	"gopkg.in/yaml.v3"
+
+	"github.com/marcenggist/kitchen-printer-tap/internal/escpos"
+	"github.com/marcenggist/kitchen-printer-tap/internal/payload"
 )
 
 // Config holds all configuration for the kitchen printer tap daemon.
@@ -19,6 +23,8 @@ type Config struct {
 	Upload  UploadConfig  `yaml:"upload"`
 	Health  HealthConfig  `yaml:"health"`
 	Metrics MetricsConfig `yaml:"metrics"`
+
+	Analysis AnalysisConfig `yaml:"analysis"`
 }
 
 // CaptureConfig holds packet capture settings.
@@ -29,14 +35,72 @@ type CaptureConfig struct {
 	SnapLen         int           `yaml:"snap_len"`
 	Promiscuous     bool          `yaml:"promiscuous"`
 	BufferSizeMB    int           `yaml:"buffer_size_mb"`
+	// StatusPolls selects what happens to sessions that only carry status
+	// queries or printer initialization: "drop" or "store" (tagged "poll").
+	StatusPolls string `yaml:"status_polls"`
+	// PacketRingMB bounds the raw packets kept in memory so that the
+	// packets of recent jobs can be exported as pcap. 0 disables the ring.
+	PacketRingMB int `yaml:"packet_ring_mb"`
+	// PacketRingAge is how long packets are kept in the ring.
+	PacketRingAge time.Duration `yaml:"packet_ring_age"`
+	// PcapOnAnomaly saves the packets of jobs with sequence gaps or
+	// out-of-order segments as a .pcap file next to the job.
+	PcapOnAnomaly bool `yaml:"pcap_on_anomaly"`
 }
 
 // StorageConfig holds local storage settings.
 type StorageConfig struct {
-	BasePath         string `yaml:"base_path"`
-	MinFreeMB        int    `yaml:"min_free_mb"`
-	RetentionDays    int    `yaml:"retention_days"`
-	ReprintWindowSec int    `yaml:"reprint_window_sec"`
+	BasePath string `yaml:"base_path"`
+	// Backend selects the job layout: "files" stores each job as separate
+	// files in YYYY/MM/DD directories, "segments" appends jobs to rotating
+	// segment files below base_path/segments.
+	Backend string `yaml:"backend"`
+	// SegmentSizeMB is the size at which the segments backend starts a new
+	// segment file.
+	SegmentSizeMB int `yaml:"segment_size_mb"`
+	MinFreeMB     int `yaml:"min_free_mb"`
+	// MaxStorageMB caps the size of the job tree. When a new job does not
+	// fit, the oldest uploaded jobs are evicted. 0 disables the cap.
+	MaxStorageMB int `yaml:"max_storage_mb"`
+	// QuotaEvictUnuploaded lets the quota also evict jobs that have not
+	// been uploaded yet, once no uploaded jobs are left.
+	QuotaEvictUnuploaded bool `yaml:"quota_evict_unuploaded"`
+	// Compression of stored .bin payloads: none, gzip or zstd.
+	Compression string `yaml:"compression"`
+	// EncryptionKeyFile enables AES-GCM encryption of stored payloads and
+	// attachments with the keys in this file (see job.LoadKeyring).
+	EncryptionKeyFile string `yaml:"encryption_key_file"`
+	// EncryptMetadata also encrypts the .json metadata files.
+	EncryptMetadata bool `yaml:"encrypt_metadata"`
+	// DeviceKeyFile is the device's Ed25519 signing key, generated on
+	// first start. Empty disables signing.
+	DeviceKeyFile string `yaml:"device_key_file"`
+	// IndexFile is the embedded job index used for queries. Empty
+	// disables indexing.
+	IndexFile     string `yaml:"index_file"`
+	RetentionDays int    `yaml:"retention_days"`
+	// RetentionDeleteUnuploaded lets retention delete expired jobs that
+	// have not been uploaded yet. Implied when upload is disabled.
+	RetentionDeleteUnuploaded bool `yaml:"retention_delete_unuploaded"`
+	ReprintWindowSec          int  `yaml:"reprint_window_sec"`
+	// ReprintNormalized enables reprint matching on the ticket text with
+	// the volatile fields in ReprintMasks masked out.
+	ReprintNormalized bool     `yaml:"reprint_normalized"`
+	ReprintMasks      []string `yaml:"reprint_masks"`
+	// RerouteDetection tags jobs identical to a job sent to another
+	// printer within the reprint window as "rerouted".
+	RerouteDetection bool `yaml:"reroute_detection"`
+	// ReprintMaxEntries bounds the jobs remembered for reprint detection;
+	// the least recently used are evicted first.
+	ReprintMaxEntries int `yaml:"reprint_max_entries"`
+	// SpoolMaxMB bounds the jobs held back when saving fails, to be saved
+	// once the disk recovers. 0 disables the spool.
+	SpoolMaxMB int `yaml:"spool_max_mb"`
+	// SpoolDir keeps spooled jobs as files in this directory instead of in
+	// memory, typically on a tmpfs so that they survive a tapd restart.
+	SpoolDir string `yaml:"spool_dir"`
+	// SpoolRetryInterval is how often saving spooled jobs is retried.
+	SpoolRetryInterval time.Duration `yaml:"spool_retry_interval"`
 }
 
 // UploadConfig holds webhook upload settings.
@@ -48,6 +112,9 @@ type UploadConfig struct {
 	RetryBackoff time.Duration `yaml:"retry_backoff"`
 	Timeout      time.Duration `yaml:"timeout"`
 	BatchSize    int           `yaml:"batch_size"`
+	// ContentTypes limits uploads to jobs of these content types.
+	// Empty uploads all jobs.
+	ContentTypes []string `yaml:"content_types"`
 }
 
 // HealthConfig holds health endpoint settings.
@@ -62,6 +129,20 @@ type MetricsConfig struct {
 	Interval time.Duration `yaml:"interval"`
 }
 
+// AnalysisConfig holds settings for decoding captured print data.
+type AnalysisConfig struct {
+	ExtractRasters bool `yaml:"extract_rasters"`
+	DecodeBarcodes bool `yaml:"decode_barcodes"`
+	// CodePage is the printer code page assumed until the job selects one
+	// with ESC t (cp437, cp850, cp858 or cp1252).
+	CodePage      string `yaml:"code_page"`
+	ExtractOrders bool   `yaml:"extract_orders"`
+	TemplatesDir  string `yaml:"templates_dir"`
+	// VoidWindow is how long printed orders are remembered for linking
+	// cancellation tickets to them.
+	VoidWindow time.Duration `yaml:"void_window"`
+}
+
 // DefaultConfig returns a configuration with sensible defaults.
 func DefaultConfig() *Config {
 	return &Config{
@@ -75,12 +156,32 @@ func DefaultConfig() *Config {
 			SnapLen:         65535,
 			Promiscuous:     true,
 			BufferSizeMB:    8,
+			StatusPolls:     "drop",
+			PacketRingMB:    16,
+			PacketRingAge:   30 * time.Minute,
+			PcapOnAnomaly:   true,
 		},
 		Storage: StorageConfig{
-			BasePath:         "/var/lib/kitchen-printer-tap",
-			MinFreeMB:        100,
-			RetentionDays:    30,
-			ReprintWindowSec: 300,
+			BasePath:           "/var/lib/kitchen-printer-tap",
+			Backend:            "files",
+			SegmentSizeMB:      64,
+			MinFreeMB:          100,
+			Compression:        "none",
+			DeviceKeyFile:      "/var/lib/kitchen-printer-tap/device.key",
+			IndexFile:          "/var/lib/kitchen-printer-tap/index.db",
+			RetentionDays:      30,
+			ReprintWindowSec:   300,
+			ReprintNormalized:  true,
+			RerouteDetection:   true,
+			ReprintMaxEntries:  10000,
+			SpoolMaxMB:         16,
+			SpoolRetryInterval: 10 * time.Second,
+			ReprintMasks: []string{
+				`\b\d{1,2}:\d{2}(:\d{2})?\b`,
+				`\b\d{1,4}[./-]\d{1,2}[./-]\d{2,4}\b`,
+				`(?i)\b(reprint|re-print|kopie|copy|duplikat|duplicate|nachdruck|wiederholung)\b`,
+				`(?i)\b(druck|print|copy|kopie|seq)\s*(nr\.?|no\.?|#)?\s*:?\s*\d+\b`,
+			},
 		},
 		Upload: UploadConfig{
 			Enabled:      false,
@@ -99,6 +200,14 @@ func DefaultConfig() *Config {
 			Enabled:  true,
 			Interval: 60 * time.Second,
 		},
+		Analysis: AnalysisConfig{
+			ExtractRasters: true,
+			DecodeBarcodes: true,
+			CodePage:       "cp437",
+			ExtractOrders:  true,
+			TemplatesDir:   "/etc/kitchen-printer-tap/templates",
+			VoidWindow:     12 * time.Hour,
+		},
 	}
 }
 
@@ -139,11 +248,67 @@ func (c *Config) Validate() error {
 	if c.Capture.IdleTimeout < 100*time.Millisecond {
 		return fmt.Errorf("idle_timeout must be at least 100ms")
 	}
+	if c.Capture.StatusPolls != "drop" && c.Capture.StatusPolls != "store" {
+		return fmt.Errorf("status_polls must be \"drop\" or \"store\"")
+	}
+	if c.Capture.PacketRingMB < 0 {
+		return fmt.Errorf("packet_ring_mb must not be negative")
+	}
+	if c.Capture.PacketRingMB > 0 && c.Capture.PacketRingAge <= 0 {
+		return fmt.Errorf("packet_ring_age must be positive")
+	}
 	if c.Storage.BasePath == "" {
 		return fmt.Errorf("storage base_path is required")
 	}
+	switch c.Storage.Backend {
+	case "files", "segments":
+	default:
+		return fmt.Errorf("storage backend must be \"files\" or \"segments\"")
+	}
+	if c.Storage.Backend == "segments" && c.Storage.SegmentSizeMB < 1 {
+		return fmt.Errorf("segment_size_mb must be at least 1")
+	}
+	if c.Storage.MaxStorageMB < 0 {
+		return fmt.Errorf("max_storage_mb must not be negative")
+	}
+	// Without uploads no job is ever uploaded, so the quota could never
+	// evict anything and saving would fail once the disk fills up
+	if c.Storage.MaxStorageMB > 0 && !c.Upload.Enabled && !c.Storage.QuotaEvictUnuploaded {
+		return fmt.Errorf("quota_evict_unuploaded is required when max_storage_mb is set and upload is disabled")
+	}
+	switch c.Storage.Compression {
+	case "none", "gzip", "zstd":
+	default:
+		return fmt.Errorf("compression must be \"none\", \"gzip\" or \"zstd\"")
+	}
+	if c.Storage.EncryptMetadata && c.Storage.EncryptionKeyFile == "" {
+		return fmt.Errorf("encryption_key_file is required when encrypt_metadata is enabled")
+	}
+	if c.Storage.RetentionDays < 0 {
+		return fmt.Errorf("retention_days must not be negative")
+	}
+	if c.Storage.ReprintMaxEntries < 0 {
+		return fmt.Errorf("reprint_max_entries must not be negative")
+	}
+	if c.Storage.SpoolMaxMB < 0 {
+		return fmt.Errorf("spool_max_mb must not be negative")
+	}
+	if c.Storage.SpoolMaxMB > 0 && c.Storage.SpoolRetryInterval < time.Second {
+		return fmt.Errorf("spool_retry_interval must be at least 1s")
+	}
 	if c.Upload.Enabled && c.Upload.WebhookURL == "" {
 		return fmt.Errorf("webhook_url is required when upload is enabled")
 	}
+	for _, ct := range c.Upload.ContentTypes {
+		if !slices.Contains(payload.ContentTypes, ct) {
+			return fmt.Errorf("unknown upload content type %q", ct)
+		}
+	}
+	if !escpos.ValidCodePage(c.Analysis.CodePage) {
+		return fmt.Errorf("unsupported code_page %q", c.Analysis.CodePage)
+	}
+	if c.Analysis.ExtractOrders && c.Analysis.TemplatesDir == "" {
+		return fmt.Errorf("templates_dir is required when extract_orders is enabled")
+	}
 	return nil
 }
@@ -0,0 +1,143 @@
+package escpos
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Barcode is a one- or two-dimensional code printed by the job.
+type Barcode struct {
+	// Symbology is the code type, e.g. "CODE128" or "QR".
+	Symbology string
+	Data      string
+	// Command is the command that carried the code, "GS k" or "GS ( k".
+	Command string
+	Offset  int
+}
+
+var barcodeSymbologies = map[byte]string{
+	0: "UPC-A", 1: "UPC-E", 2: "EAN13", 3: "EAN8", 4: "CODE39", 5: "ITF", 6: "CODABAR",
+	65: "UPC-A", 66: "UPC-E", 67: "EAN13", 68: "EAN8", 69: "CODE39", 70: "ITF", 71: "CODABAR",
+	72: "CODE93", 73: "CODE128", 74: "GS1-128", 75: "GS1-DATABAR-OMNI",
+	76: "GS1-DATABAR-TRUNCATED", 77: "GS1-DATABAR-LIMITED", 78: "GS1-DATABAR-EXPANDED",
+	79: "CODE128-AUTO",
+}
+
+// symbol codes (cn) of GS ( k
+var symbolSymbologies = map[byte]string{
+	48: "PDF417",
+	49: "QR",
+	50: "MAXICODE",
+	51: "GS1-DATABAR",
+	52: "COMPOSITE",
+	53: "AZTEC",
+	54: "DATAMATRIX",
+}
+
+// Barcodes decodes all barcodes (GS k) and 2D symbols (GS ( k) in data.
+// For 2D symbols the data stored in the symbol save area is reported.
+func Barcodes(data []byte) []Barcode {
+	var codes []Barcode
+
+	s := NewScanner(data)
+	for s.Scan() {
+		tok := s.Token()
+
+		switch tok.Name {
+		case "GS k":
+			if bc, ok := decodeBarcode(tok.Params); ok {
+				bc.Command = tok.Name
+				bc.Offset = tok.Offset
+				codes = append(codes, bc)
+			}
+		case "GS ( k":
+			if bc, ok := decodeSymbol(tok.Params); ok {
+				bc.Command = tok.Name
+				bc.Offset = tok.Offset
+				codes = append(codes, bc)
+			}
+		}
+	}
+
+	return codes
+}
+
+// decodeBarcode decodes GS k parameters: m d1...dk NUL (m = 0..6) or
+// m n d1...dn (m = 65..79).
+func decodeBarcode(p []byte) (Barcode, bool) {
+	if len(p) < 2 {
+		return Barcode{}, false
+	}
+	m := p[0]
+	symbology, ok := barcodeSymbologies[m]
+	if !ok {
+		symbology = fmt.Sprintf("BARCODE-%d", m)
+	}
+
+	var d []byte
+	if m <= 6 {
+		d = p[1:]
+		if n := len(d); n > 0 && d[n-1] == 0x00 {
+			d = d[:n-1]
+		}
+	} else {
+		n := int(p[1])
+		if len(p) < 2+n {
+			return Barcode{}, false
+		}
+		d = p[2 : 2+n]
+	}
+
+	if m == 73 || m == 74 {
+		return Barcode{Symbology: symbology, Data: decodeCode128(d)}, true
+	}
+	return Barcode{Symbology: symbology, Data: string(d)}, true
+}
+
+// decodeCode128 removes code set selectors ("{A", "{B", "{C") and expands
+// code set C digit pairs.
+func decodeCode128(d []byte) string {
+	var sb strings.Builder
+	set := byte('B')
+	for i := 0; i < len(d); i++ {
+		if d[i] == '{' && i+1 < len(d) {
+			switch next := d[i+1]; next {
+			case 'A', 'B', 'C':
+				set = next
+				i++
+				continue
+			case '{':
+				sb.WriteByte('{')
+				i++
+				continue
+			case '1':
+				// FNC1 is a GS1 separator, not data
+				i++
+				continue
+			case 'S', '2', '3', '4':
+				i++
+				continue
+			}
+		}
+		if set == 'C' {
+			fmt.Fprintf(&sb, "%02d", d[i])
+			continue
+		}
+		sb.WriteByte(d[i])
+	}
+	return sb.String()
+}
+
+// decodeSymbol decodes GS ( k parameters: pL pH cn fn m d1...dk. Only the
+// store data function (fn 80) carries symbol content.
+func decodeSymbol(p []byte) (Barcode, bool) {
+	if len(p) < 5 || p[3] != 80 {
+		return Barcode{}, false
+	}
+	cn := p[2]
+	symbology, ok := symbolSymbologies[cn]
+	if !ok {
+		symbology = fmt.Sprintf("SYMBOL-%d", cn)
+	}
+	return Barcode{Symbology: symbology, Data: string(p[5:])}, true
+}
@@ -0,0 +1,85 @@
+package escpos
+
+import "strings"
+
+// Upper halves (0x80-0xFF) of the code pages commonly used by kitchen
+// printers in German-speaking sites.
+var (
+	cp437 = []rune("ÇüéâäàåçêëèïîìÄÅ" +
+		"ÉæÆôöòûùÿÖÜ¢£¥₧ƒ" +
+		"áíóúñÑªº¿⌐¬½¼¡«»" +
+		"░▒▓│┤╡╢╖╕╣║╗╝╜╛┐" +
+		"└┴┬├─┼╞╟╚╔╩╦╠═╬╧" +
+		"╨╤╥╙╘╒╓╫╪┘┌█▄▌▐▀" +
+		"αßΓπΣσµτΦΘΩδ∞φε∩" +
+		"≡±≥≤⌠⌡÷≈°∙·√ⁿ²■ ")
+
+	cp850 = []rune("ÇüéâäàåçêëèïîìÄÅ" +
+		"ÉæÆôöòûùÿÖÜø£Ø×ƒ" +
+		"áíóúñÑªº¿®¬½¼¡«»" +
+		"░▒▓│┤ÁÂÀ©╣║╗╝¢¥┐" +
+		"└┴┬├─┼ãÃ╚╔╩╦╠═╬¤" +
+		"ðÐÊËÈıÍÎÏ┘┌█▄¦Ì▀" +
+		"ÓßÔÒõÕµþÞÚÛÙýÝ¯´" +
+		"­±‗¾¶§÷¸°¨·¹³²■ ")
+
+	cp858 = func() []rune {
+		r := append([]rune(nil), cp850...)
+		r[0xD5-0x80] = '€'
+		return r
+	}()
+
+	cp1252 = func() []rune {
+		r := make([]rune, 128)
+		for i := range r {
+			r[i] = rune(0x80 + i)
+		}
+		copy(r, []rune("€�‚ƒ„…†‡ˆ‰Š‹Œ�Ž�"+
+			"�‘’“”•–—˜™š›œ�žŸ"))
+		return r
+	}()
+)
+
+// code page tables selected with ESC t n
+var codePagesByNumber = map[byte][]rune{
+	0:  cp437,
+	2:  cp850,
+	16: cp1252,
+	19: cp858,
+}
+
+// codePageTable returns the upper-half table for a code page name such as
+// "cp437", "cp850", "cp858" or "cp1252". Unknown names yield CP437.
+func codePageTable(name string) []rune {
+	switch strings.ToLower(name) {
+	case "cp850":
+		return cp850
+	case "cp858":
+		return cp858
+	case "cp1252", "windows-1252":
+		return cp1252
+	default:
+		return cp437
+	}
+}
+
+// ValidCodePage reports whether name is a supported code page.
+func ValidCodePage(name string) bool {
+	switch strings.ToLower(name) {
+	case "", "cp437", "cp850", "cp858", "cp1252", "windows-1252":
+		return true
+	}
+	return false
+}
+
+// German international character set (ESC R 2) replacements.
+var germanChars = map[byte]rune{
+	'@':  '§',
+	'[':  'Ä',
+	'\\': 'Ö',
+	']':  'Ü',
+	'{':  'ä',
+	'|':  'ö',
+	'}':  'ü',
+	'~':  'ß',
+}
@@ -0,0 +1,198 @@
+package escpos
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+)
+
+// Raster is a bitmap image embedded in a print job.
+type Raster struct {
+	// Command is the command that carried the image, e.g. "GS v 0".
+	Command string
+	// Offset is the byte offset of the (first) command in the payload.
+	Offset int
+	Image  *image.Gray
+}
+
+// PNG encodes the raster as a PNG image.
+func (r Raster) PNG() ([]byte, error) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, r.Image); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Rasters extracts all raster images embedded in data. It understands
+// GS v 0 raster images, GS ( L / GS 8 L graphics stored in the print
+// buffer, and ESC * bit images. Consecutive ESC * stripes separated only by
+// line feeds are stitched into a single image, since that is how drivers
+// print a bitmap ticket.
+func Rasters(data []byte) []Raster {
+	var rasters []Raster
+	var band *stripeBand
+
+	flush := func() {
+		if band != nil {
+			rasters = append(rasters, band.raster())
+			band = nil
+		}
+	}
+
+	s := NewScanner(data)
+	for s.Scan() {
+		tok := s.Token()
+
+		switch tok.Name {
+		case "ESC *":
+			img := bitImage(tok.Params)
+			if img == nil {
+				continue
+			}
+			if band == nil {
+				band = &stripeBand{offset: tok.Offset}
+			}
+			band.stripes = append(band.stripes, img)
+			continue
+		case "LF", "CR", "ESC 2", "ESC 3", "ESC J", "ESC a", "ESC $", "GS L":
+			// Layout commands between stripes do not end a band.
+			continue
+		}
+
+		flush()
+
+		var img *image.Gray
+		switch tok.Name {
+		case "GS v 0":
+			img = rasterBitImage(tok.Params)
+		case "GS ( L":
+			if len(tok.Params) >= 2 {
+				img = graphicsImage(tok.Params[2:])
+			}
+		case "GS 8 L":
+			if len(tok.Params) >= 4 {
+				img = graphicsImage(tok.Params[4:])
+			}
+		}
+		if img != nil {
+			rasters = append(rasters, Raster{
+				Command: tok.Name,
+				Offset:  tok.Offset,
+				Image:   img,
+			})
+		}
+	}
+	flush()
+
+	return rasters
+}
+
+// rasterBitImage decodes GS v 0 parameters: m xL xH yL yH d1...dk.
+func rasterBitImage(p []byte) *image.Gray {
+	if len(p) < 5 {
+		return nil
+	}
+	widthBytes := int(p[1]) + int(p[2])*256
+	height := int(p[3]) + int(p[4])*256
+	return packedImage(p[5:], widthBytes*8, widthBytes, height)
+}
+
+// graphicsImage decodes the raster graphics store function of GS ( L and
+// GS 8 L: m fn a bx by c xL xH yL yH d1...dk. Only fn 112 (store raster
+// graphics in the print buffer) carries image data.
+func graphicsImage(p []byte) *image.Gray {
+	if len(p) < 10 || p[0] != 48 || p[1] != 112 {
+		return nil
+	}
+	width := int(p[6]) + int(p[7])*256
+	height := int(p[8]) + int(p[9])*256
+	return packedImage(p[10:], width, (width+7)/8, height)
+}
+
+// packedImage builds an image from row-major, MSB-first 1bpp data.
+func packedImage(d []byte, width, rowBytes, height int) *image.Gray {
+	if width == 0 || height == 0 || int64(len(d)) < int64(rowBytes)*int64(height) {
+		return nil
+	}
+
+	img := newWhite(width, height)
+	for y := 0; y < height; y++ {
+		row := d[y*rowBytes : (y+1)*rowBytes]
+		for x := 0; x < width; x++ {
+			if row[x/8]&(0x80>>(x%8)) != 0 {
+				img.SetGray(x, y, color.Gray{Y: 0})
+			}
+		}
+	}
+	return img
+}
+
+// bitImage decodes ESC * parameters: m nL nH d1...dk. Data is column-major
+// with 8 (m = 0, 1) or 24 (m = 32, 33) vertical dots per column.
+func bitImage(p []byte) *image.Gray {
+	if len(p) < 3 {
+		return nil
+	}
+	m := p[0]
+	width := int(p[1]) + int(p[2])*256
+	colBytes := 1
+	if m == 32 || m == 33 {
+		colBytes = 3
+	}
+	d := p[3:]
+	if width == 0 || len(d) < width*colBytes {
+		return nil
+	}
+
+	height := colBytes * 8
+	img := newWhite(width, height)
+	for x := 0; x < width; x++ {
+		col := d[x*colBytes : (x+1)*colBytes]
+		for y := 0; y < height; y++ {
+			if col[y/8]&(0x80>>(y%8)) != 0 {
+				img.SetGray(x, y, color.Gray{Y: 0})
+			}
+		}
+	}
+	return img
+}
+
+// stripeBand collects consecutive ESC * stripes into one image.
+type stripeBand struct {
+	offset  int
+	stripes []*image.Gray
+}
+
+func (b *stripeBand) raster() Raster {
+	width, height := 0, 0
+	for _, s := range b.stripes {
+		width = max(width, s.Bounds().Dx())
+		height += s.Bounds().Dy()
+	}
+
+	img := newWhite(width, height)
+	y := 0
+	for _, s := range b.stripes {
+		bounds := s.Bounds()
+		for sy := 0; sy < bounds.Dy(); sy++ {
+			copy(img.Pix[(y+sy)*img.Stride:], s.Pix[sy*s.Stride:sy*s.Stride+bounds.Dx()])
+		}
+		y += bounds.Dy()
+	}
+
+	return Raster{
+		Command: "ESC *",
+		Offset:  b.offset,
+		Image:   img,
+	}
+}
+
+func newWhite(width, height int) *image.Gray {
+	img := image.NewGray(image.Rect(0, 0, width, height))
+	for i := range img.Pix {
+		img.Pix[i] = 0xFF
+	}
+	return img
+}
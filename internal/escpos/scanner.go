@@ -0,0 +1,317 @@
+package escpos
+
+import "fmt"
+
+// Control bytes that introduce ESC/POS commands.
+const (
+	DLE = 0x10
+	ESC = 0x1B
+	FS  = 0x1C
+	GS  = 0x1D
+)
+
+// Kind identifies the type of a token in an ESC/POS stream.
+type Kind int
+
+const (
+	// KindText is a run of printable bytes.
+	KindText Kind = iota
+	// KindControl is a single-byte control code such as LF or CR.
+	KindControl
+	// KindCommand is a multi-byte ESC, GS, FS or DLE command.
+	KindCommand
+)
+
+// Token is a single element of an ESC/POS stream: either a run of text,
+// a single control byte, or a command with its parameters and data.
+type Token struct {
+	Kind   Kind
+	Offset int
+	// Name is the command name in Epson notation, e.g. "GS v 0".
+	Name string
+	// Raw holds all bytes of the token as they appear in the stream.
+	Raw []byte
+	// Params holds the bytes following the command name.
+	Params []byte
+	// Known reports whether the command is in the command table. Unknown
+	// commands are assumed to have no parameters.
+	Known bool
+}
+
+// Scanner splits an ESC/POS byte stream into tokens.
+type Scanner struct {
+	data []byte
+	pos  int
+	tok  Token
+}
+
+// NewScanner returns a scanner reading from data.
+func NewScanner(data []byte) *Scanner {
+	return &Scanner{data: data}
+}
+
+// Scan advances to the next token. It returns false at end of input.
+func (s *Scanner) Scan() bool {
+	if s.pos >= len(s.data) {
+		return false
+	}
+
+	start := s.pos
+	b := s.data[start]
+
+	switch {
+	case b == ESC || b == GS || b == FS || b == DLE:
+		name, end, known := commandLength(s.data, start)
+		s.tok = Token{
+			Kind:   KindCommand,
+			Offset: start,
+			Name:   name,
+			Raw:    s.data[start:end],
+			Params: s.data[min(start+nameLen(name), end):end],
+			Known:  known,
+		}
+		s.pos = end
+	case b < 0x20 || b == 0x7F:
+		s.tok = Token{
+			Kind:   KindControl,
+			Offset: start,
+			Name:   controlName(b),
+			Raw:    s.data[start : start+1],
+			Known:  true,
+		}
+		s.pos++
+	default:
+		end := start
+		for end < len(s.data) && isText(s.data[end]) {
+			end++
+		}
+		s.tok = Token{
+			Kind:   KindText,
+			Offset: start,
+			Raw:    s.data[start:end],
+			Known:  true,
+		}
+		s.pos = end
+	}
+
+	return true
+}
+
+// Token returns the most recent token produced by Scan.
+func (s *Scanner) Token() Token {
+	return s.tok
+}
+
+func isText(b byte) bool {
+	return b >= 0x20 && b != 0x7F
+}
+
+func controlName(b byte) string {
+	switch b {
+	case 0x09:
+		return "HT"
+	case 0x0A:
+		return "LF"
+	case 0x0C:
+		return "FF"
+	case 0x0D:
+		return "CR"
+	case 0x18:
+		return "CAN"
+	default:
+		return "CTL"
+	}
+}
+
+// nameLen returns how many bytes of the stream the command name occupies.
+// Names are space-separated, one element per byte.
+func nameLen(name string) int {
+	n := 1
+	for i := 0; i < len(name); i++ {
+		if name[i] == ' ' {
+			n++
+		}
+	}
+	return n
+}
+
+func prefixName(b byte) string {
+	switch b {
+	case ESC:
+		return "ESC"
+	case GS:
+		return "GS"
+	case FS:
+		return "FS"
+	default:
+		return "DLE"
+	}
+}
+
+func byteName(b byte) string {
+	switch {
+	case b == ' ':
+		return "SP"
+	case b > 0x20 && b < 0x7F:
+		return string(rune(b))
+	case b == 0x04:
+		return "EOT"
+	case b == 0x05:
+		return "ENQ"
+	case b == 0x14:
+		return "DC4"
+	default:
+		return fmt.Sprintf("0x%02X", b)
+	}
+}
+
+// commandLength returns the command name, the end offset and whether the
+// command is known. Lengths that run past the end of data are clamped.
+func commandLength(data []byte, start int) (string, int, bool) {
+	prefix := data[start]
+	if start+1 >= len(data) {
+		return prefixName(prefix), len(data), false
+	}
+	code := data[start+1]
+	name := prefixName(prefix) + " " + byteName(code)
+	p := start + 2 // first parameter byte
+
+	arg := func(i int) int {
+		if p+i < len(data) {
+			return int(data[p+i])
+		}
+		return 0
+	}
+	// span returns the end of n bytes starting at from, clamped to the
+	// end of data. Lengths are computed in int64 so that the 16- and 32-bit
+	// parameters of graphics commands cannot overflow int on 32-bit builds.
+	span := func(from int, n int64) int {
+		if n < 0 || n > int64(len(data)-from) {
+			return len(data)
+		}
+		return from + int(n)
+	}
+	fixed := func(n int) (string, int, bool) {
+		return name, span(p, int64(n)), true
+	}
+	untilNUL := func(from int) int {
+		for i := from; i < len(data); i++ {
+			if data[i] == 0x00 {
+				return i + 1
+			}
+		}
+		return len(data)
+	}
+
+	switch prefix {
+	case ESC:
+		switch code {
+		case '@', '2', '<', 'i', 'm', 'L', 'S', 'F', 0x0C:
+			return fixed(0)
+		case '!', '-', 'E', 'G', 'M', 'R', 't', 'a', 'd', 'J', 'e', '{', 'V', '3',
+			' ', 'r', '=', '%', 'T', 'U', '?', 'K', 'c', 'u', 'v', 'l':
+			if code == 'c' {
+				// ESC c 3 n, ESC c 4 n, ESC c 5 n
+				return name + " " + byteName(byte(arg(0))), span(p, 2), true
+			}
+			return fixed(1)
+		case '$', '\\':
+			return fixed(2)
+		case 'p':
+			return fixed(3)
+		case 'W':
+			return fixed(8)
+		case 'D':
+			return name, untilNUL(p), true
+		case '*':
+			m, n := arg(0), int64(arg(1)+arg(2)*256)
+			if m == 32 || m == 33 {
+				n *= 3
+			}
+			return name, span(p+3, n), true
+		case '&':
+			// ESC & y c1 c2 [x d1...d(y*x)]k
+			y, c1, c2 := arg(0), arg(1), arg(2)
+			end := span(p, 3)
+			for c := c1; c <= c2 && end < len(data); c++ {
+				x := int64(data[end])
+				end = span(end, 1+x*int64(y))
+			}
+			return name, end, true
+		}
+	case GS:
+		switch code {
+		case '!', 'B', 'H', 'h', 'w', 'f', 'a', 'r', 'I', 'b', '/', 'E', 'T', 'c', 'j':
+			return fixed(1)
+		case 'L', 'W', '$', '\\', 'P', 'g':
+			return fixed(2)
+		case '^':
+			return fixed(3)
+		case ':':
+			return fixed(0)
+		case 'V':
+			m := arg(0)
+			if m == 65 || m == 66 || m == 97 || m == 98 || m == 103 || m == 104 {
+				return fixed(2)
+			}
+			return fixed(1)
+		case 'k':
+			m := arg(0)
+			if m <= 6 {
+				return name, untilNUL(p + 1), true
+			}
+			return name, span(p+2, int64(arg(1))), true
+		case 'v':
+			// GS v 0 m xL xH yL yH d1...dk
+			if arg(0) != '0' {
+				break
+			}
+			w := int64(arg(2) + arg(3)*256)
+			h := int64(arg(4) + arg(5)*256)
+			return name + " 0", span(p+6, w*h), true
+		case '(':
+			// GS ( fn pL pH p1...pk
+			fn := arg(0)
+			n := int64(arg(1) + arg(2)*256)
+			return name + " " + byteName(byte(fn)), span(p+3, n), true
+		case '8':
+			// GS 8 L p1 p2 p3 p4 m fn ...
+			if arg(0) != 'L' {
+				break
+			}
+			n := int64(arg(1)) | int64(arg(2))<<8 | int64(arg(3))<<16 | int64(arg(4))<<24
+			return name + " L", span(p+5, n), true
+		case '*':
+			x, y := arg(0), arg(1)
+			return name, span(p+2, int64(x*y*8)), true
+		}
+	case FS:
+		switch code {
+		case '&', '.':
+			return fixed(0)
+		case '!', '-', 'C', 'W', 'r':
+			return fixed(1)
+		case 'p', 'S':
+			return fixed(2)
+		case '(':
+			fn := arg(0)
+			n := int64(arg(1) + arg(2)*256)
+			return name + " " + byteName(byte(fn)), span(p+3, n), true
+		}
+	case DLE:
+		switch code {
+		case 0x04:
+			// DLE EOT n, with an extra argument for n = 7 and 8
+			if n := arg(0); n == 7 || n == 8 {
+				return fixed(2)
+			}
+			return fixed(1)
+		case 0x05:
+			return fixed(1)
+		case 0x14:
+			return fixed(3)
+		}
+	}
+
+	return name, start + 2, false
+}
@@ -0,0 +1,44 @@
+package escpos
+
+import "testing"
+
+func TestScannerOversizedLengths(t *testing.T) {
+	// Length parameters that overflowed int on 32-bit builds and made
+	// the token end before its start.
+	tests := []struct {
+		name string
+		data []byte
+		cmd  string
+	}{
+		{"GS v 0", []byte{0x1d, 0x76, 0x30, 0x00, 0xff, 0xff, 0xff, 0xff, 0x01, 0x02}, "GS v 0"},
+		{"GS 8 L", []byte{0x1d, 0x38, 0x4c, 0xff, 0xff, 0xff, 0xff, 0x30, 0x70, 0x01}, "GS 8 L"},
+		{"GS 8 L high bit", []byte{0x1d, 0x38, 0x4c, 0x00, 0x00, 0x00, 0x80, 0x30, 0x70, 0x01}, "GS 8 L"},
+		{"GS ( L", []byte{0x1d, 0x28, 0x4c, 0xff, 0xff, 0x30, 0x70, 0x01, 0x02, 0x03}, "GS ( L"},
+		{"ESC *", []byte{0x1b, 0x2a, 0x21, 0xff, 0xff, 0x01, 0x02, 0x03, 0x04, 0x05}, "ESC *"},
+		{"ESC &", []byte{0x1b, 0x26, 0xff, 0x00, 0xff, 0xff, 0x01, 0x02, 0x03, 0x04}, "ESC &"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewScanner(tt.data)
+			if !s.Scan() {
+				t.Fatal("Scan returned false")
+			}
+			tok := s.Token()
+			if tok.Name != tt.cmd {
+				t.Errorf("Name = %q, want %q", tok.Name, tt.cmd)
+			}
+			if len(tok.Raw) != len(tt.data) {
+				t.Errorf("len(Raw) = %d, want %d", len(tok.Raw), len(tt.data))
+			}
+			if s.Scan() {
+				t.Errorf("unexpected token after clamped command: %+v", s.Token())
+			}
+
+			// Decoding the truncated command must not panic either
+			Rasters(tt.data)
+			Barcodes(tt.data)
+			Text(tt.data, "")
+		})
+	}
+}
@@ -0,0 +1,62 @@
+package escpos
+
+import "strings"
+
+// Text renders the printable content of an ESC/POS stream as UTF-8 text,
+// one printed line per text line. Commands are dropped, code page (ESC t)
+// and international character set (ESC R) selections are honoured, and
+// codePage names the code page in effect before any ESC t.
+func Text(data []byte, codePage string) string {
+	var sb strings.Builder
+
+	table := codePageTable(codePage)
+	german := false
+
+	s := NewScanner(data)
+	for s.Scan() {
+		tok := s.Token()
+
+		switch tok.Kind {
+		case KindText:
+			for _, b := range tok.Raw {
+				switch {
+				case b >= 0x80:
+					sb.WriteRune(table[b-0x80])
+				case german && germanChars[b] != 0:
+					sb.WriteRune(germanChars[b])
+				default:
+					sb.WriteByte(b)
+				}
+			}
+		case KindControl:
+			switch tok.Name {
+			case "LF", "FF":
+				sb.WriteByte('\n')
+			case "HT":
+				sb.WriteByte('\t')
+			}
+		case KindCommand:
+			switch tok.Name {
+			case "ESC t":
+				if len(tok.Params) == 1 {
+					if t, ok := codePagesByNumber[tok.Params[0]]; ok {
+						table = t
+					}
+				}
+			case "ESC R":
+				if len(tok.Params) == 1 {
+					german = tok.Params[0] == 2
+				}
+			case "ESC d":
+				if len(tok.Params) == 1 {
+					sb.WriteString(strings.Repeat("\n", int(tok.Params[0])))
+				}
+			case "ESC @":
+				table = codePageTable(codePage)
+				german = false
+			}
+		}
+	}
+
+	return sb.String()
+}
@@ -1,14 +1,20 @@
 package health
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"log/slog"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/marcenggist/kitchen-printer-tap/internal/capture"
 	"github.com/marcenggist/kitchen-printer-tap/internal/config"
+	"github.com/marcenggist/kitchen-printer-tap/internal/job"
 )
 
 // Status represents the health status response.
@@ -21,6 +27,11 @@ type Status struct {
 	ActiveSessions int       `json:"active_sessions"`
 	UploadQueue    int64     `json:"upload_queue"`
 	ParseErrors    int64     `json:"parse_errors"`
+	PollsDropped   int64     `json:"polls_dropped"`
+	PollsStored    int64     `json:"polls_stored"`
+	SpoolDepth     int64     `json:"spool_depth"`
+	SpoolBytes     int64     `json:"spool_bytes"`
+	SpoolDropped   int64     `json:"spool_dropped"`
 }
 
 // Server provides the health endpoint.
@@ -30,6 +41,9 @@ type Server struct {
 	stats       *capture.Stats
 	getQueue    func() int64
 	getSessions func() int
+	index       *job.Index
+	writePcap   func(w io.Writer, jobID string) (int, error)
+	savePcap    func(jobID string) (int, error)
 	logger      *slog.Logger
 	server      *http.Server
 }
@@ -46,6 +60,20 @@ func New(cfg *config.HealthConfig, stats *capture.Stats, getQueue func() int64,
 	}
 }
 
+// SetJobIndex enables the /jobs query endpoint. It must be called before
+// Start.
+func (s *Server) SetJobIndex(index *job.Index) {
+	s.index = index
+}
+
+// SetPcapExport enables the /pcap endpoint, which serves the captured
+// packets of a recent job written by writePcap on GET, and saves them with
+// the job through savePcap on POST. It must be called before Start.
+func (s *Server) SetPcapExport(writePcap func(w io.Writer, jobID string) (int, error), savePcap func(jobID string) (int, error)) {
+	s.writePcap = writePcap
+	s.savePcap = savePcap
+}
+
 // Start begins the health server.
 func (s *Server) Start() error {
 	if !s.cfg.Enabled {
@@ -55,6 +83,12 @@ func (s *Server) Start() error {
 
 	mux := http.NewServeMux()
 	mux.HandleFunc("/health", s.handleHealth)
+	if s.index != nil {
+		mux.HandleFunc("/jobs", s.handleJobs)
+	}
+	if s.writePcap != nil {
+		mux.HandleFunc("/pcap", s.handlePcap)
+	}
 
 	s.server = &http.Server{
 		Addr:         s.cfg.Address,
@@ -88,25 +122,109 @@ func (s *Server) Stop() {
 }
 
 func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
-	status := Status{
-		Status:         "ok",
-		Timestamp:      time.Now().UTC(),
-		Uptime:         time.Since(s.startTime).Round(time.Second).String(),
-		JobsCaptured:   s.stats.JobsCaptured.Load(),
-		BytesCaptured:  s.stats.BytesCaptured.Load(),
-		ActiveSessions: s.getSessions(),
-		UploadQueue:    s.getQueue(),
-		ParseErrors:    s.stats.ParseErrors.Load(),
-	}
+	status := s.GetStatus()
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(status)
 }
 
+// handleJobs queries the job index. Parameters: from and to (RFC 3339 or
+// YYYY-MM-DD), printer, tag and limit.
+func (s *Server) handleJobs(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+
+	var q job.IndexQuery
+	var err error
+	if q.From, err = job.ParseQueryTime(params.Get("from")); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if q.To, err = job.ParseQueryTime(params.Get("to")); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	q.PrinterIP = params.Get("printer")
+	q.Tag = params.Get("tag")
+	if limit := params.Get("limit"); limit != "" {
+		if q.Limit, err = strconv.Atoi(limit); err != nil || q.Limit < 0 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+
+	jobs, err := s.index.Query(q)
+	if err != nil {
+		s.logger.Error("job query failed",
+			"error", err)
+		http.Error(w, "query failed", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(jobs)
+}
+
+// handlePcap serves the packets of the job given by the job parameter as a
+// pcap file, or on POST saves them with the job.
+func (s *Server) handlePcap(w http.ResponseWriter, r *http.Request) {
+	jobID := r.URL.Query().Get("job")
+	if jobID == "" {
+		http.Error(w, "job parameter is required", http.StatusBadRequest)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		s.handleSavePcap(w, jobID)
+		return
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var buf bytes.Buffer
+	if _, err := s.writePcap(&buf, jobID); err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, capture.ErrNoPackets) {
+			status = http.StatusNotFound
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/vnd.tcpdump.pcap")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", jobID+".pcap"))
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf.Bytes())
+}
+
+// handleSavePcap saves the packets of a job with the job and reports their
+// number.
+func (s *Server) handleSavePcap(w http.ResponseWriter, jobID string) {
+	n, err := s.savePcap(jobID)
+	if err != nil {
+		status := http.StatusInternalServerError
+		switch {
+		case errors.Is(err, capture.ErrNoPackets), errors.Is(err, job.ErrJobNotFound):
+			status = http.StatusNotFound
+		case errors.Is(err, job.ErrPcapExists):
+			status = http.StatusConflict
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]any{"job_id": jobID, "packets": n})
+}
+
 // GetStatus returns the current health status.
 func (s *Server) GetStatus() Status {
-	return Status{
+	status := Status{
 		Status:         "ok",
 		Timestamp:      time.Now().UTC(),
 		Uptime:         time.Since(s.startTime).Round(time.Second).String(),
@@ -115,5 +233,15 @@ func (s *Server) GetStatus() Status {
 		ActiveSessions: s.getSessions(),
 		UploadQueue:    s.getQueue(),
 		ParseErrors:    s.stats.ParseErrors.Load(),
+		PollsDropped:   s.stats.PollsDropped.Load(),
+		PollsStored:    s.stats.PollsStored.Load(),
+		SpoolDepth:     s.stats.SpoolDepth.Load(),
+		SpoolBytes:     s.stats.SpoolBytes.Load(),
+		SpoolDropped:   s.stats.SpoolDropped.Load(),
+	}
+	// Jobs waiting in the spool mean the disk is failing
+	if status.SpoolDepth > 0 {
+		status.Status = "degraded"
 	}
+	return status
 }
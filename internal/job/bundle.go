@@ -0,0 +1,366 @@
+package job
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// BundleManifestName is the name of the manifest in an export bundle.
+const BundleManifestName = "manifest.json"
+
+// BundleOptions selects the jobs of an export bundle. Zero fields do not
+// restrict the selection.
+type BundleOptions struct {
+	// From and To bound the capture start time; To is exclusive.
+	From      time.Time
+	To        time.Time
+	PrinterIP string
+	SiteID    string
+	// Render returns the ticket text of a job, or "" if it has none. It
+	// may be nil.
+	Render func(meta *Metadata, payload []byte) string
+}
+
+// BundleManifest describes the contents of an export bundle.
+type BundleManifest struct {
+	CreatedAt time.Time       `json:"created_at"`
+	From      *time.Time      `json:"from,omitempty"`
+	To        *time.Time      `json:"to,omitempty"`
+	PrinterIP string          `json:"printer_ip,omitempty"`
+	SiteID    string          `json:"site_id,omitempty"`
+	Jobs      []BundleJob     `json:"jobs"`
+	Skipped   []BundleSkipped `json:"skipped"`
+}
+
+// BundleJob is a job in an export bundle. Files maps the job's files in
+// the bundle to their SHA256.
+type BundleJob struct {
+	JobID          string            `json:"job_id"`
+	DeviceID       string            `json:"device_id"`
+	SiteID         string            `json:"site_id"`
+	PrinterIP      string            `json:"printer_ip"`
+	CaptureStartTS time.Time         `json:"capture_start_ts"`
+	SHA256         string            `json:"sha256"`
+	Files          map[string]string `json:"files"`
+}
+
+// BundleSkipped is a selected job that could not be exported.
+type BundleSkipped struct {
+	JobID  string `json:"job_id"`
+	Reason string `json:"reason"`
+}
+
+// BundleStore is a JobStore that export bundles can be written from.
+// Store and SegmentStore implement it.
+type BundleStore interface {
+	JobStore
+	// bundleJobs returns the metadata of at least the jobs captured from
+	// from to before to, where zero times do not restrict, and the jobs
+	// among them whose metadata cannot be read.
+	bundleJobs(from, to time.Time) ([]Metadata, []BundleSkipped, error)
+	// Contents returns the decoded payload of a job and all its decoded
+	// attachments, including the saved packets, in AttachmentFiles order.
+	Contents(meta *Metadata) ([]byte, []Attachment, error)
+}
+
+// WriteBundle writes the jobs of store selected by opts to w as a gzipped
+// tar archive for handing to a customer or support engineer. For each job
+// it holds the decoded payload (.bin), the metadata in plain JSON (.json),
+// the rendered ticket text (.txt) and the decoded attachments, below
+// jobs/YYYY-MM-DD/. The archive ends with manifest.json, listing every job
+// with the SHA256 of its files, and SHA256SUMS covering all files for
+// `sha256sum -c`. Selected jobs that cannot be read or whose payload does
+// not match its sha256 are listed as skipped; jobs whose metadata cannot
+// be read only when no printer or site is selected.
+func WriteBundle(w io.Writer, store BundleStore, opts BundleOptions) (*BundleManifest, error) {
+	metas, unreadable, err := store.bundleJobs(opts.From, opts.To)
+	if err != nil {
+		return nil, err
+	}
+
+	manifest := &BundleManifest{
+		CreatedAt: time.Now().UTC(),
+		PrinterIP: opts.PrinterIP,
+		SiteID:    opts.SiteID,
+		Jobs:      []BundleJob{},
+		Skipped:   []BundleSkipped{},
+	}
+	if !opts.From.IsZero() {
+		from := opts.From.UTC()
+		manifest.From = &from
+	}
+	if !opts.To.IsZero() {
+		to := opts.To.UTC()
+		manifest.To = &to
+	}
+	// Without metadata a job may belong to another printer or site, which
+	// the bundle must not reveal
+	if opts.PrinterIP == "" && opts.SiteID == "" {
+		manifest.Skipped = append(manifest.Skipped, unreadable...)
+	}
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	sums := make(map[string]string)
+	add := func(name string, data []byte, modTime time.Time) error {
+		if err := tw.WriteHeader(&tar.Header{
+			Name:    name,
+			Mode:    0640,
+			Size:    int64(len(data)),
+			ModTime: modTime,
+			Format:  tar.FormatPAX,
+		}); err != nil {
+			return err
+		}
+		if _, err := tw.Write(data); err != nil {
+			return err
+		}
+		sums[name] = fileHash(data)
+		return nil
+	}
+
+	var selected []Metadata
+	for _, meta := range metas {
+		if opts.selects(&meta) {
+			selected = append(selected, meta)
+		}
+	}
+	sort.Slice(selected, func(i, k int) bool {
+		return selected[i].CaptureStartTS.Before(selected[k].CaptureStartTS)
+	})
+
+	for i := range selected {
+		entry, reason, err := bundleJob(add, store, &selected[i], opts.Render)
+		if err != nil {
+			return nil, err
+		}
+		if reason != "" {
+			manifest.Skipped = append(manifest.Skipped, BundleSkipped{JobID: selected[i].JobID, Reason: reason})
+			continue
+		}
+		manifest.Jobs = append(manifest.Jobs, *entry)
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("marshaling manifest: %w", err)
+	}
+	if err := add(BundleManifestName, data, manifest.CreatedAt); err != nil {
+		return nil, fmt.Errorf("writing manifest: %w", err)
+	}
+
+	names := make([]string, 0, len(sums))
+	for name := range sums {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var list strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&list, "%s  %s\n", sums[name], name)
+	}
+	if err := add("SHA256SUMS", []byte(list.String()), manifest.CreatedAt); err != nil {
+		return nil, fmt.Errorf("writing checksums: %w", err)
+	}
+
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// selects reports whether a job matches the options.
+func (o *BundleOptions) selects(meta *Metadata) bool {
+	if !o.From.IsZero() && meta.CaptureStartTS.Before(o.From) {
+		return false
+	}
+	if !o.To.IsZero() && !meta.CaptureStartTS.Before(o.To) {
+		return false
+	}
+	if o.PrinterIP != "" && meta.PrinterIP != o.PrinterIP {
+		return false
+	}
+	if o.SiteID != "" && meta.SiteID != o.SiteID {
+		return false
+	}
+	return true
+}
+
+// bundleJob adds the files of a job to the bundle. It returns a reason
+// instead of an entry if the job cannot be exported, and an error only if
+// writing the bundle fails.
+func bundleJob(add func(name string, data []byte, modTime time.Time) error, store BundleStore, meta *Metadata, render func(*Metadata, []byte) string) (*BundleJob, string, error) {
+	payload, attachments, err := store.Contents(meta)
+	if err != nil {
+		return nil, err.Error(), nil
+	}
+	if fileHash(payload) != meta.SHA256 {
+		return nil, "payload does not match sha256", nil
+	}
+
+	files := append([]Attachment{{Name: meta.JobID + ".bin", Data: payload}}, attachments...)
+	if render != nil {
+		if text := render(meta, payload); text != "" {
+			files = append(files, Attachment{Name: meta.JobID + ".txt", Data: []byte(text)})
+		}
+	}
+	metaBytes, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return nil, fmt.Sprintf("marshaling metadata: %v", err), nil
+	}
+	files = append(files, Attachment{Name: meta.JobID + ".json", Data: metaBytes})
+
+	entry := &BundleJob{
+		JobID:          meta.JobID,
+		DeviceID:       meta.DeviceID,
+		SiteID:         meta.SiteID,
+		PrinterIP:      meta.PrinterIP,
+		CaptureStartTS: meta.CaptureStartTS,
+		SHA256:         meta.SHA256,
+		Files:          make(map[string]string, len(files)),
+	}
+	dir := path.Join("jobs", meta.CaptureStartTS.UTC().Format("2006-01-02"))
+	for _, f := range files {
+		name := path.Join(dir, f.Name)
+		if err := add(name, f.Data, meta.CaptureStartTS); err != nil {
+			return nil, "", fmt.Errorf("writing %s: %w", name, err)
+		}
+		entry.Files[name] = fileHash(f.Data)
+	}
+	return entry, "", nil
+}
+
+// bundleJobs returns the metadata of the jobs in the day directories
+// overlapping from to before to.
+func (s *Store) bundleJobs(from, to time.Time) ([]Metadata, []BundleSkipped, error) {
+	days, err := dayDirs(s.basePath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var metas []Metadata
+	var unreadable []BundleSkipped
+	for _, day := range days {
+		if !from.IsZero() && !day.date.AddDate(0, 0, 1).After(from.UTC()) {
+			continue
+		}
+		if !to.IsZero() && !day.date.Before(to.UTC()) {
+			continue
+		}
+
+		ids, err := jobIDsInDir(day.path)
+		if err != nil {
+			return nil, nil, fmt.Errorf("reading %s: %w", day.path, err)
+		}
+		for _, id := range ids {
+			meta, err := ReadMetadata(filepath.Join(day.path, id+".json"), s.keys)
+			if err != nil {
+				unreadable = append(unreadable, BundleSkipped{JobID: id, Reason: err.Error()})
+				continue
+			}
+			metas = append(metas, meta)
+		}
+	}
+	return metas, unreadable, nil
+}
+
+// Contents reads the payload and attachments of a job from its day
+// directory.
+func (s *Store) Contents(meta *Metadata) ([]byte, []Attachment, error) {
+	base := s.GetJobPath(meta.JobID, meta.CaptureStartTS.UTC())
+	payload, err := LoadPayload(base, meta, s.keys)
+	if err != nil {
+		return nil, nil, fmt.Errorf("reading payload: %w", err)
+	}
+
+	var attachments []Attachment
+	for _, name := range meta.AttachmentFiles() {
+		data, err := LoadAttachment(filepath.Dir(base), name, meta, s.keys)
+		if err != nil {
+			return nil, nil, fmt.Errorf("reading attachment %s: %w", name, err)
+		}
+		attachments = append(attachments, Attachment{Name: name, Data: data})
+	}
+	return payload, attachments, nil
+}
+
+// bundleJobs returns the metadata of the live jobs captured from from to
+// before to.
+func (s *SegmentStore) bundleJobs(from, to time.Time) ([]Metadata, []BundleSkipped, error) {
+	s.mu.Lock()
+	selected := make(map[string]segmentJob)
+	for id, j := range s.jobs {
+		// Jobs with unreadable metadata have no capture time
+		if !j.start.IsZero() && (j.start.Before(from) || (!to.IsZero() && !j.start.Before(to))) {
+			continue
+		}
+		selected[id] = *j
+	}
+	s.mu.Unlock()
+
+	var metas []Metadata
+	var unreadable []BundleSkipped
+	for id, j := range selected {
+		files, err := s.readFiles(&j)
+		if err != nil {
+			unreadable = append(unreadable, BundleSkipped{JobID: id, Reason: err.Error()})
+			continue
+		}
+		meta, err := parseMetadata(files[id+".json"], s.keys)
+		if err != nil {
+			unreadable = append(unreadable, BundleSkipped{JobID: id, Reason: err.Error()})
+			continue
+		}
+		metas = append(metas, meta)
+	}
+	sort.Slice(unreadable, func(i, k int) bool {
+		return unreadable[i].JobID < unreadable[k].JobID
+	})
+	return metas, unreadable, nil
+}
+
+// Contents reads the payload and attachments of a job from its segment.
+func (s *SegmentStore) Contents(meta *Metadata) ([]byte, []Attachment, error) {
+	s.mu.Lock()
+	j, err := s.lookup(meta.JobID)
+	var located segmentJob
+	if err == nil {
+		located = *j
+	}
+	s.mu.Unlock()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	files, err := s.readFiles(&located)
+	if err != nil {
+		return nil, nil, err
+	}
+	payload, err := openPayload(files[meta.JobID+".bin"], meta, s.keys)
+	if err != nil {
+		return nil, nil, fmt.Errorf("reading payload: %w", err)
+	}
+
+	var attachments []Attachment
+	for _, name := range meta.AttachmentFiles() {
+		data, ok := files[name]
+		if !ok {
+			return nil, nil, fmt.Errorf("reading attachment %s: not in the job record", name)
+		}
+		if data, err = openAttachment(data, name, meta, s.keys); err != nil {
+			return nil, nil, fmt.Errorf("reading attachment %s: %w", name, err)
+		}
+		attachments = append(attachments, Attachment{Name: name, Data: data})
+	}
+	return payload, attachments, nil
+}
@@ -0,0 +1,153 @@
+package job
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Payload codecs recorded in Metadata.PayloadCodec. An empty codec means
+// the .bin file holds the raw payload.
+const (
+	CodecNone = "none"
+	CodecGzip = "gzip"
+	CodecZstd = "zstd"
+)
+
+// The zstd encoder is safe for concurrent EncodeAll calls and expensive to
+// create, so it is shared.
+var zstdEncoder = sync.OnceValues(func() (*zstd.Encoder, error) {
+	return zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+})
+
+// encodePayload compresses data with the given codec.
+func encodePayload(codec string, data []byte) ([]byte, error) {
+	switch codec {
+	case "", CodecNone:
+		return data, nil
+	case CodecGzip:
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		if _, err := zw.Write(data); err != nil {
+			return nil, err
+		}
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case CodecZstd:
+		enc, err := zstdEncoder()
+		if err != nil {
+			return nil, err
+		}
+		return enc.EncodeAll(data, nil), nil
+	default:
+		return nil, fmt.Errorf("unknown payload codec %q", codec)
+	}
+}
+
+// DecodePayload decompresses a stored payload. byteLen is the uncompressed
+// length recorded in the metadata and bounds the decoded size.
+func DecodePayload(codec string, data []byte, byteLen int) ([]byte, error) {
+	switch codec {
+	case "", CodecNone:
+		return data, nil
+	case CodecGzip:
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		return readBounded(zr, byteLen)
+	case CodecZstd:
+		dec, err := zstd.NewReader(bytes.NewReader(data), zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		defer dec.Close()
+		return readBounded(dec, byteLen)
+	default:
+		return nil, fmt.Errorf("unknown payload codec %q", codec)
+	}
+}
+
+// maxDecodedLen bounds payloads decoded without a recorded length.
+const maxDecodedLen = 64 * 1024 * 1024
+
+// decodeUnbounded decompresses a payload whose uncompressed length is not
+// known, up to maxDecodedLen bytes.
+func decodeUnbounded(codec string, data []byte) ([]byte, error) {
+	var r io.Reader
+	switch codec {
+	case CodecGzip:
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		r = zr
+	case CodecZstd:
+		dec, err := zstd.NewReader(bytes.NewReader(data), zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		defer dec.Close()
+		r = dec
+	default:
+		return data, nil
+	}
+
+	decoded, err := io.ReadAll(io.LimitReader(r, maxDecodedLen+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(decoded) > maxDecodedLen {
+		return nil, fmt.Errorf("decoded payload exceeds %d bytes", maxDecodedLen)
+	}
+	return decoded, nil
+}
+
+// readBounded reads r to the end, failing unless it holds exactly byteLen
+// bytes, so a corrupt payload cannot expand without limit.
+func readBounded(r io.Reader, byteLen int) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, int64(byteLen)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) != byteLen {
+		return nil, fmt.Errorf("decoded %d bytes, metadata records %d", len(data), byteLen)
+	}
+	return data, nil
+}
+
+// LoadPayload reads the payload of the job stored at base (the job path
+// without extension), then decrypts and decompresses it according to its
+// metadata. keys may be nil when encryption is not configured.
+func LoadPayload(base string, meta *Metadata, keys *Keyring) ([]byte, error) {
+	data, err := os.ReadFile(base + ".bin")
+	if err != nil {
+		return nil, err
+	}
+	return openPayload(data, meta, keys)
+}
+
+// openPayload decrypts and decompresses the contents of a .bin file.
+func openPayload(data []byte, meta *Metadata, keys *Keyring) ([]byte, error) {
+	if meta.KeyID != "" {
+		plain, err := keys.open(meta.KeyID, data, sealAAD(meta.JobID, "bin"))
+		if err != nil {
+			return nil, err
+		}
+		data = plain
+	}
+	payload, err := DecodePayload(meta.PayloadCodec, data, meta.ByteLen)
+	if err != nil {
+		return nil, fmt.Errorf("decoding %s payload: %w", meta.PayloadCodec, err)
+	}
+	return payload, nil
+}
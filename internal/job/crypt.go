@@ -0,0 +1,248 @@
+package job
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// KeySize is the length of job encryption keys (AES-256).
+const KeySize = 32
+
+// Keyring holds the AES-GCM keys used to encrypt jobs at rest. New jobs are
+// encrypted with the active key; older keys are kept to decrypt jobs written
+// before a key rotation. The key ID is recorded in each job's metadata.
+type Keyring struct {
+	keys   map[string]cipher.AEAD
+	active string
+}
+
+// LoadKeyring reads a key file. Each line holds a key ID and a base64
+// encoded 32-byte key separated by whitespace; blank lines and lines
+// starting with # are ignored. The last key in the file is the active key,
+// so keys are rotated by appending a new line. An empty path returns a nil
+// keyring, which disables encryption.
+func LoadKeyring(path string) (*Keyring, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading key file: %w", err)
+	}
+	if info.Mode().Perm()&0007 != 0 {
+		return nil, fmt.Errorf("key file %s must not be accessible by others (mode %s)", path, info.Mode().Perm())
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading key file: %w", err)
+	}
+	defer f.Close()
+
+	k := &Keyring{keys: make(map[string]cipher.AEAD)}
+	scanner := bufio.NewScanner(f)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("key file line %d: expected \"<key-id> <base64-key>\"", lineNum)
+		}
+		id := fields[0]
+		if _, dup := k.keys[id]; dup {
+			return nil, fmt.Errorf("key file line %d: duplicate key ID %q", lineNum, id)
+		}
+		key, err := base64.StdEncoding.DecodeString(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("key file line %d: %w", lineNum, err)
+		}
+		if len(key) != KeySize {
+			return nil, fmt.Errorf("key file line %d: key is %d bytes, want %d", lineNum, len(key), KeySize)
+		}
+
+		aead, err := newAEAD(key)
+		if err != nil {
+			return nil, fmt.Errorf("key file line %d: %w", lineNum, err)
+		}
+		k.keys[id] = aead
+		k.active = id
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading key file: %w", err)
+	}
+	if k.active == "" {
+		return nil, fmt.Errorf("key file %s contains no keys", path)
+	}
+
+	return k, nil
+}
+
+// GenerateKey returns a new random key, base64 encoded for a key file.
+func GenerateKey() (string, error) {
+	key := make([]byte, KeySize)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(key), nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// ActiveKeyID returns the ID of the key used for new jobs.
+func (k *Keyring) ActiveKeyID() string {
+	return k.active
+}
+
+// seal encrypts data with the active key. The result is the random nonce
+// followed by the ciphertext. aad binds the ciphertext to its file, so that
+// files cannot be swapped between jobs unnoticed.
+func (k *Keyring) seal(data []byte, aad string) (keyID string, sealed []byte, err error) {
+	sealed, err = k.sealWith(k.active, data, aad)
+	return k.active, sealed, err
+}
+
+// sealWith encrypts data with the given key, for files added to a job
+// that is already encrypted with it.
+func (k *Keyring) sealWith(keyID string, data []byte, aad string) ([]byte, error) {
+	aead, ok := k.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("unknown encryption key %q", keyID)
+	}
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(data)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("generating nonce: %w", err)
+	}
+	return aead.Seal(nonce, nonce, data, []byte(aad)), nil
+}
+
+// open decrypts data sealed with the given key.
+func (k *Keyring) open(keyID string, sealed []byte, aad string) ([]byte, error) {
+	if k == nil {
+		return nil, fmt.Errorf("job is encrypted with key %q but no key file is configured", keyID)
+	}
+	aead, ok := k.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("unknown encryption key %q", keyID)
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, fmt.Errorf("encrypted data too short")
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	data, err := aead.Open(nil, nonce, ciphertext, []byte(aad))
+	if err != nil {
+		return nil, fmt.Errorf("decrypting with key %q: %w", keyID, err)
+	}
+	return data, nil
+}
+
+// Seal encrypts data kept outside the job tree, such as spooled jobs, with
+// the active key. aad identifies the data like the job file names do for
+// job files.
+func (k *Keyring) Seal(data []byte, aad string) (keyID string, sealed []byte, err error) {
+	return k.seal(data, aad)
+}
+
+// Open decrypts data encrypted by Seal.
+func (k *Keyring) Open(keyID string, sealed []byte, aad string) ([]byte, error) {
+	return k.open(keyID, sealed, aad)
+}
+
+// openAny decrypts data sealed with any key of the keyring, for files
+// whose key ID is unknown.
+func (k *Keyring) openAny(sealed []byte, aad string) ([]byte, bool) {
+	for id := range k.keys {
+		if data, err := k.open(id, sealed, aad); err == nil {
+			return data, true
+		}
+	}
+	return nil, false
+}
+
+// sealAAD identifies a job file for authenticated encryption.
+func sealAAD(jobID, file string) string {
+	return jobID + "/" + file
+}
+
+// sealedMetadata is the on-disk form of an encrypted metadata file. The job
+// and key IDs stay readable so that files can be listed and matched to
+// their key without decrypting them.
+type sealedMetadata struct {
+	JobID          string `json:"job_id"`
+	KeyID          string `json:"key_id"`
+	SealedMetadata []byte `json:"sealed_metadata"`
+}
+
+// ReadMetadata reads and, if necessary, decrypts a job metadata file.
+// keys may be nil when encryption is not configured.
+func ReadMetadata(path string, keys *Keyring) (Metadata, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Metadata{}, err
+	}
+	return parseMetadata(data, keys)
+}
+
+// parseMetadata decodes the contents of a metadata file.
+func parseMetadata(data []byte, keys *Keyring) (Metadata, error) {
+	var meta Metadata
+
+	var sealed sealedMetadata
+	if err := json.Unmarshal(data, &sealed); err != nil {
+		return meta, fmt.Errorf("parsing metadata: %w", err)
+	}
+	if sealed.SealedMetadata != nil {
+		var err error
+		data, err = keys.open(sealed.KeyID, sealed.SealedMetadata, sealAAD(sealed.JobID, "json"))
+		if err != nil {
+			return meta, err
+		}
+	}
+
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return meta, fmt.Errorf("parsing metadata: %w", err)
+	}
+	// The envelope's job ID is what the key was bound to; the metadata
+	// inside must not claim to be another job
+	if sealed.SealedMetadata != nil && meta.JobID != sealed.JobID {
+		return Metadata{}, fmt.Errorf("sealed metadata of job %q is for job %q", sealed.JobID, meta.JobID)
+	}
+	return meta, nil
+}
+
+// LoadAttachment reads an attachment of a job stored in dir, decrypting it
+// if the job is encrypted.
+func LoadAttachment(dir, name string, meta *Metadata, keys *Keyring) ([]byte, error) {
+	data, err := os.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		return nil, err
+	}
+	return openAttachment(data, name, meta, keys)
+}
+
+// openAttachment decrypts the contents of an attachment file.
+func openAttachment(data []byte, name string, meta *Metadata, keys *Keyring) ([]byte, error) {
+	if meta.KeyID == "" {
+		return data, nil
+	}
+	return keys.open(meta.KeyID, data, sealAAD(meta.JobID, name))
+}
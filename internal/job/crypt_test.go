@@ -0,0 +1,43 @@
+package job
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestParseMetadataSealedJobID(t *testing.T) {
+	keys := newTestKeyring(t)
+	enc := jobEncoder{keys: keys, encryptMetadata: true}
+
+	tests := []struct {
+		name     string
+		envelope string
+		inner    string
+		wantErr  bool
+	}{
+		{name: "matching", envelope: "job-1", inner: "job-1"},
+		{name: "inner job differs", envelope: "job-1", inner: "job-2", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			metaBytes, err := json.Marshal(Metadata{JobID: tt.inner})
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Seal the inner metadata for the envelope's job, as if the
+			// metadata of one job had been sealed under another's ID
+			data, err := enc.sealMetadata(tt.envelope, metaBytes)
+			if err != nil {
+				t.Fatalf("sealMetadata: %v", err)
+			}
+
+			meta, err := parseMetadata(data, keys)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseMetadata: %v, want error = %v", err, tt.wantErr)
+			}
+			if err == nil && meta.JobID != tt.envelope {
+				t.Errorf("job_id = %q, want %q", meta.JobID, tt.envelope)
+			}
+		})
+	}
+}
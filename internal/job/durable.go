@@ -0,0 +1,122 @@
+package job
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// fileSystem is the file system the store writes jobs through. Tests
+// replace it to simulate power loss.
+type fileSystem interface {
+	Mkdir(path string, perm os.FileMode) error
+	OpenFile(path string, flag int, perm os.FileMode) (syncFile, error)
+	Rename(oldpath, newpath string) error
+	Remove(path string) error
+	// SyncDir flushes the entries of a directory to stable storage.
+	SyncDir(path string) error
+}
+
+// syncFile is an open file of a fileSystem.
+type syncFile interface {
+	Write(p []byte) (int, error)
+	Sync() error
+	Close() error
+}
+
+type osFS struct{}
+
+func (osFS) Mkdir(path string, perm os.FileMode) error { return os.Mkdir(path, perm) }
+
+func (osFS) OpenFile(path string, flag int, perm os.FileMode) (syncFile, error) {
+	return os.OpenFile(path, flag, perm)
+}
+
+func (osFS) Rename(oldpath, newpath string) error { return os.Rename(oldpath, newpath) }
+
+func (osFS) Remove(path string) error { return os.Remove(path) }
+
+func (osFS) SyncDir(path string) error { return syncDir(path) }
+
+// syncDir fsyncs a directory. A rename or a new file is only durable once
+// the directory holding it has been synced; until then a power cut can
+// lose it even though the file data itself was synced.
+func syncDir(path string) error {
+	d, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if cerr := d.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// writeFileAtomic writes data to tmpPath, syncs it and renames it to
+// finalPath, then syncs the directory so that the rename survives a power
+// cut.
+func writeFileAtomic(fsys fileSystem, tmpPath, finalPath string, data []byte) error {
+	f, err := fsys.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0640)
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		fsys.Remove(tmpPath)
+		return err
+	}
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		fsys.Remove(tmpPath)
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		fsys.Remove(tmpPath)
+		return err
+	}
+
+	if err := fsys.Rename(tmpPath, finalPath); err != nil {
+		fsys.Remove(tmpPath)
+		return err
+	}
+
+	if err := fsys.SyncDir(filepath.Dir(finalPath)); err != nil {
+		fsys.Remove(finalPath)
+		return fmt.Errorf("syncing directory: %w", err)
+	}
+
+	return nil
+}
+
+// mkdirAllDurable creates dir and any missing parents below root, syncing
+// the parent of each directory it creates. root must exist.
+func mkdirAllDurable(fsys fileSystem, root, dir string) error {
+	rel, err := filepath.Rel(root, dir)
+	if err != nil || rel == "." {
+		return err
+	}
+	if rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return errors.New("directory is outside the base path")
+	}
+
+	parent := root
+	for _, name := range strings.Split(rel, string(filepath.Separator)) {
+		path := filepath.Join(parent, name)
+		if err := fsys.Mkdir(path, 0750); err != nil {
+			if !errors.Is(err, fs.ErrExist) {
+				return err
+			}
+		} else if err := fsys.SyncDir(parent); err != nil {
+			return err
+		}
+		parent = path
+	}
+	return nil
+}
@@ -0,0 +1,396 @@
+package job
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/marcenggist/kitchen-printer-tap/internal/config"
+)
+
+var errPowerCut = errors.New("power cut")
+
+// crashFS passes operations through to the real file system and models
+// what a power cut would leave behind: file contents survive only once the
+// file is synced, directory entries only once their directory is synced.
+// After budget operations the power is cut and every further operation
+// fails.
+type crashFS struct {
+	budget  int
+	crashed bool
+	// live and durable map a directory path to its entries
+	live    map[string]map[string]*inode
+	durable map[string]map[string]*inode
+}
+
+type inode struct {
+	dir    bool
+	data   []byte
+	synced []byte
+}
+
+func newCrashFS(root string, budget int) *crashFS {
+	return &crashFS{
+		budget:  budget,
+		live:    map[string]map[string]*inode{root: {}},
+		durable: map[string]map[string]*inode{root: {}},
+	}
+}
+
+// step uses up one operation of the budget. A negative budget never runs
+// out.
+func (c *crashFS) step() error {
+	if c.crashed {
+		return errPowerCut
+	}
+	if c.budget == 0 {
+		c.crashed = true
+		return errPowerCut
+	}
+	c.budget--
+	return nil
+}
+
+func (c *crashFS) Mkdir(path string, perm os.FileMode) error {
+	if err := c.step(); err != nil {
+		return err
+	}
+	if err := os.Mkdir(path, perm); err != nil {
+		return err
+	}
+	c.live[filepath.Dir(path)][filepath.Base(path)] = &inode{dir: true}
+	c.live[path] = map[string]*inode{}
+	c.durable[path] = map[string]*inode{}
+	return nil
+}
+
+func (c *crashFS) OpenFile(path string, flag int, perm os.FileMode) (syncFile, error) {
+	if err := c.step(); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	entries := c.live[filepath.Dir(path)]
+	node, ok := entries[filepath.Base(path)]
+	if !ok {
+		node = &inode{}
+		entries[filepath.Base(path)] = node
+	}
+	if flag&os.O_TRUNC != 0 {
+		node.data = nil
+	}
+	return &crashFile{fs: c, file: f, node: node}, nil
+}
+
+func (c *crashFS) Rename(oldpath, newpath string) error {
+	if err := c.step(); err != nil {
+		return err
+	}
+	if err := os.Rename(oldpath, newpath); err != nil {
+		return err
+	}
+	oldEntries := c.live[filepath.Dir(oldpath)]
+	c.live[filepath.Dir(newpath)][filepath.Base(newpath)] = oldEntries[filepath.Base(oldpath)]
+	delete(oldEntries, filepath.Base(oldpath))
+	return nil
+}
+
+func (c *crashFS) Remove(path string) error {
+	if err := c.step(); err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil {
+		return err
+	}
+	delete(c.live[filepath.Dir(path)], filepath.Base(path))
+	return nil
+}
+
+func (c *crashFS) SyncDir(path string) error {
+	if err := c.step(); err != nil {
+		return err
+	}
+	if err := syncDir(path); err != nil {
+		return err
+	}
+	entries := make(map[string]*inode, len(c.live[path]))
+	for name, node := range c.live[path] {
+		entries[name] = node
+	}
+	c.durable[path] = entries
+	return nil
+}
+
+// restore writes the files that survived the power cut below src to dst.
+func (c *crashFS) restore(t *testing.T, src, dst string) {
+	t.Helper()
+	for name, node := range c.durable[src] {
+		path := filepath.Join(dst, name)
+		if node.dir {
+			if err := os.Mkdir(path, 0750); err != nil {
+				t.Fatal(err)
+			}
+			c.restore(t, filepath.Join(src, name), path)
+			continue
+		}
+		if err := os.WriteFile(path, node.synced, 0640); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+type crashFile struct {
+	fs   *crashFS
+	file *os.File
+	node *inode
+}
+
+func (f *crashFile) Write(p []byte) (int, error) {
+	if err := f.fs.step(); err != nil {
+		return 0, err
+	}
+	n, err := f.file.Write(p)
+	f.node.data = append(f.node.data, p[:n]...)
+	return n, err
+}
+
+func (f *crashFile) Sync() error {
+	if err := f.fs.step(); err != nil {
+		return err
+	}
+	if err := f.file.Sync(); err != nil {
+		return err
+	}
+	f.node.synced = append([]byte(nil), f.node.data...)
+	return nil
+}
+
+func (f *crashFile) Close() error {
+	err := f.file.Close()
+	if serr := f.fs.step(); err == nil {
+		err = serr
+	}
+	return err
+}
+
+func newTestStore(t *testing.T, basePath string, keys *Keyring) *Store {
+	t.Helper()
+	cfg := config.DefaultConfig().Storage
+	cfg.BasePath = basePath
+	cfg.MinFreeMB = 0
+	cfg.Compression = CodecGzip
+	cfg.IndexFile = ""
+	store, err := NewStore(&cfg, keys, nil, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatalf("NewStore: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+func newTestKeyring(t *testing.T) *Keyring {
+	t.Helper()
+	key, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "keys")
+	if err := os.WriteFile(path, []byte("k1 "+key+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := LoadKeyring(path)
+	if err != nil {
+		t.Fatalf("LoadKeyring: %v", err)
+	}
+	return keys
+}
+
+// saveTestJobs saves jobs on two days, one with an attachment, until the
+// first error. Returns the IDs of the jobs saved.
+func saveTestJobs(store JobStore) []string {
+	day := time.Date(2026, 10, 17, 21, 30, 0, 0, time.UTC)
+	starts := []time.Time{day, day.Add(time.Minute), day.Add(4 * time.Hour)}
+
+	var saved []string
+	for i, start := range starts {
+		j := New("kptap-001", "site-1", "10.0.0.5", 9100, "10.0.0.2", "raw")
+		j.Metadata.CaptureStartTS = start
+		j.Append([]byte(fmt.Sprintf("\x1b@TABLE %d\n2x Schnitzel\n\x1dV\x00", i+1)))
+		if i == 1 {
+			j.AddRasterImage(RasterImage{Command: "GS v 0", Width: 8, Height: 1}, []byte("\x89PNG"))
+		}
+		j.Close()
+		if err := store.Save(j); err != nil {
+			return saved
+		}
+		saved = append(saved, j.Metadata.JobID)
+	}
+	return saved
+}
+
+// mustSaveTestJobs saves the jobs of saveTestJobs and fails the test unless
+// all of them were saved.
+func mustSaveTestJobs(t *testing.T, store JobStore) []string {
+	t.Helper()
+	ids := saveTestJobs(store)
+	if len(ids) != 3 {
+		t.Fatalf("saved %d jobs, want 3", len(ids))
+	}
+	return ids
+}
+
+// TestSavePowerCut cuts the power after every file system operation of a
+// sequence of saves and checks that what survives never contains a
+// partial job, that every save that succeeded survives, and that startup
+// recovery leaves a consistent store.
+func TestSavePowerCut(t *testing.T) {
+	keys := newTestKeyring(t)
+
+	// Count the operations of an uninterrupted run
+	base := t.TempDir()
+	store := newTestStore(t, base, keys)
+	fsys := newCrashFS(base, -1)
+	store.fs = fsys
+	if saved := saveTestJobs(store); len(saved) != 3 {
+		t.Fatalf("saved %d jobs without a power cut, want 3", len(saved))
+	}
+	ops := -fsys.budget - 1
+
+	for cut := 0; cut <= ops; cut++ {
+		t.Run(fmt.Sprintf("after %d ops", cut), func(t *testing.T) {
+			base := t.TempDir()
+			store := newTestStore(t, base, keys)
+			fsys := newCrashFS(base, cut)
+			store.fs = fsys
+			saved := saveTestJobs(store)
+
+			after := t.TempDir()
+			fsys.restore(t, base, after)
+
+			report, err := CheckStore(after, keys, nil)
+			if err != nil {
+				t.Fatalf("CheckStore: %v", err)
+			}
+			for _, p := range report.Problems {
+				if p.Kind != FsckOrphanedFile {
+					t.Errorf("partial job after power cut: %+v", p)
+				}
+			}
+			for _, jobID := range saved {
+				if _, err := resolveTestJob(after, jobID); err != nil {
+					t.Errorf("saved job lost in power cut: %v", err)
+				}
+			}
+
+			recovered := newTestStore(t, after, keys)
+			if _, err := recovered.Recover("kptap-001", "site-1"); err != nil {
+				t.Fatalf("Recover: %v", err)
+			}
+			report, err = CheckStore(after, keys, nil)
+			if err != nil {
+				t.Fatalf("CheckStore: %v", err)
+			}
+			if !report.OK() {
+				t.Errorf("problems after recovery: %+v", report.Problems)
+			}
+		})
+	}
+}
+
+// TestDeletePowerCut cuts the power after every file system operation of
+// a deletion, by Delete and by quota eviction, and checks that recovery
+// never saves a deleted job again.
+func TestDeletePowerCut(t *testing.T) {
+	keys := newTestKeyring(t)
+	tests := []struct {
+		name string
+		// remove deletes jobs from a store holding the jobs of saveTestJobs
+		remove func(store *Store, ids []string)
+	}{
+		{
+			name: "delete",
+			remove: func(store *Store, ids []string) {
+				store.Delete(ids[0])
+			},
+		},
+		{
+			name: "eviction",
+			remove: func(store *Store, ids []string) {
+				used, _ := store.treeSize()
+				store.usedBytes = used
+				store.maxStorageBytes = used + metadataSizeEstimate
+				store.evictUnuploaded = true
+				j := New("kptap-001", "site-1", "10.0.0.5", 9100, "10.0.0.2", "raw")
+				j.Metadata.CaptureStartTS = time.Date(2026, 10, 18, 9, 0, 0, 0, time.UTC)
+				j.Append([]byte("\x1b@TABLE 4\n"))
+				j.Close()
+				store.Save(j)
+			},
+		},
+	}
+
+	// setup saves the test jobs through a file system whose power is cut
+	// after cut operations of remove
+	setup := func(t *testing.T, base string) (*Store, *crashFS, []string) {
+		store := newTestStore(t, base, keys)
+		fsys := newCrashFS(base, -1)
+		store.fs = fsys
+		return store, fsys, mustSaveTestJobs(t, store)
+	}
+
+	for _, tt := range tests {
+		store, fsys, ids := setup(t, t.TempDir())
+		before := fsys.budget
+		tt.remove(store, ids)
+		ops := before - fsys.budget
+
+		for cut := 0; cut <= ops; cut++ {
+			t.Run(fmt.Sprintf("%s after %d ops", tt.name, cut), func(t *testing.T) {
+				base := t.TempDir()
+				store, fsys, ids := setup(t, base)
+				fsys.budget = cut
+				tt.remove(store, ids)
+
+				after := t.TempDir()
+				fsys.restore(t, base, after)
+
+				report, err := newTestStore(t, after, keys).Recover("kptap-001", "site-1")
+				if err != nil {
+					t.Fatalf("Recover: %v", err)
+				}
+				for _, id := range report.Regenerated {
+					if slices.Contains(ids, id) {
+						t.Errorf("deleted job %s regenerated", id)
+					}
+				}
+				check, err := CheckStore(after, keys, nil)
+				if err != nil {
+					t.Fatalf("CheckStore: %v", err)
+				}
+				if !check.OK() {
+					t.Errorf("problems after recovery: %+v", check.Problems)
+				}
+			})
+		}
+	}
+}
+
+// resolveTestJob returns the metadata path of a job below basePath.
+func resolveTestJob(basePath, jobID string) (string, error) {
+	matches, err := filepath.Glob(filepath.Join(basePath, "*", "*", "*", jobID+".json"))
+	if err != nil {
+		return "", err
+	}
+	if len(matches) == 0 {
+		return "", fmt.Errorf("job %s not found", jobID)
+	}
+	return matches[0], nil
+}
@@ -0,0 +1,159 @@
+package job
+
+import (
+	"encoding/json"
+	"fmt"
+	"syscall"
+
+	"github.com/marcenggist/kitchen-printer-tap/internal/config"
+)
+
+// jobEncoder turns jobs into the bytes a store writes: the payload
+// compressed and encrypted, attachments encrypted, and the metadata signed
+// and optionally sealed. It is shared by all store backends so that they
+// store identical files.
+type jobEncoder struct {
+	compression     string
+	keys            *Keyring
+	encryptMetadata bool
+	signer          *Signer
+}
+
+func newJobEncoder(cfg *config.StorageConfig, keys *Keyring, signer *Signer) jobEncoder {
+	return jobEncoder{
+		compression:     cfg.Compression,
+		keys:            keys,
+		encryptMetadata: keys != nil && cfg.EncryptMetadata,
+		signer:          signer,
+	}
+}
+
+// encodedJob holds the contents of a job's stored files.
+type encodedJob struct {
+	payload     []byte
+	attachments []Attachment
+	metadata    []byte
+}
+
+// encode compresses, encrypts and signs a closed job, recording the codec,
+// key and signature in its metadata.
+func (e *jobEncoder) encode(job *Job) (*encodedJob, error) {
+	// Compress the payload before sizing the job
+	payload, err := encodePayload(e.compression, job.Data)
+	if err != nil {
+		return nil, fmt.Errorf("compressing payload: %w", err)
+	}
+	if e.compression != "" && e.compression != CodecNone {
+		job.Metadata.PayloadCodec = e.compression
+	}
+
+	// Encrypt payload and attachments
+	attachments := job.Attachments
+	if e.keys != nil {
+		keyID, sealed, err := e.keys.seal(payload, sealAAD(job.Metadata.JobID, "bin"))
+		if err != nil {
+			return nil, fmt.Errorf("encrypting payload: %w", err)
+		}
+		payload = sealed
+		job.Metadata.KeyID = keyID
+
+		attachments = make([]Attachment, len(job.Attachments))
+		for i, a := range job.Attachments {
+			_, sealed, err := e.keys.seal(a.Data, sealAAD(job.Metadata.JobID, a.Name))
+			if err != nil {
+				return nil, fmt.Errorf("encrypting attachment %s: %w", a.Name, err)
+			}
+			attachments[i] = Attachment{Name: a.Name, Data: sealed}
+		}
+	}
+	if job.Metadata.PayloadCodec != "" || job.Metadata.KeyID != "" {
+		job.Metadata.StoredByteLen = len(payload)
+	}
+
+	metaBytes, err := e.encodeMetadata(&job.Metadata)
+	if err != nil {
+		return nil, err
+	}
+
+	return &encodedJob{
+		payload:     payload,
+		attachments: attachments,
+		metadata:    metaBytes,
+	}, nil
+}
+
+// encodePcap encodes packets saved for a stored job with the given
+// metadata. It encrypts them with the job's key, so that the job's other
+// files stay valid, records them in the metadata and returns the
+// attachment and the encoded metadata.
+func (e *jobEncoder) encodePcap(meta *Metadata, pcapData []byte) (Attachment, []byte, error) {
+	a := Attachment{Name: meta.JobID + ".pcap", Data: pcapData}
+	if meta.KeyID != "" {
+		if e.keys == nil {
+			return Attachment{}, nil, fmt.Errorf("job is encrypted with key %q but no key file is configured", meta.KeyID)
+		}
+		sealed, err := e.keys.sealWith(meta.KeyID, pcapData, sealAAD(meta.JobID, a.Name))
+		if err != nil {
+			return Attachment{}, nil, fmt.Errorf("encrypting packets: %w", err)
+		}
+		a.Data = sealed
+	}
+	meta.PcapFile = a.Name
+
+	metaBytes, err := e.encodeMetadata(meta)
+	if err != nil {
+		return Attachment{}, nil, err
+	}
+	return a, metaBytes, nil
+}
+
+// encodeMetadata signs metadata and returns the contents of its file.
+func (e *jobEncoder) encodeMetadata(meta *Metadata) ([]byte, error) {
+	if e.signer != nil {
+		if err := e.signer.Sign(meta); err != nil {
+			return nil, fmt.Errorf("signing metadata: %w", err)
+		}
+	}
+
+	metaBytes, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("marshaling metadata: %w", err)
+	}
+	if e.encryptMetadata {
+		if metaBytes, err = e.sealMetadata(meta.JobID, metaBytes); err != nil {
+			return nil, err
+		}
+	}
+	return metaBytes, nil
+}
+
+// sealMetadata encrypts marshaled metadata into its on-disk envelope.
+func (e *jobEncoder) sealMetadata(jobID string, metaBytes []byte) ([]byte, error) {
+	keyID, sealed, err := e.keys.seal(metaBytes, sealAAD(jobID, "json"))
+	if err != nil {
+		return nil, fmt.Errorf("encrypting metadata: %w", err)
+	}
+	envelope, err := json.MarshalIndent(sealedMetadata{
+		JobID:          jobID,
+		KeyID:          keyID,
+		SealedMetadata: sealed,
+	}, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("marshaling metadata: %w", err)
+	}
+	return envelope, nil
+}
+
+// hasFreeSpace reports whether the file system holding path has at least
+// minFreeMB megabytes available.
+func hasFreeSpace(path string, minFreeMB int) bool {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		// If we can't check, assume we have space
+		return true
+	}
+
+	// Calculate available space in MB
+	availMB := (stat.Bavail * uint64(stat.Bsize)) / (1024 * 1024)
+	return availMB >= uint64(minFreeMB)
+}
@@ -0,0 +1,359 @@
+package job
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Problem kinds reported by CheckStore.
+const (
+	FsckInvalidMetadata     = "invalid_metadata"
+	FsckMissingPayload      = "missing_payload"
+	FsckUnreadablePayload   = "unreadable_payload"
+	FsckSizeMismatch        = "size_mismatch"
+	FsckHashMismatch        = "hash_mismatch"
+	FsckMissingAttachment   = "missing_attachment"
+	FsckInvalidSignature    = "invalid_signature"
+	FsckMissingSignature    = "missing_signature"
+	FsckInvalidUploadStatus = "invalid_upload_status"
+	FsckOrphanedFile        = "orphaned_file"
+)
+
+// uploadStatuses are the valid values of an upload status file's status.
+var uploadStatuses = map[string]bool{
+	UploadPending:  true,
+	UploadUploaded: true,
+	UploadFailed:   true,
+	UploadSkipped:  true,
+}
+
+// FsckProblem is a damaged file found by CheckStore. File is relative to
+// the base path.
+type FsckProblem struct {
+	Kind   string `json:"kind"`
+	JobID  string `json:"job_id,omitempty"`
+	File   string `json:"file"`
+	Detail string `json:"detail"`
+}
+
+// FsckReport is the result of CheckStore.
+type FsckReport struct {
+	Days int `json:"days"`
+	Jobs int `json:"jobs"`
+	// Damaged lists the IDs of the jobs with at least one problem.
+	Damaged  []string      `json:"damaged"`
+	Problems []FsckProblem `json:"problems"`
+}
+
+// OK reports whether the check found no problems.
+func (r *FsckReport) OK() bool {
+	return len(r.Problems) == 0
+}
+
+// CheckStore walks the job tree below basePath and checks every job: the
+// metadata must parse and be well-formed, the payload must decode to the
+// recorded byte_len and sha256, attachments must exist, signatures must
+// verify and upload status files must be valid. Payloads without metadata
+// and leftover temporary files are reported as orphaned. keys may be nil
+// when encryption is not configured; encrypted jobs are then unreadable.
+// Signatures are checked against the trusted key pub and not at all if pub
+// is nil.
+func CheckStore(basePath string, keys *Keyring, pub ed25519.PublicKey) (*FsckReport, error) {
+	days, err := dayDirs(basePath)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &FsckReport{Damaged: []string{}, Problems: []FsckProblem{}}
+	damaged := make(map[string]bool)
+	problem := func(kind, jobID, path, detail string) {
+		rel, err := filepath.Rel(basePath, path)
+		if err != nil {
+			rel = path
+		}
+		report.Problems = append(report.Problems, FsckProblem{
+			Kind:   kind,
+			JobID:  jobID,
+			File:   filepath.ToSlash(rel),
+			Detail: detail,
+		})
+		if jobID != "" {
+			damaged[jobID] = true
+		}
+	}
+
+	for _, day := range days {
+		report.Days++
+
+		entries, err := os.ReadDir(day.path)
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %w", day.path, err)
+		}
+		names := make(map[string]bool, len(entries))
+		for _, e := range entries {
+			names[e.Name()] = true
+		}
+
+		for _, e := range entries {
+			name := e.Name()
+			path := filepath.Join(day.path, name)
+			switch {
+			case e.IsDir() || name == ManifestName || name == ManifestHeadName || name == ManifestHeadName+".tmp":
+			case strings.HasSuffix(name, ".tmp"):
+				problem(FsckOrphanedFile, "", path, "temporary file of an interrupted write")
+			case strings.HasSuffix(name, ".upload.json"):
+				jobID := strings.TrimSuffix(name, ".upload.json")
+				if !names[jobID+".json"] {
+					problem(FsckOrphanedFile, jobID, path, "upload status without job metadata")
+					continue
+				}
+				checkUploadStatus(jobID, path, problem)
+			case strings.HasSuffix(name, ".json"):
+				report.Jobs++
+				checkJob(day, strings.TrimSuffix(path, ".json"), keys, pub, names, problem)
+			case strings.HasSuffix(name, ".bin"):
+				if jobID := strings.TrimSuffix(name, ".bin"); !names[jobID+".json"] {
+					problem(FsckOrphanedFile, jobID, path, "payload without job metadata")
+				}
+			}
+		}
+	}
+
+	for jobID := range damaged {
+		report.Damaged = append(report.Damaged, jobID)
+	}
+	sort.Strings(report.Damaged)
+	return report, nil
+}
+
+// checkJob checks the metadata, payload and attachments of the job at base.
+func checkJob(day dayDir, base string, keys *Keyring, pub ed25519.PublicKey, names map[string]bool, problem func(kind, jobID, path, detail string)) {
+	jobID := filepath.Base(base)
+	jsonPath := base + ".json"
+
+	meta, err := ReadMetadata(jsonPath, keys)
+	if err != nil {
+		problem(FsckInvalidMetadata, jobID, jsonPath, err.Error())
+		return
+	}
+
+	binPath := base + ".bin"
+	stored, err := os.ReadFile(binPath)
+	if err != nil && !os.IsNotExist(err) {
+		problem(FsckUnreadablePayload, jobID, binPath, err.Error())
+		return
+	}
+	files := jobFiles{
+		jobID:      jobID,
+		jsonPath:   jsonPath,
+		binPath:    binPath,
+		payload:    stored,
+		hasPayload: err == nil,
+		attachmentPath: func(name string) string {
+			return filepath.Join(day.path, name)
+		},
+		hasAttachment: func(name string) bool {
+			return names[name]
+		},
+	}
+	checkJobFiles(&meta, day, files, keys, pub, problem)
+}
+
+// jobFiles are the stored files of a job checked by checkJobFiles, wherever
+// the job is kept.
+type jobFiles struct {
+	jobID             string
+	jsonPath, binPath string
+	payload           []byte
+	hasPayload        bool
+	attachmentPath    func(name string) string
+	hasAttachment     func(name string) bool
+}
+
+// checkJobFiles checks the parsed metadata of a job against its stored
+// payload and attachments.
+func checkJobFiles(meta *Metadata, day dayDir, files jobFiles, keys *Keyring, pub ed25519.PublicKey, problem func(kind, jobID, path, detail string)) {
+	jobID := files.jobID
+	for _, detail := range metadataErrors(meta, jobID, day) {
+		problem(FsckInvalidMetadata, jobID, files.jsonPath, detail)
+	}
+
+	for _, file := range meta.AttachmentFiles() {
+		if !files.hasAttachment(file) {
+			problem(FsckMissingAttachment, jobID, files.attachmentPath(file), "attachment listed in metadata does not exist")
+		}
+	}
+
+	// With a trusted key, an unsigned job is as suspect as a badly signed
+	// one: stripping the signature must not hide an edit
+	if pub != nil {
+		if meta.Signature == "" {
+			problem(FsckMissingSignature, jobID, files.jsonPath, "job is not signed")
+		} else if err := VerifySignature(*meta, pub); err != nil {
+			problem(FsckInvalidSignature, jobID, files.jsonPath, err.Error())
+		}
+	}
+
+	// Decode the payload without trusting byte_len, so that size and hash
+	// mismatches are told apart
+	binPath := files.binPath
+	if !files.hasPayload {
+		problem(FsckMissingPayload, jobID, binPath, "payload file does not exist")
+		return
+	}
+	stored := files.payload
+	if meta.StoredByteLen != 0 && len(stored) != meta.StoredByteLen {
+		problem(FsckSizeMismatch, jobID, binPath,
+			fmt.Sprintf("stored file has %d bytes, metadata records %d", len(stored), meta.StoredByteLen))
+	}
+	data := stored
+	if meta.KeyID != "" {
+		var err error
+		if data, err = keys.open(meta.KeyID, stored, sealAAD(jobID, "bin")); err != nil {
+			problem(FsckUnreadablePayload, jobID, binPath, err.Error())
+			return
+		}
+	}
+	payload, err := decodeUnbounded(meta.PayloadCodec, data)
+	if err != nil {
+		problem(FsckUnreadablePayload, jobID, binPath, fmt.Sprintf("decoding %s payload: %v", meta.PayloadCodec, err))
+		return
+	}
+	if len(payload) != meta.ByteLen {
+		problem(FsckSizeMismatch, jobID, binPath,
+			fmt.Sprintf("payload has %d bytes, metadata records %d", len(payload), meta.ByteLen))
+	}
+	if got := fileHash(payload); got != meta.SHA256 {
+		problem(FsckHashMismatch, jobID, binPath,
+			fmt.Sprintf("payload sha256 %s, metadata records %s", got, meta.SHA256))
+	}
+}
+
+// Check checks every live job of the segment store like CheckStore checks
+// the job tree. Files are reported relative to the base path as the
+// segment holding the job.
+func (s *SegmentStore) Check(pub ed25519.PublicKey) (*FsckReport, error) {
+	s.mu.Lock()
+	jobs := make(map[string]segmentJob, len(s.jobs))
+	for id, j := range s.jobs {
+		jobs[id] = *j
+	}
+	s.mu.Unlock()
+
+	report := &FsckReport{Jobs: len(jobs), Damaged: []string{}, Problems: []FsckProblem{}}
+	damaged := make(map[string]bool)
+	problem := func(kind, jobID, path, detail string) {
+		report.Problems = append(report.Problems, FsckProblem{
+			Kind:   kind,
+			JobID:  jobID,
+			File:   path,
+			Detail: detail,
+		})
+		damaged[jobID] = true
+	}
+
+	for id, j := range jobs {
+		segment := fmt.Sprintf("%s/%08d.seg", SegmentDir, j.segment)
+		files, err := s.readFiles(&j)
+		if err != nil {
+			problem(FsckUnreadablePayload, id, segment, err.Error())
+			continue
+		}
+		meta, err := parseMetadata(files[id+".json"], s.keys)
+		if err != nil {
+			problem(FsckInvalidMetadata, id, segment, err.Error())
+			continue
+		}
+
+		// Segments are not split by day, so the job's own day is used
+		start := meta.CaptureStartTS.UTC()
+		day := dayDir{date: time.Date(start.Year(), start.Month(), start.Day(), 0, 0, 0, 0, time.UTC)}
+		payload, ok := files[id+".bin"]
+		checkJobFiles(&meta, day, jobFiles{
+			jobID:          id,
+			jsonPath:       segment,
+			binPath:        segment,
+			payload:        payload,
+			hasPayload:     ok,
+			attachmentPath: func(string) string { return segment },
+			hasAttachment: func(name string) bool {
+				_, ok := files[name]
+				return ok
+			},
+		}, s.keys, pub, problem)
+	}
+
+	for jobID := range damaged {
+		report.Damaged = append(report.Damaged, jobID)
+	}
+	sort.Strings(report.Damaged)
+	sort.SliceStable(report.Problems, func(i, k int) bool {
+		return report.Problems[i].JobID < report.Problems[k].JobID
+	})
+	return report, nil
+}
+
+// metadataErrors validates the fields every saved job must have.
+func metadataErrors(meta *Metadata, jobID string, day dayDir) []string {
+	var errs []string
+	if meta.JobID != jobID {
+		errs = append(errs, fmt.Sprintf("job_id %q does not match the file name", meta.JobID))
+	}
+	if meta.DeviceID == "" {
+		errs = append(errs, "device_id is empty")
+	}
+	if meta.CaptureStartTS.IsZero() {
+		errs = append(errs, "capture_start_ts is missing")
+	} else if start := meta.CaptureStartTS.UTC(); start.Before(day.date) || !start.Before(day.date.AddDate(0, 0, 1)) {
+		errs = append(errs, fmt.Sprintf("capture_start_ts %s is outside its day directory", start.Format("2006-01-02T15:04:05Z")))
+	}
+	if meta.CaptureEndTS.Before(meta.CaptureStartTS) {
+		errs = append(errs, "capture_end_ts is before capture_start_ts")
+	}
+	if meta.ByteLen < 0 {
+		errs = append(errs, "byte_len is negative")
+	}
+	if sum, err := hex.DecodeString(meta.SHA256); err != nil || len(sum) != 32 {
+		errs = append(errs, fmt.Sprintf("sha256 %q is not a hex SHA256", meta.SHA256))
+	}
+	switch meta.PayloadCodec {
+	case "", CodecNone, CodecGzip, CodecZstd:
+	default:
+		errs = append(errs, fmt.Sprintf("unknown payload_codec %q", meta.PayloadCodec))
+	}
+	return errs
+}
+
+// checkUploadStatus validates an upload status file.
+func checkUploadStatus(jobID, path string, problem func(kind, jobID, path, detail string)) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		problem(FsckInvalidUploadStatus, jobID, path, err.Error())
+		return
+	}
+	var status struct {
+		JobID    string `json:"job_id"`
+		Status   string `json:"status"`
+		Attempts int    `json:"attempts"`
+	}
+	if err := json.Unmarshal(data, &status); err != nil {
+		problem(FsckInvalidUploadStatus, jobID, path, fmt.Sprintf("parsing upload status: %v", err))
+		return
+	}
+	if status.JobID != jobID {
+		problem(FsckInvalidUploadStatus, jobID, path, fmt.Sprintf("job_id %q does not match the file name", status.JobID))
+	}
+	if !uploadStatuses[status.Status] {
+		problem(FsckInvalidUploadStatus, jobID, path, fmt.Sprintf("unknown status %q", status.Status))
+	}
+	if status.Attempts < 0 {
+		problem(FsckInvalidUploadStatus, jobID, path, "attempts is negative")
+	}
+}
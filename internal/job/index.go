@@ -0,0 +1,390 @@
+package job
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	bucketJobs      = []byte("jobs")
+	bucketByTime    = []byte("by_time")
+	bucketByPrinter = []byte("by_printer")
+	bucketByTag     = []byte("by_tag")
+	bucketMeta      = []byte("meta")
+
+	keyCleanShutdown = []byte("clean_shutdown")
+)
+
+// IndexEntry is the indexed summary of a stored job.
+type IndexEntry struct {
+	JobID          string    `json:"job_id"`
+	Path           string    `json:"path"`
+	CaptureStartTS time.Time `json:"capture_start_ts"`
+	CaptureEndTS   time.Time `json:"capture_end_ts"`
+	PrinterIP      string    `json:"printer_ip"`
+	PrinterPort    uint16    `json:"printer_port"`
+	SrcIP          string    `json:"src_ip"`
+	ByteLen        int       `json:"byte_len"`
+	SHA256         string    `json:"sha256"`
+	ContentType    string    `json:"content_type,omitempty"`
+	Tags           []string  `json:"tags,omitempty"`
+	UploadStatus   string    `json:"upload_status"`
+	OrderNumber    string    `json:"order_number,omitempty"`
+}
+
+// IndexQuery selects jobs from the index. Zero fields do not restrict the
+// result.
+type IndexQuery struct {
+	// From and To bound the capture start time; To is exclusive.
+	From      time.Time
+	To        time.Time
+	PrinterIP string
+	Tag       string
+	// Limit caps the number of results, oldest first.
+	Limit int
+}
+
+// Index is an embedded bbolt database of job summaries, maintained by the
+// store and rebuildable from the job tree. Jobs are keyed by ID with
+// secondary keys on capture time, printer and tag.
+type Index struct {
+	db       *bolt.DB
+	basePath string
+}
+
+// OpenIndex opens or creates the index at path for the job tree at
+// basePath. Reports whether the index needs a rebuild because it is new or
+// was not closed cleanly.
+func OpenIndex(path, basePath string) (*Index, bool, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+		return nil, false, fmt.Errorf("creating index directory: %w", err)
+	}
+
+	db, err := bolt.Open(path, 0640, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, false, fmt.Errorf("opening index: %w", err)
+	}
+
+	stale := false
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{bucketJobs, bucketByTime, bucketByPrinter, bucketByTag, bucketMeta} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		meta := tx.Bucket(bucketMeta)
+		stale = !bytes.Equal(meta.Get(keyCleanShutdown), []byte{1})
+		return meta.Put(keyCleanShutdown, []byte{0})
+	})
+	if err != nil {
+		db.Close()
+		return nil, false, fmt.Errorf("initializing index: %w", err)
+	}
+
+	return &Index{db: db, basePath: basePath}, stale, nil
+}
+
+// OpenIndexReadOnly opens an existing index for queries. It fails while
+// tapd holds the index open.
+func OpenIndexReadOnly(path, basePath string) (*Index, error) {
+	db, err := bolt.Open(path, 0640, &bolt.Options{Timeout: time.Second, ReadOnly: true})
+	if err != nil {
+		return nil, fmt.Errorf("opening index: %w", err)
+	}
+	return &Index{db: db, basePath: basePath}, nil
+}
+
+// Close marks the index as cleanly shut down and closes it.
+func (x *Index) Close() error {
+	if x == nil {
+		return nil
+	}
+	if !x.db.IsReadOnly() {
+		x.db.Update(func(tx *bolt.Tx) error {
+			return tx.Bucket(bucketMeta).Put(keyCleanShutdown, []byte{1})
+		})
+	}
+	return x.db.Close()
+}
+
+// Add indexes a saved job. base is the job path without extension.
+func (x *Index) Add(meta *Metadata, base string) error {
+	if x == nil {
+		return nil
+	}
+	return x.db.Update(func(tx *bolt.Tx) error {
+		return x.put(tx, x.entry(meta, base, UploadPending))
+	})
+}
+
+// SetUploadStatus records the upload status of a job. Unknown jobs are
+// ignored.
+func (x *Index) SetUploadStatus(jobID, status string) {
+	if x == nil {
+		return
+	}
+	x.db.Update(func(tx *bolt.Tx) error {
+		data := tx.Bucket(bucketJobs).Get([]byte(jobID))
+		if data == nil {
+			return nil
+		}
+		var e IndexEntry
+		if err := json.Unmarshal(data, &e); err != nil {
+			return err
+		}
+		e.UploadStatus = status
+		return x.put(tx, e)
+	})
+}
+
+// Remove drops a deleted job from the index.
+func (x *Index) Remove(jobID string) {
+	if x == nil {
+		return
+	}
+	x.db.Update(func(tx *bolt.Tx) error {
+		return x.remove(tx, jobID)
+	})
+}
+
+// Get returns the index entry of a job.
+func (x *Index) Get(jobID string) (IndexEntry, bool, error) {
+	var e IndexEntry
+	found := false
+	err := x.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(bucketJobs).Get([]byte(jobID))
+		if data == nil {
+			return nil
+		}
+		found = true
+		return json.Unmarshal(data, &e)
+	})
+	return e, found, err
+}
+
+// Len returns the number of indexed jobs.
+func (x *Index) Len() int {
+	n := 0
+	x.db.View(func(tx *bolt.Tx) error {
+		n = tx.Bucket(bucketJobs).Stats().KeyN
+		return nil
+	})
+	return n
+}
+
+// Query returns the jobs matching q, oldest first. The most selective
+// secondary key is scanned: printer or tag if given, otherwise time.
+func (x *Index) Query(q IndexQuery) ([]IndexEntry, error) {
+	results := []IndexEntry{}
+
+	err := x.db.View(func(tx *bolt.Tx) error {
+		bucket, prefix := tx.Bucket(bucketByTime), []byte(nil)
+		switch {
+		case q.PrinterIP != "":
+			bucket, prefix = tx.Bucket(bucketByPrinter), prefixKey(q.PrinterIP)
+		case q.Tag != "":
+			bucket, prefix = tx.Bucket(bucketByTag), prefixKey(q.Tag)
+		}
+		jobs := tx.Bucket(bucketJobs)
+
+		c := bucket.Cursor()
+		seek := append(slices.Clip(prefix), timeKey(q.From)...)
+		for k, v := c.Seek(seek); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			ts := time.Unix(0, int64(binary.BigEndian.Uint64(k[len(prefix):])))
+			if !q.To.IsZero() && !ts.Before(q.To) {
+				break
+			}
+
+			data := jobs.Get(v)
+			if data == nil {
+				continue
+			}
+			var e IndexEntry
+			if err := json.Unmarshal(data, &e); err != nil {
+				return err
+			}
+			if q.PrinterIP != "" && e.PrinterIP != q.PrinterIP {
+				continue
+			}
+			if q.Tag != "" && !slices.Contains(e.Tags, q.Tag) {
+				continue
+			}
+
+			results = append(results, e)
+			if q.Limit > 0 && len(results) >= q.Limit {
+				break
+			}
+		}
+		return nil
+	})
+
+	return results, err
+}
+
+// Rebuild replaces the index contents with the jobs found in the job tree.
+// keys decrypts encrypted metadata and may be nil. Returns the number of
+// jobs indexed.
+func (x *Index) Rebuild(keys *Keyring) (int, error) {
+	days, err := dayDirs(x.basePath)
+	if err != nil {
+		return 0, err
+	}
+
+	var entries []IndexEntry
+	for _, day := range days {
+		jobIDs, err := jobIDsInDir(day.path)
+		if err != nil {
+			continue
+		}
+		for _, id := range jobIDs {
+			base := filepath.Join(day.path, id)
+			meta, err := ReadMetadata(base+".json", keys)
+			if err != nil {
+				continue
+			}
+			entries = append(entries, x.entry(&meta, base, readUploadStatus(base)))
+		}
+	}
+
+	err = x.db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{bucketJobs, bucketByTime, bucketByPrinter, bucketByTag} {
+			if err := tx.DeleteBucket(name); err != nil {
+				return err
+			}
+			if _, err := tx.CreateBucket(name); err != nil {
+				return err
+			}
+		}
+		for _, e := range entries {
+			if err := x.put(tx, e); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("rebuilding index: %w", err)
+	}
+	return len(entries), nil
+}
+
+func (x *Index) entry(meta *Metadata, base, uploadStatus string) IndexEntry {
+	path, err := filepath.Rel(x.basePath, base)
+	if err != nil {
+		path = base
+	}
+	e := IndexEntry{
+		JobID:          meta.JobID,
+		Path:           filepath.ToSlash(path),
+		CaptureStartTS: meta.CaptureStartTS,
+		CaptureEndTS:   meta.CaptureEndTS,
+		PrinterIP:      meta.PrinterIP,
+		PrinterPort:    meta.PrinterPort,
+		SrcIP:          meta.SrcIP,
+		ByteLen:        meta.ByteLen,
+		SHA256:         meta.SHA256,
+		ContentType:    meta.ContentType,
+		Tags:           meta.Tags,
+		UploadStatus:   uploadStatus,
+	}
+	if meta.Order != nil {
+		e.OrderNumber = meta.Order.OrderNumber
+	}
+	return e
+}
+
+// put writes an entry and its secondary keys, replacing an older version.
+func (x *Index) put(tx *bolt.Tx, e IndexEntry) error {
+	if err := x.remove(tx, e.JobID); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	id := []byte(e.JobID)
+	if err := tx.Bucket(bucketJobs).Put(id, data); err != nil {
+		return err
+	}
+	for _, sk := range secondaryKeys(e) {
+		if err := tx.Bucket(sk.bucket).Put(sk.key, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (x *Index) remove(tx *bolt.Tx, jobID string) error {
+	jobs := tx.Bucket(bucketJobs)
+	data := jobs.Get([]byte(jobID))
+	if data == nil {
+		return nil
+	}
+	var old IndexEntry
+	if err := json.Unmarshal(data, &old); err != nil {
+		return err
+	}
+	for _, sk := range secondaryKeys(old) {
+		if err := tx.Bucket(sk.bucket).Delete(sk.key); err != nil {
+			return err
+		}
+	}
+	return jobs.Delete([]byte(jobID))
+}
+
+type secondaryKey struct {
+	bucket []byte
+	key    []byte
+}
+
+// secondaryKeys returns the keys of an entry: [prefix\x00]start-time job-id.
+func secondaryKeys(e IndexEntry) []secondaryKey {
+	suffix := append(timeKey(e.CaptureStartTS), e.JobID...)
+	keys := []secondaryKey{
+		{bucketByTime, suffix},
+		{bucketByPrinter, append(prefixKey(e.PrinterIP), suffix...)},
+	}
+	for _, tag := range e.Tags {
+		keys = append(keys, secondaryKey{bucketByTag, append(prefixKey(tag), suffix...)})
+	}
+	return keys
+}
+
+func prefixKey(s string) []byte {
+	return append([]byte(s), 0)
+}
+
+// timeKey encodes a time so that keys sort chronologically.
+func timeKey(t time.Time) []byte {
+	key := make([]byte, 8)
+	if !t.IsZero() {
+		binary.BigEndian.PutUint64(key, uint64(t.UnixNano()))
+	}
+	return key
+}
+
+// ParseQueryTime parses a query bound given as RFC 3339 time or as a
+// YYYY-MM-DD date, which is midnight UTC and not midnight in the site's
+// time zone. An empty string is the zero time.
+func ParseQueryTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse("2006-01-02", s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q (want RFC 3339 or YYYY-MM-DD)", s)
+	}
+	return t, nil
+}
@@ -3,15 +3,16 @@ package job
 import (
 	"crypto/sha256"
 	"encoding/hex"
-	"encoding/json"
 	"fmt"
+	"log/slog"
 	"os"
 	"path/filepath"
 	"sync"
-	"syscall"
 	"time"
 
 	"github.com/google/uuid"
+
+	"github.com/marcenggist/kitchen-printer-tap/internal/config"
 )
 
 // Metadata represents the JSON metadata for a captured print job.
@@ -26,17 +27,124 @@ type Metadata struct {
 	CaptureEndTS   time.Time `json:"capture_end_ts"`
 	ByteLen        int       `json:"byte_len"`
 	SHA256         string    `json:"sha256"`
-	Transport      string    `json:"transport"`
-	Tags           []string  `json:"tags,omitempty"`
-	ReprintOfJobID string    `json:"reprint_of_job_id,omitempty"`
+	// PayloadCodec is the compression of the .bin file; ByteLen and
+	// SHA256 always describe the uncompressed payload.
+	PayloadCodec  string `json:"payload_codec,omitempty"`
+	StoredByteLen int    `json:"stored_byte_len,omitempty"`
+	// KeyID identifies the key the payload and attachments are encrypted
+	// with; empty if the job is stored unencrypted.
+	KeyID string `json:"key_id,omitempty"`
+	// NormalizedSHA256 is the fingerprint of the ticket text with
+	// volatile fields (times, dates, reprint banners) masked.
+	NormalizedSHA256 string   `json:"normalized_sha256,omitempty"`
+	Transport        string   `json:"transport"`
+	ContentType      string   `json:"content_type,omitempty"`
+	Tags             []string `json:"tags,omitempty"`
+	ReprintOfJobID   string   `json:"reprint_of_job_id,omitempty"`
+	ReprintMatch     string   `json:"reprint_match,omitempty"`
+	// ReroutedFromJobID is set when the same ticket was sent to another
+	// printer shortly before, e.g. because that printer failed.
+	ReroutedFromJobID   string `json:"rerouted_from_job_id,omitempty"`
+	ReroutedFromPrinter string `json:"rerouted_from_printer,omitempty"`
+	CancelsJobID        string `json:"cancels_job_id,omitempty"`
+
+	RasterImages []RasterImage `json:"raster_images,omitempty"`
+	Barcodes     []Barcode     `json:"barcodes,omitempty"`
+	Order        *Order        `json:"order,omitempty"`
+
+	// Anomalies lists irregularities of the TCP stream the payload was
+	// reassembled from: AnomalySeqGap and AnomalyOutOfOrder.
+	Anomalies []string `json:"anomalies,omitempty"`
+	// PcapFile is the file holding the captured packets of the job, saved
+	// next to it for jobs with anomalies.
+	PcapFile string `json:"pcap_file,omitempty"`
+
+	// SigningKey is the device's Ed25519 public key and Signature its
+	// signature over SignedMetadata, both base64 encoded.
+	SigningKey string `json:"signing_key,omitempty"`
+	Signature  string `json:"signature,omitempty"`
+}
+
+// Stream anomalies recorded in Metadata.Anomalies.
+const (
+	// AnomalySeqGap means data is missing: a segment arrived beyond the
+	// next expected sequence number.
+	AnomalySeqGap = "seq_gap"
+	// AnomalyOutOfOrder means a segment arrived before data that was
+	// already captured and was appended out of place.
+	AnomalyOutOfOrder = "out_of_order"
+)
+
+// AttachmentFiles returns the names of the files stored next to the job
+// besides its payload and metadata.
+func (m *Metadata) AttachmentFiles() []string {
+	var files []string
+	for _, img := range m.RasterImages {
+		files = append(files, img.File)
+	}
+	if m.PcapFile != "" {
+		files = append(files, m.PcapFile)
+	}
+	return files
+}
+
+// RasterImage describes a bitmap extracted from the job payload and stored
+// as a PNG file next to the job.
+type RasterImage struct {
+	File    string `json:"file"`
+	Command string `json:"command"`
+	Offset  int    `json:"offset"`
+	Width   int    `json:"width"`
+	Height  int    `json:"height"`
+}
+
+// Barcode is a barcode or 2D symbol (QR, PDF417, ...) printed by the job.
+type Barcode struct {
+	Symbology string `json:"symbology"`
+	Data      string `json:"data"`
+	Command   string `json:"command"`
+	Offset    int    `json:"offset"`
+}
+
+// Order is the structured order extracted from the ticket text by a
+// POS vendor template.
+type Order struct {
+	Template     string      `json:"template"`
+	Vendor       string      `json:"vendor,omitempty"`
+	OrderNumber  string      `json:"order_number,omitempty"`
+	Table        string      `json:"table,omitempty"`
+	Covers       int         `json:"covers,omitempty"`
+	Waiter       string      `json:"waiter,omitempty"`
+	PrintedAt    *time.Time  `json:"printed_at,omitempty"`
+	PrintedAtRaw string      `json:"printed_at_raw,omitempty"`
+	Items        []OrderItem `json:"items,omitempty"`
+	// Void is set for cancellation (STORNO / VOID / CANCEL) tickets.
+	Void bool `json:"void,omitempty"`
+	// CancelsOrderNumber is the order number a void ticket refers to.
+	CancelsOrderNumber string `json:"cancels_order_number,omitempty"`
+}
+
+// OrderItem is a line item on an order ticket.
+type OrderItem struct {
+	Quantity  int      `json:"quantity"`
+	Name      string   `json:"name"`
+	Modifiers []string `json:"modifiers,omitempty"`
+}
+
+// Attachment is an auxiliary file derived from the job payload, written to
+// the job directory under Name when the job is saved.
+type Attachment struct {
+	Name string
+	Data []byte
 }
 
 // Job represents an in-progress or completed print job capture.
 type Job struct {
-	mu       sync.Mutex
-	Metadata Metadata
-	Data     []byte
-	closed   bool
+	mu          sync.Mutex
+	Metadata    Metadata
+	Data        []byte
+	Attachments []Attachment
+	closed      bool
 }
 
 // New creates a new job with the given parameters.
@@ -57,6 +165,17 @@ func New(deviceID, siteID, printerIP string, printerPort uint16, srcIP, transpor
 	}
 }
 
+// NewClosed returns a closed job with the given metadata and contents, for
+// jobs that were closed earlier and kept outside the store.
+func NewClosed(meta Metadata, data []byte, attachments []Attachment) *Job {
+	return &Job{
+		Metadata:    meta,
+		Data:        data,
+		Attachments: attachments,
+		closed:      true,
+	}
+}
+
 // Append adds data to the job. Returns false if job is already closed.
 func (j *Job) Append(data []byte) bool {
 	j.mu.Lock()
@@ -108,11 +227,13 @@ func (j *Job) AddTag(tag string) {
 	j.Metadata.Tags = append(j.Metadata.Tags, tag)
 }
 
-// SetReprintOf marks this job as a reprint of another job.
-func (j *Job) SetReprintOf(jobID string) {
+// SetReprintOf marks this job as a reprint of another job. match is
+// MatchExact or MatchNormalized.
+func (j *Job) SetReprintOf(jobID, match string) {
 	j.mu.Lock()
 	defer j.mu.Unlock()
 	j.Metadata.ReprintOfJobID = jobID
+	j.Metadata.ReprintMatch = match
 	for _, tag := range j.Metadata.Tags {
 		if tag == "reprint" {
 			return
@@ -121,27 +242,207 @@ func (j *Job) SetReprintOf(jobID string) {
 	j.Metadata.Tags = append(j.Metadata.Tags, "reprint")
 }
 
+// SetReroutedFrom marks this job as a re-route of a job sent to another
+// printer. match is MatchExact or MatchNormalized.
+func (j *Job) SetReroutedFrom(jobID, printerIP, match string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.Metadata.ReroutedFromJobID = jobID
+	j.Metadata.ReroutedFromPrinter = printerIP
+	j.Metadata.ReprintMatch = match
+	for _, tag := range j.Metadata.Tags {
+		if tag == "rerouted" {
+			return
+		}
+	}
+	j.Metadata.Tags = append(j.Metadata.Tags, "rerouted")
+}
+
+// GetNormalizedHash returns the normalized fingerprint of the job.
+func (j *Job) GetNormalizedHash() string {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.Metadata.NormalizedSHA256
+}
+
+// SetNormalizedHash records the normalized fingerprint of the job.
+func (j *Job) SetNormalizedHash(hash string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.Metadata.NormalizedSHA256 = hash
+}
+
+// SetContentType records the classified printer language of the payload.
+func (j *Job) SetContentType(contentType string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.Metadata.ContentType = contentType
+}
+
+// SetVoid marks this job as a cancellation ticket. cancelsJobID is the
+// job it cancels and may be empty if the original job is unknown.
+func (j *Job) SetVoid(cancelsJobID string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.Metadata.CancelsJobID = cancelsJobID
+	for _, tag := range j.Metadata.Tags {
+		if tag == "void" {
+			return
+		}
+	}
+	j.Metadata.Tags = append(j.Metadata.Tags, "void")
+}
+
+// AddRasterImage records an extracted raster image and attaches its PNG
+// encoding to the job.
+func (j *Job) AddRasterImage(img RasterImage, pngData []byte) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	img.File = fmt.Sprintf("%s.raster-%d.png", j.Metadata.JobID, len(j.Metadata.RasterImages)+1)
+	j.Metadata.RasterImages = append(j.Metadata.RasterImages, img)
+	j.Attachments = append(j.Attachments, Attachment{Name: img.File, Data: pngData})
+}
+
+// AddAnomaly records an irregularity of the job's TCP stream.
+func (j *Job) AddAnomaly(kind string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	for _, a := range j.Metadata.Anomalies {
+		if a == kind {
+			return
+		}
+	}
+	j.Metadata.Anomalies = append(j.Metadata.Anomalies, kind)
+}
+
+// AttachPcap attaches the captured packets of the job in pcap format.
+func (j *Job) AttachPcap(pcapData []byte) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.Metadata.PcapFile = j.Metadata.JobID + ".pcap"
+	j.Attachments = append(j.Attachments, Attachment{Name: j.Metadata.PcapFile, Data: pcapData})
+}
+
+// SetBarcodes records the barcodes decoded from the job payload.
+func (j *Job) SetBarcodes(codes []Barcode) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.Metadata.Barcodes = codes
+}
+
+// SetOrder records the order extracted from the ticket text.
+func (j *Job) SetOrder(o *Order) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.Metadata.Order = o
+}
+
 // Store represents the job storage backend.
 type Store struct {
-	basePath  string
-	minFreeMB int
-	mu        sync.Mutex
+	jobEncoder
+	basePath        string
+	minFreeMB       int
+	index           *Index
+	maxStorageBytes int64
+	usedBytes       int64
+	evictUnuploaded bool
+	quotaRetryAt    time.Time
+	quotaMeasuredAt time.Time
+	readOnly        bool
+	fs              fileSystem
+	logger          *slog.Logger
+	mu              sync.Mutex
+	// manifestMu serializes manifest appends; manifestHeads caches the
+	// last entry of each day manifest by day directory.
+	manifestMu    sync.Mutex
+	manifestHeads map[string]manifestHead
 }
 
-// NewStore creates a new job store.
-func NewStore(basePath string, minFreeMB int) (*Store, error) {
-	if err := os.MkdirAll(basePath, 0750); err != nil {
+// NewStore creates a new job store. Jobs are encrypted with the active key
+// of keys and signed by signer unless they are nil.
+func NewStore(cfg *config.StorageConfig, keys *Keyring, signer *Signer, logger *slog.Logger) (*Store, error) {
+	if err := os.MkdirAll(cfg.BasePath, 0750); err != nil {
 		return nil, fmt.Errorf("creating base path: %w", err)
 	}
 
+	s := &Store{
+		jobEncoder:      newJobEncoder(cfg, keys, signer),
+		basePath:        cfg.BasePath,
+		minFreeMB:       cfg.MinFreeMB,
+		maxStorageBytes: int64(cfg.MaxStorageMB) * 1024 * 1024,
+		evictUnuploaded: cfg.QuotaEvictUnuploaded,
+		fs:              osFS{},
+		logger:          logger,
+	}
+
+	if s.maxStorageBytes > 0 {
+		used, err := s.treeSize()
+		if err != nil {
+			return nil, fmt.Errorf("measuring job storage: %w", err)
+		}
+		s.usedBytes = used
+		s.quotaMeasuredAt = time.Now()
+		logger.Info("job storage quota",
+			"max_storage_mb", cfg.MaxStorageMB,
+			"used_mb", used/(1024*1024))
+	}
+
+	if cfg.IndexFile != "" {
+		index, stale, err := OpenIndex(cfg.IndexFile, cfg.BasePath)
+		if err != nil {
+			return nil, err
+		}
+		s.index = index
+
+		// Jobs saved or deleted since an unclean shutdown may be missing
+		if stale {
+			start := time.Now()
+			n, err := index.Rebuild(keys)
+			if err != nil {
+				index.Close()
+				return nil, err
+			}
+			logger.Info("job index rebuilt",
+				"path", cfg.IndexFile,
+				"jobs", n,
+				"duration", time.Since(start).Round(time.Millisecond).String())
+		}
+	}
+
+	return s, nil
+}
+
+// Index returns the job index, or nil if indexing is disabled.
+func (s *Store) Index() *Index {
+	return s.index
+}
+
+// Close closes the job index.
+func (s *Store) Close() error {
+	return s.index.Close()
+}
+
+// OpenStoreReadOnly opens an existing job tree for reading without its
+// index, so it can be used while tapd runs. Jobs are looked up in the day
+// directories and the store refuses to save, delete or mark jobs.
+func OpenStoreReadOnly(cfg *config.StorageConfig, keys *Keyring, logger *slog.Logger) (*Store, error) {
+	if _, err := os.Stat(cfg.BasePath); err != nil {
+		return nil, fmt.Errorf("opening job tree: %w", err)
+	}
 	return &Store{
-		basePath:  basePath,
-		minFreeMB: minFreeMB,
+		jobEncoder: newJobEncoder(cfg, keys, nil),
+		basePath:   cfg.BasePath,
+		readOnly:   true,
+		fs:         osFS{},
+		logger:     logger,
 	}, nil
 }
 
 // Save writes a job to disk atomically.
 func (s *Store) Save(job *Job) error {
+	if s.readOnly {
+		return errReadOnlyStore
+	}
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
@@ -149,15 +450,24 @@ func (s *Store) Save(job *Job) error {
 		return fmt.Errorf("cannot save unclosed job")
 	}
 
-	// Check disk space
-	if !s.hasEnoughSpace() {
+	enc, err := s.encode(job)
+	if err != nil {
+		return err
+	}
+	payload, attachments, metaBytes := enc.payload, enc.attachments, enc.metadata
+
+	// Make room within the quota by evicting old jobs, then check disk
+	// space
+	size := job.storedSize(len(payload))
+	s.ensureSpace(size)
+	if !hasFreeSpace(s.basePath, s.minFreeMB) {
 		return fmt.Errorf("insufficient disk space (min %d MB required)", s.minFreeMB)
 	}
 
 	// Create date-based directory structure
 	ts := job.Metadata.CaptureStartTS
 	dir := filepath.Join(s.basePath, ts.Format("2006"), ts.Format("01"), ts.Format("02"))
-	if err := os.MkdirAll(dir, 0750); err != nil {
+	if err := mkdirAllDurable(s.fs, s.basePath, dir); err != nil {
 		return fmt.Errorf("creating job directory: %w", err)
 	}
 
@@ -168,68 +478,67 @@ func (s *Store) Save(job *Job) error {
 	tmpJSONPath := jsonPath + ".tmp"
 
 	// Write binary data atomically
-	if err := s.writeFileAtomic(tmpBinPath, binPath, job.Data); err != nil {
+	if err := writeFileAtomic(s.fs, tmpBinPath, binPath, payload); err != nil {
 		return fmt.Errorf("writing binary file: %w", err)
 	}
 
-	// Write metadata JSON atomically
-	metaBytes, err := json.MarshalIndent(job.Metadata, "", "  ")
-	if err != nil {
-		os.Remove(binPath)
-		return fmt.Errorf("marshaling metadata: %w", err)
+	// Write attachments before metadata so the JSON file only appears once
+	// everything it references is in place. Each rename is synced before
+	// the next file is written, so after a power cut the metadata never
+	// survives without its payload.
+	var written []string
+	removeAll := func() {
+		s.fs.Remove(binPath)
+		for _, path := range written {
+			s.fs.Remove(path)
+		}
+	}
+	for _, a := range attachments {
+		path := filepath.Join(dir, a.Name)
+		if err := writeFileAtomic(s.fs, path+".tmp", path, a.Data); err != nil {
+			removeAll()
+			return fmt.Errorf("writing attachment %s: %w", a.Name, err)
+		}
+		written = append(written, path)
 	}
 
-	if err := s.writeFileAtomic(tmpJSONPath, jsonPath, metaBytes); err != nil {
-		os.Remove(binPath)
+	// Write metadata JSON atomically
+	if err := writeFileAtomic(s.fs, tmpJSONPath, jsonPath, metaBytes); err != nil {
+		removeAll()
 		return fmt.Errorf("writing metadata file: %w", err)
 	}
-
-	return nil
-}
-
-func (s *Store) writeFileAtomic(tmpPath, finalPath string, data []byte) error {
-	f, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0640)
-	if err != nil {
-		return err
+	s.usedBytes += int64(len(payload) + len(metaBytes))
+	for _, a := range attachments {
+		s.usedBytes += int64(len(a.Data))
 	}
 
-	if _, err := f.Write(data); err != nil {
-		f.Close()
-		os.Remove(tmpPath)
-		return err
+	// Record the stored files in the day manifest
+	files := map[string]string{
+		filepath.Base(binPath):  fileHash(payload),
+		filepath.Base(jsonPath): fileHash(metaBytes),
 	}
-
-	if err := f.Sync(); err != nil {
-		f.Close()
-		os.Remove(tmpPath)
-		return err
+	for _, a := range attachments {
+		files[a.Name] = fileHash(a.Data)
 	}
-
-	if err := f.Close(); err != nil {
-		os.Remove(tmpPath)
-		return err
+	if err := s.appendManifest(dir, ManifestEntry{
+		Op:     ManifestSave,
+		JobID:  job.Metadata.JobID,
+		SHA256: job.Metadata.SHA256,
+		Files:  files,
+	}); err != nil {
+		s.logger.Warn("failed to record job in manifest",
+			"job_id", job.Metadata.JobID,
+			"error", err)
 	}
-
-	if err := os.Rename(tmpPath, finalPath); err != nil {
-		os.Remove(tmpPath)
-		return err
+	if err := s.index.Add(&job.Metadata, baseName); err != nil {
+		s.logger.Warn("failed to index job",
+			"job_id", job.Metadata.JobID,
+			"error", err)
 	}
 
 	return nil
 }
 
-func (s *Store) hasEnoughSpace() bool {
-	var stat syscall.Statfs_t
-	if err := syscall.Statfs(s.basePath, &stat); err != nil {
-		// If we can't check, assume we have space
-		return true
-	}
-
-	// Calculate available space in MB
-	availMB := (stat.Bavail * uint64(stat.Bsize)) / (1024 * 1024)
-	return availMB >= uint64(s.minFreeMB)
-}
-
 // GetJobPath returns the path where a job would be stored.
 func (s *Store) GetJobPath(jobID string, ts time.Time) string {
 	dir := filepath.Join(s.basePath, ts.Format("2006"), ts.Format("01"), ts.Format("02"))
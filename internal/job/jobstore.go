@@ -0,0 +1,316 @@
+package job
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// JobStore stores captured jobs. The capturer saves jobs through it and
+// the uploader reads them and records their upload status, so neither
+// depends on how jobs are laid out. Store is the file-per-job
+// implementation.
+type JobStore interface {
+	// Save stores a closed job.
+	Save(j *Job) error
+	// Get returns a stored job with its decoded payload, attachments and
+	// upload status. It returns an error wrapping ErrJobNotFound for
+	// unknown jobs.
+	Get(jobID string) (*StoredJob, error)
+	// List returns the metadata of the jobs selected by opts in capture
+	// order.
+	List(opts ListOptions) ([]Metadata, error)
+	// Delete removes a job.
+	Delete(jobID string) error
+	// MarkUploaded records the upload status of a job: the outcome of an
+	// upload attempt, or that the job was skipped.
+	MarkUploaded(jobID string, status UploadStatus) error
+	// AttachPcap saves captured packets, in pcap format, with a stored job
+	// as its PcapFile. It returns ErrPcapExists if the job already has
+	// packets.
+	AttachPcap(jobID string, pcapData []byte) error
+}
+
+// ErrJobNotFound is returned for jobs that are not in the store.
+var ErrJobNotFound = errors.New("job not found")
+
+// ErrPcapExists is returned by AttachPcap for jobs that already have their
+// packets saved.
+var ErrPcapExists = errors.New("job already has saved packets")
+
+// errReadOnlyStore is returned by stores opened read-only for writes.
+var errReadOnlyStore = errors.New("job store is open read-only")
+
+// StoredJob is a job read back from a JobStore.
+type StoredJob struct {
+	Metadata Metadata
+	// Payload is the raw captured payload, decrypted and decompressed.
+	Payload []byte
+	// Attachments are the job's raster images in metadata order. Images
+	// that cannot be read are left out.
+	Attachments []Attachment
+	Upload      UploadStatus
+}
+
+// ListOptions selects jobs for List. Zero fields do not restrict the
+// result.
+type ListOptions struct {
+	// Since selects jobs captured at or after the given time.
+	Since time.Time
+	// PendingUpload selects jobs that are neither uploaded nor skipped.
+	PendingUpload bool
+}
+
+var _ JobStore = (*Store)(nil)
+
+// Get returns a stored job.
+func (s *Store) Get(jobID string) (*StoredJob, error) {
+	base, err := s.jobBase(jobID)
+	if err != nil {
+		return nil, err
+	}
+
+	meta, err := ReadMetadata(base+".json", s.keys)
+	if err != nil {
+		return nil, fmt.Errorf("reading metadata: %w", err)
+	}
+	payload, err := LoadPayload(base, &meta, s.keys)
+	if err != nil {
+		return nil, fmt.Errorf("reading payload: %w", err)
+	}
+
+	stored := &StoredJob{
+		Metadata: meta,
+		Payload:  payload,
+		Upload:   loadUploadStatus(base, jobID),
+	}
+	dir := filepath.Dir(base)
+	for _, img := range meta.RasterImages {
+		data, err := LoadAttachment(dir, img.File, &meta, s.keys)
+		if err != nil {
+			s.logger.Warn("failed to read raster image",
+				"path", filepath.Join(dir, img.File),
+				"error", err)
+			continue
+		}
+		stored.Attachments = append(stored.Attachments, Attachment{Name: img.File, Data: data})
+	}
+	return stored, nil
+}
+
+// List returns the metadata of the selected jobs in capture order. Jobs
+// whose metadata cannot be read are skipped.
+func (s *Store) List(opts ListOptions) ([]Metadata, error) {
+	days, err := dayDirs(s.basePath)
+	if err != nil {
+		return nil, err
+	}
+
+	since := opts.Since.UTC()
+	var jobs []Metadata
+	for _, day := range days {
+		if !day.date.AddDate(0, 0, 1).After(since) {
+			continue
+		}
+		ids, err := jobIDsInDir(day.path)
+		if err != nil {
+			continue
+		}
+		for _, id := range ids {
+			base := filepath.Join(day.path, id)
+			if opts.PendingUpload && uploadDone(base) {
+				continue
+			}
+			meta, err := ReadMetadata(base+".json", s.keys)
+			if err != nil {
+				continue
+			}
+			if !meta.CaptureStartTS.Before(since) {
+				jobs = append(jobs, meta)
+			}
+		}
+	}
+
+	sort.Slice(jobs, func(i, k int) bool {
+		return jobs[i].CaptureStartTS.Before(jobs[k].CaptureStartTS)
+	})
+
+	return jobs, nil
+}
+
+// Delete removes a job and records the deletion in the day manifest.
+func (s *Store) Delete(jobID string) error {
+	if s.readOnly {
+		return errReadOnlyStore
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	base, err := s.jobBase(jobID)
+	if err != nil {
+		return err
+	}
+	_, err = s.deleteJob(base, "manual")
+	return err
+}
+
+// deleteJob records the deletion of the job at base with the given reason,
+// removes its files and drops the job from the index. Returns the bytes
+// freed. The deletion is recorded first, so that a job whose removal is
+// interrupted is removed by Recover rather than saved again. Must be
+// called with mu held.
+func (s *Store) deleteJob(base, reason string) (int64, error) {
+	freed, err := jobFilesSize(base)
+	if err != nil {
+		return 0, err
+	}
+	if err := s.recordDeletion(base, reason); err != nil {
+		return 0, fmt.Errorf("recording deletion in manifest: %w", err)
+	}
+	if err := s.removeJobFiles(base); err != nil {
+		return 0, err
+	}
+	s.usedBytes -= freed
+
+	s.index.Remove(filepath.Base(base))
+	s.removeDayIfEmpty(filepath.Dir(base))
+	return freed, nil
+}
+
+// MarkUploaded writes the upload status file of a job and updates the
+// index. It holds mu so that it cannot recreate the status file of a job
+// that Delete or quota eviction just removed.
+func (s *Store) MarkUploaded(jobID string, status UploadStatus) error {
+	if s.readOnly {
+		return errReadOnlyStore
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	base, err := s.jobBase(jobID)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(base + ".json"); os.IsNotExist(err) {
+		return fmt.Errorf("%w: %s", ErrJobNotFound, jobID)
+	}
+
+	status.JobID = jobID
+	data, err := json.MarshalIndent(status, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshaling upload status: %w", err)
+	}
+	path := base + ".upload.json"
+	var oldSize int64
+	if info, err := os.Stat(path); err == nil {
+		oldSize = info.Size()
+	}
+	if err := writeFileAtomic(s.fs, path+".tmp", path, data); err != nil {
+		return fmt.Errorf("writing upload status: %w", err)
+	}
+	s.usedBytes += int64(len(data)) - oldSize
+	s.index.SetUploadStatus(jobID, status.Status)
+	return nil
+}
+
+// AttachPcap writes the packets next to the job and rewrites its metadata
+// to list them. The payload and other files are left as they are. The day
+// manifest gets a new save entry for the job with all of its files.
+func (s *Store) AttachPcap(jobID string, pcapData []byte) error {
+	if s.readOnly {
+		return errReadOnlyStore
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	base, err := s.jobBase(jobID)
+	if err != nil {
+		return err
+	}
+	jsonPath := base + ".json"
+	meta, err := ReadMetadata(jsonPath, s.keys)
+	if err != nil {
+		return fmt.Errorf("reading metadata: %w", err)
+	}
+	if meta.PcapFile != "" {
+		return fmt.Errorf("%w: %s", ErrPcapExists, meta.PcapFile)
+	}
+	var oldSize int64
+	if info, err := os.Stat(jsonPath); err == nil {
+		oldSize = info.Size()
+	}
+
+	a, metaBytes, err := s.encodePcap(&meta, pcapData)
+	if err != nil {
+		return err
+	}
+	// The packets go first, so that the metadata never lists a file that
+	// is not there
+	dir := filepath.Dir(base)
+	pcapPath := filepath.Join(dir, a.Name)
+	if err := writeFileAtomic(s.fs, pcapPath+".tmp", pcapPath, a.Data); err != nil {
+		return fmt.Errorf("writing packets: %w", err)
+	}
+	if err := writeFileAtomic(s.fs, jsonPath+".tmp", jsonPath, metaBytes); err != nil {
+		s.fs.Remove(pcapPath)
+		return fmt.Errorf("writing metadata file: %w", err)
+	}
+	s.usedBytes += int64(len(a.Data)+len(metaBytes)) - oldSize
+
+	files := map[string]string{filepath.Base(jsonPath): fileHash(metaBytes)}
+	for _, name := range append([]string{jobID + ".bin"}, meta.AttachmentFiles()...) {
+		if _, ok := files[name]; ok {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			continue
+		}
+		files[name] = fileHash(data)
+	}
+	if err := s.appendManifest(dir, ManifestEntry{
+		Op:     ManifestSave,
+		JobID:  jobID,
+		SHA256: meta.SHA256,
+		Files:  files,
+	}); err != nil {
+		s.logger.Warn("failed to record job in manifest",
+			"job_id", jobID,
+			"error", err)
+	}
+	if err := s.index.Add(&meta, base); err != nil {
+		s.logger.Warn("failed to index job",
+			"job_id", jobID,
+			"error", err)
+	}
+	s.index.SetUploadStatus(jobID, loadUploadStatus(base, jobID).Status)
+	return nil
+}
+
+// jobBase returns the path of a job without extension, looking it up in
+// the index if there is one.
+func (s *Store) jobBase(jobID string) (string, error) {
+	if jobID == "" || filepath.Base(jobID) != jobID {
+		return "", fmt.Errorf("%w: %q", ErrJobNotFound, jobID)
+	}
+
+	if s.index != nil {
+		if e, ok, err := s.index.Get(jobID); err == nil && ok {
+			return filepath.Join(s.basePath, filepath.FromSlash(e.Path)), nil
+		}
+	}
+
+	matches, err := filepath.Glob(filepath.Join(s.basePath, "*", "*", "*", jobID+".json"))
+	if err != nil {
+		return "", err
+	}
+	if len(matches) == 0 {
+		return "", fmt.Errorf("%w: %s", ErrJobNotFound, jobID)
+	}
+	return strings.TrimSuffix(matches[0], ".json"), nil
+}
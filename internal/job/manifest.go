@@ -0,0 +1,787 @@
+package job
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ManifestName is the name of the append-only manifest in each day
+// directory.
+const ManifestName = "manifest.jsonl"
+
+// ManifestHeadName is the name of the signed head kept next to each day
+// manifest.
+const ManifestHeadName = "manifest.head"
+
+// ManifestArchiveDir is the directory below the base path that keeps the
+// manifests of day directories removed once all of their jobs were
+// deleted, as <day>.jsonl and <day>.head. It also holds LatestDayName.
+const ManifestArchiveDir = "manifests"
+
+// LatestDayName is the signed head of the first entry of the day started
+// last. New days link to it, and removing the newest days entirely is
+// noticed.
+const LatestDayName = "latest.json"
+
+// Manifest operations.
+const (
+	ManifestSave   = "save"
+	ManifestDelete = "delete"
+)
+
+// ManifestEntry is a line of a day manifest. Each entry includes the hash
+// of the previous entry, so removing, reordering or editing entries breaks
+// the chain. The first entry of a day links to the first entry of the day
+// started before it, so the days form one chain. Entries are signed with the
+// device key, so the chain cannot be recomputed after editing it.
+type ManifestEntry struct {
+	Seq   int       `json:"seq"`
+	TS    time.Time `json:"ts"`
+	Op    string    `json:"op"`
+	JobID string    `json:"job_id"`
+	// SHA256 is the payload hash from the job metadata.
+	SHA256 string `json:"sha256,omitempty"`
+	// Files maps the job's file names to the SHA256 of their stored bytes.
+	Files  map[string]string `json:"files,omitempty"`
+	Reason string            `json:"reason,omitempty"`
+	// PrevDay is the day (YYYY-MM-DD) the first entry of a manifest links
+	// to; Prev is then the hash of that day's first entry.
+	PrevDay string `json:"prev_day,omitempty"`
+	Prev    string `json:"prev"`
+	Hash    string `json:"hash"`
+	// Sig is the device key's base64 signature over Hash.
+	Sig string `json:"sig,omitempty"`
+}
+
+// computeHash returns the hash of the entry with its Hash and Sig fields
+// cleared.
+func (e ManifestEntry) computeHash() string {
+	e.Hash = ""
+	e.Sig = ""
+	data, _ := json.Marshal(e)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// ManifestHead records the last entry of a day manifest, signed with the
+// device key. Cutting entries off the end of a manifest leaves it behind
+// its head.
+type ManifestHead struct {
+	Day        string `json:"day"`
+	Seq        int    `json:"seq"`
+	Hash       string `json:"hash"`
+	SigningKey string `json:"signing_key,omitempty"`
+	Signature  string `json:"signature,omitempty"`
+}
+
+// signedBytes returns the bytes a head signature covers.
+func (h ManifestHead) signedBytes() []byte {
+	h.Signature = ""
+	data, _ := json.Marshal(h)
+	return data
+}
+
+// verify checks the signature of the head against pub.
+func (h ManifestHead) verify(pub ed25519.PublicKey) error {
+	if h.Signature == "" {
+		return fmt.Errorf("head is not signed")
+	}
+	sig, err := base64.StdEncoding.DecodeString(h.Signature)
+	if err != nil || !ed25519.Verify(pub, h.signedBytes(), sig) {
+		return fmt.Errorf("head signature does not match the trusted key")
+	}
+	return nil
+}
+
+// signManifestEntry sets the signature of e, which must be hashed.
+func (s *Signer) signManifestEntry(e *ManifestEntry) {
+	e.Sig = base64.StdEncoding.EncodeToString(ed25519.Sign(s.key, []byte(e.Hash)))
+}
+
+// signManifestHead sets the signing key and signature of h.
+func (s *Signer) signManifestHead(h *ManifestHead) {
+	h.SigningKey = s.publicKey
+	h.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(s.key, h.signedBytes()))
+}
+
+// manifestHead is the last entry of a day manifest.
+type manifestHead struct {
+	seq  int
+	hash string
+}
+
+// appendManifest adds an entry to the manifest of the day directory dir,
+// linking it to the previous entry. The first entry of a day links to the
+// first entry of the day started before it, recorded in LatestDayName, so
+// the days form one chain in the order they were started. The entry and
+// the day's head are signed with the device key unless signing is off.
+func (s *Store) appendManifest(dir string, e ManifestEntry) error {
+	s.manifestMu.Lock()
+	defer s.manifestMu.Unlock()
+
+	day, err := manifestDay(s.basePath, dir)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(dir, ManifestName)
+	head, ok := s.manifestHeads[dir]
+	if !ok {
+		// A day removed earlier continues its archived chain
+		if err := s.restoreManifest(dir, day); err != nil {
+			return fmt.Errorf("restoring archived manifest: %w", err)
+		}
+		if head, err = s.readManifestHead(path); err != nil {
+			return fmt.Errorf("reading manifest: %w", err)
+		}
+	}
+
+	e.Prev = head.hash
+	if head.seq == 0 {
+		prev, err := latestDay(s.basePath)
+		if err != nil {
+			return fmt.Errorf("reading latest day: %w", err)
+		}
+		e.PrevDay = prev.Day
+		e.Prev = prev.Hash
+	}
+	e.Seq = head.seq + 1
+	e.TS = time.Now().UTC()
+	e.Hash = e.computeHash()
+	if s.signer != nil {
+		s.signer.signManifestEntry(&e)
+	}
+
+	line, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("marshaling manifest entry: %w", err)
+	}
+
+	f, err := s.fs.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0640)
+	if err != nil {
+		return fmt.Errorf("opening manifest: %w", err)
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return fmt.Errorf("writing manifest: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("syncing manifest: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("closing manifest: %w", err)
+	}
+	// The first entry creates the file
+	if e.Seq == 1 {
+		if err := s.fs.SyncDir(dir); err != nil {
+			return fmt.Errorf("syncing manifest directory: %w", err)
+		}
+	}
+	if s.manifestHeads == nil {
+		s.manifestHeads = make(map[string]manifestHead)
+	}
+	s.manifestHeads[dir] = manifestHead{seq: e.Seq, hash: e.Hash}
+
+	newHead := ManifestHead{Day: day, Seq: e.Seq, Hash: e.Hash}
+	if s.signer != nil {
+		s.signer.signManifestHead(&newHead)
+	}
+	if err := writeManifestHead(s.fs, filepath.Join(dir, ManifestHeadName), newHead); err != nil {
+		return fmt.Errorf("writing manifest head: %w", err)
+	}
+	if e.Seq == 1 {
+		archive := filepath.Join(s.basePath, ManifestArchiveDir)
+		if err := mkdirAllDurable(s.fs, s.basePath, archive); err != nil {
+			return fmt.Errorf("recording latest day: %w", err)
+		}
+		if err := writeManifestHead(s.fs, filepath.Join(archive, LatestDayName), newHead); err != nil {
+			return fmt.Errorf("recording latest day: %w", err)
+		}
+	}
+	return nil
+}
+
+// manifestDay returns the day (YYYY-MM-DD) of the day directory dir.
+func manifestDay(basePath, dir string) (string, error) {
+	rel, err := filepath.Rel(basePath, dir)
+	if err != nil {
+		return "", err
+	}
+	date, err := time.Parse("2006/01/02", filepath.ToSlash(rel))
+	if err != nil {
+		return "", fmt.Errorf("%s is not a day directory", dir)
+	}
+	return date.Format("2006-01-02"), nil
+}
+
+// writeManifestHead atomically replaces the head file at path.
+func writeManifestHead(fsys fileSystem, path string, h ManifestHead) error {
+	data, err := json.Marshal(h)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(fsys, path+".tmp", path, data)
+}
+
+// readManifestHeadFile reads a head file written by writeManifestHead.
+func readManifestHeadFile(path string) (ManifestHead, error) {
+	var h ManifestHead
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return h, err
+	}
+	if err := json.Unmarshal(data, &h); err != nil {
+		return h, fmt.Errorf("parsing %s: %w", filepath.Base(path), err)
+	}
+	return h, nil
+}
+
+// latestDay returns the head of the first entry of the day started last,
+// which the first entry of a new day links to. It is read from
+// LatestDayName; if a crash kept that file from being updated, the day
+// already linking to the recorded one is the latest. Returns an empty head
+// before the first day.
+func latestDay(basePath string) (ManifestHead, error) {
+	latest, err := readManifestHeadFile(filepath.Join(basePath, ManifestArchiveDir, LatestDayName))
+	if os.IsNotExist(err) {
+		return ManifestHead{}, nil
+	}
+	if err != nil {
+		return ManifestHead{}, err
+	}
+
+	sources, err := manifestFiles(basePath)
+	if err != nil {
+		return ManifestHead{}, err
+	}
+	for day, src := range sources {
+		if first, err := firstManifestEntry(src.manifest); err == nil && first.PrevDay == latest.Day && first.Prev == latest.Hash && day != latest.Day {
+			return ManifestHead{Day: day, Seq: first.Seq, Hash: first.Hash}, nil
+		}
+	}
+	return latest, nil
+}
+
+// firstManifestEntry returns the first entry of a manifest.
+func firstManifestEntry(path string) (ManifestEntry, error) {
+	var e ManifestEntry
+	f, err := os.Open(path)
+	if err != nil {
+		return e, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	if !scanner.Scan() {
+		if err := scanner.Err(); err != nil {
+			return e, err
+		}
+		return e, fmt.Errorf("%s is empty", path)
+	}
+	err = json.Unmarshal(scanner.Bytes(), &e)
+	return e, err
+}
+
+// manifestFiles returns the manifest and head files of each day below
+// basePath, whether its directory still exists or it was archived, by day.
+func manifestFiles(basePath string) (map[string]manifestSource, error) {
+	sources := make(map[string]manifestSource)
+
+	archived, err := filepath.Glob(filepath.Join(basePath, ManifestArchiveDir, "*.jsonl"))
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range archived {
+		day := strings.TrimSuffix(filepath.Base(path), ".jsonl")
+		if _, err := time.Parse("2006-01-02", day); err != nil {
+			continue
+		}
+		sources[day] = manifestSource{
+			manifest: path,
+			head:     strings.TrimSuffix(path, ".jsonl") + ".head",
+		}
+	}
+
+	days, err := dayDirs(basePath)
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range days {
+		path := filepath.Join(d.path, ManifestName)
+		if _, err := os.Stat(path); err != nil {
+			continue
+		}
+		sources[d.date.Format("2006-01-02")] = manifestSource{
+			manifest: path,
+			head:     filepath.Join(d.path, ManifestHeadName),
+			dir:      d.path,
+		}
+	}
+	return sources, nil
+}
+
+// manifestSource locates the manifest of a day. dir is empty for archived
+// days.
+type manifestSource struct {
+	manifest string
+	head     string
+	dir      string
+}
+
+// readManifestHead returns the last valid entry of a manifest. If the file
+// ends in a torn line from an interrupted append, a newline is added so the
+// next entry starts on its own line; verification reports the torn line.
+func (s *Store) readManifestHead(path string) (manifestHead, error) {
+	var head manifestHead
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return head, nil
+	}
+	if err != nil {
+		return head, err
+	}
+
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		var e ManifestEntry
+		if len(line) == 0 || json.Unmarshal(line, &e) != nil {
+			continue
+		}
+		head = manifestHead{seq: e.Seq, hash: e.Hash}
+	}
+
+	if len(data) > 0 && data[len(data)-1] != '\n' {
+		f, err := s.fs.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0640)
+		if err != nil {
+			return head, err
+		}
+		_, err = f.Write([]byte("\n"))
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return head, err
+		}
+	}
+
+	return head, nil
+}
+
+// fileHash returns the hex SHA256 of data.
+func fileHash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// recordDeletion records the removal of the job at base in the day
+// manifest.
+func (s *Store) recordDeletion(base, reason string) error {
+	return s.appendManifest(filepath.Dir(base), ManifestEntry{
+		Op:     ManifestDelete,
+		JobID:  filepath.Base(base),
+		Reason: reason,
+	})
+}
+
+// removeDayIfEmpty removes a day directory once no jobs are left in it.
+// Its manifest and head are moved to ManifestArchiveDir, so that the
+// removed day stays part of the chain.
+func (s *Store) removeDayIfEmpty(dir string) bool {
+	if ids, err := jobIDsInDir(dir); err != nil || len(ids) > 0 {
+		return false
+	}
+
+	s.manifestMu.Lock()
+	defer s.manifestMu.Unlock()
+
+	if _, err := os.Stat(filepath.Join(dir, ManifestName)); err == nil {
+		day, err := manifestDay(s.basePath, dir)
+		if err != nil {
+			return false
+		}
+		archive := filepath.Join(s.basePath, ManifestArchiveDir)
+		if err := mkdirAllDurable(s.fs, s.basePath, archive); err != nil {
+			return false
+		}
+		if err := s.fs.Rename(filepath.Join(dir, ManifestName), filepath.Join(archive, day+".jsonl")); err != nil {
+			return false
+		}
+		s.fs.Rename(filepath.Join(dir, ManifestHeadName), filepath.Join(archive, day+".head"))
+		if err := s.fs.SyncDir(archive); err != nil {
+			return false
+		}
+	}
+	s.fs.Remove(filepath.Join(dir, ManifestHeadName+".tmp"))
+	delete(s.manifestHeads, dir)
+	return removeIfEmpty(s.fs, dir)
+}
+
+// restoreManifest moves the archived manifest of day back into its day
+// directory dir, when jobs are saved again to a day that was removed. Must
+// be called with manifestMu held.
+func (s *Store) restoreManifest(dir, day string) error {
+	if _, err := os.Stat(filepath.Join(dir, ManifestName)); err == nil {
+		return nil
+	}
+	archived := filepath.Join(s.basePath, ManifestArchiveDir, day)
+	if _, err := os.Stat(archived + ".jsonl"); err != nil {
+		return nil
+	}
+	if err := s.fs.Rename(archived+".jsonl", filepath.Join(dir, ManifestName)); err != nil {
+		return err
+	}
+	s.fs.Rename(archived+".head", filepath.Join(dir, ManifestHeadName))
+	return s.fs.SyncDir(dir)
+}
+
+// Manifest problem kinds reported by VerifyManifests.
+const (
+	ProblemBrokenChain  = "broken_chain"
+	ProblemCorruptEntry = "corrupt_entry"
+	ProblemBadSignature = "invalid_signature"
+	ProblemBadHead      = "invalid_head"
+	ProblemMissingDay   = "missing_day"
+	ProblemMissingFile  = "missing_file"
+	ProblemModifiedFile = "modified_file"
+	ProblemUnrecorded   = "unrecorded_job"
+	ProblemNoManifest   = "missing_manifest"
+)
+
+// ManifestProblem is an inconsistency found by VerifyManifests.
+type ManifestProblem struct {
+	Kind   string `json:"kind"`
+	Day    string `json:"day"`
+	Line   int    `json:"line,omitempty"`
+	JobID  string `json:"job_id,omitempty"`
+	File   string `json:"file,omitempty"`
+	Detail string `json:"detail"`
+}
+
+// ManifestReport is the result of VerifyManifests.
+type ManifestReport struct {
+	Days int `json:"days"`
+	// ArchivedDays counts the manifests of removed day directories.
+	ArchivedDays int               `json:"archived_days"`
+	Entries      int               `json:"entries"`
+	Jobs         int               `json:"jobs"`
+	Problems     []ManifestProblem `json:"problems"`
+}
+
+// OK reports whether verification found no problems.
+func (r *ManifestReport) OK() bool {
+	return len(r.Problems) == 0
+}
+
+// dayChain is a replayed day manifest.
+type dayChain struct {
+	first *ManifestEntry
+	// bySeq maps entry numbers to entry hashes.
+	bySeq  map[int]string
+	hashes map[string]bool
+	// saved are the jobs saved and not deleted.
+	saved map[string]ManifestEntry
+}
+
+// VerifyManifests checks the manifest chain of every day below basePath,
+// including the archived manifests of removed days, and compares the
+// recorded file hashes with the files on disk. It reports broken or
+// corrupt chain entries, days that do not link into the chain of days or are
+// missing, manifests cut short of their head, files of saved jobs that are
+// missing or modified, and jobs on disk that no manifest entry records.
+// Entry and head signatures are checked against the trusted key pub, and
+// not at all if pub is nil.
+func VerifyManifests(basePath string, pub ed25519.PublicKey) (*ManifestReport, error) {
+	sources, err := manifestFiles(basePath)
+	if err != nil {
+		return nil, err
+	}
+	report := &ManifestReport{Problems: []ManifestProblem{}}
+
+	// Day directories without a manifest are not part of the chain
+	days, err := dayDirs(basePath)
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range days {
+		dayName := d.date.Format("2006-01-02")
+		if _, ok := sources[dayName]; ok {
+			continue
+		}
+		report.Days++
+		if ids, _ := jobIDsInDir(d.path); len(ids) > 0 {
+			report.Problems = append(report.Problems, ManifestProblem{
+				Kind:   ProblemNoManifest,
+				Day:    dayName,
+				Detail: fmt.Sprintf("%d jobs without a manifest", len(ids)),
+			})
+		}
+	}
+
+	names := make([]string, 0, len(sources))
+	for day := range sources {
+		names = append(names, day)
+	}
+	sort.Strings(names)
+
+	chains := make(map[string]*dayChain, len(names))
+	for _, day := range names {
+		src := sources[day]
+		problem := func(p ManifestProblem) {
+			p.Day = day
+			report.Problems = append(report.Problems, p)
+		}
+		if src.dir == "" {
+			report.ArchivedDays++
+		} else {
+			report.Days++
+		}
+
+		chain, err := replayManifest(src.manifest, pub, report, problem)
+		if err != nil {
+			return nil, fmt.Errorf("verifying %s: %w", src.manifest, err)
+		}
+		chains[day] = chain
+
+		checkManifestHead(src.head, day, chain, pub, problem)
+		if err := checkDayFiles(src.dir, chain, report, problem); err != nil {
+			return nil, fmt.Errorf("verifying %s: %w", src.dir, err)
+		}
+	}
+
+	checkDayLinks(names, chains, report)
+	checkLatestDay(basePath, names, chains, pub, report)
+	return report, nil
+}
+
+// replayManifest checks the chain and signatures of a manifest and
+// collects its entries.
+func replayManifest(path string, pub ed25519.PublicKey, report *ManifestReport, problem func(ManifestProblem)) (*dayChain, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	chain := &dayChain{
+		bySeq:  make(map[int]string),
+		hashes: make(map[string]bool),
+		saved:  make(map[string]ManifestEntry),
+	}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	var prev manifestHead
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+
+		var e ManifestEntry
+		if err := json.Unmarshal(line, &e); err != nil {
+			problem(ManifestProblem{Kind: ProblemCorruptEntry, Line: lineNum, Detail: err.Error()})
+			continue
+		}
+		report.Entries++
+
+		if got := e.computeHash(); got != e.Hash {
+			problem(ManifestProblem{Kind: ProblemBrokenChain, Line: lineNum, JobID: e.JobID,
+				Detail: "entry hash does not match its contents"})
+		}
+		// The first entry links to the previous day, see checkDayLinks
+		if chain.first == nil {
+			first := e
+			chain.first = &first
+			if e.Seq != 1 {
+				problem(ManifestProblem{Kind: ProblemBrokenChain, Line: lineNum, JobID: e.JobID,
+					Detail: fmt.Sprintf("manifest starts at entry %d", e.Seq)})
+			}
+		} else if e.Prev != prev.hash || e.Seq != prev.seq+1 {
+			problem(ManifestProblem{Kind: ProblemBrokenChain, Line: lineNum, JobID: e.JobID,
+				Detail: fmt.Sprintf("entry %d does not follow entry %d", e.Seq, prev.seq)})
+		}
+		if pub != nil {
+			sig, err := base64.StdEncoding.DecodeString(e.Sig)
+			if e.Sig == "" || err != nil || !ed25519.Verify(pub, []byte(e.Hash), sig) {
+				problem(ManifestProblem{Kind: ProblemBadSignature, Line: lineNum, JobID: e.JobID,
+					Detail: "entry is not signed with the trusted key"})
+			}
+		}
+		prev = manifestHead{seq: e.Seq, hash: e.Hash}
+		chain.bySeq[e.Seq] = e.Hash
+		chain.hashes[e.Hash] = true
+
+		switch e.Op {
+		case ManifestSave:
+			chain.saved[e.JobID] = e
+		case ManifestDelete:
+			delete(chain.saved, e.JobID)
+		}
+	}
+	return chain, scanner.Err()
+}
+
+// checkDayLinks checks that the days form one chain in the order they
+// were started: the first entry of every day but the first links to an
+// entry of an existing day, and no two days link to the same day, so that
+// days cannot be removed, replaced or inserted unnoticed.
+func checkDayLinks(days []string, chains map[string]*dayChain, report *ManifestReport) {
+	linkedBy := make(map[string]string)
+	origin := ""
+	for _, day := range days {
+		first := chains[day].first
+		if first == nil {
+			continue
+		}
+		problem := func(kind, detail string) {
+			report.Problems = append(report.Problems, ManifestProblem{
+				Kind: kind, Day: day, Line: 1, JobID: first.JobID, Detail: detail,
+			})
+		}
+
+		if first.PrevDay == "" {
+			switch {
+			case first.Prev != "":
+				problem(ProblemBrokenChain, "first entry links to a previous entry but names no previous day")
+			case origin != "":
+				problem(ProblemBrokenChain, fmt.Sprintf("day starts a new chain, but %s already started one", origin))
+			default:
+				origin = day
+			}
+			continue
+		}
+
+		prev, ok := chains[first.PrevDay]
+		switch {
+		case !ok:
+			problem(ProblemMissingDay, fmt.Sprintf("first entry links to %s, which has no manifest", first.PrevDay))
+		case !prev.hashes[first.Prev]:
+			problem(ProblemBrokenChain, fmt.Sprintf("first entry does not link to an entry of %s", first.PrevDay))
+		case linkedBy[first.PrevDay] != "":
+			problem(ProblemBrokenChain, fmt.Sprintf("%s already links to %s", linkedBy[first.PrevDay], first.PrevDay))
+		default:
+			linkedBy[first.PrevDay] = day
+		}
+	}
+}
+
+// checkManifestHead checks the head file of a day against its chain. A
+// crash between appending an entry and writing the head can leave the
+// head one entry behind, but never ahead of the chain.
+func checkManifestHead(path, day string, chain *dayChain, pub ed25519.PublicKey, problem func(ManifestProblem)) {
+	head, err := readManifestHeadFile(path)
+	if err != nil {
+		problem(ManifestProblem{Kind: ProblemBadHead, File: filepath.Base(path), Detail: err.Error()})
+		return
+	}
+	if head.Day != day {
+		problem(ManifestProblem{Kind: ProblemBadHead, File: filepath.Base(path),
+			Detail: fmt.Sprintf("head belongs to %s", head.Day)})
+	}
+	if chain.bySeq[head.Seq] != head.Hash {
+		problem(ManifestProblem{Kind: ProblemBadHead, File: filepath.Base(path),
+			Detail: fmt.Sprintf("manifest has no entry %d with the head's hash; entries were removed or rewritten", head.Seq)})
+	}
+	if pub != nil {
+		if err := head.verify(pub); err != nil {
+			problem(ManifestProblem{Kind: ProblemBadHead, File: filepath.Base(path), Detail: err.Error()})
+		}
+	}
+}
+
+// checkDayFiles compares the files of the jobs a manifest records as saved
+// with the files in the day directory dir, which is empty for archived
+// days whose files are all gone.
+func checkDayFiles(dir string, chain *dayChain, report *ManifestReport, problem func(ManifestProblem)) error {
+	jobIDs := make([]string, 0, len(chain.saved))
+	for jobID := range chain.saved {
+		jobIDs = append(jobIDs, jobID)
+	}
+	sort.Strings(jobIDs)
+	for _, jobID := range jobIDs {
+		report.Jobs++
+		files := chain.saved[jobID].Files
+		names := make([]string, 0, len(files))
+		for name := range files {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			want := files[name]
+			if dir == "" {
+				problem(ManifestProblem{Kind: ProblemMissingFile, JobID: jobID, File: name,
+					Detail: "day directory was removed without deleting the job"})
+				continue
+			}
+			data, err := os.ReadFile(filepath.Join(dir, name))
+			if err != nil {
+				problem(ManifestProblem{Kind: ProblemMissingFile, JobID: jobID, File: name, Detail: err.Error()})
+				continue
+			}
+			if got := fileHash(data); got != want {
+				problem(ManifestProblem{Kind: ProblemModifiedFile, JobID: jobID, File: name,
+					Detail: fmt.Sprintf("sha256 %s, manifest records %s", got, want)})
+			}
+		}
+	}
+	if dir == "" {
+		return nil
+	}
+
+	ids, err := jobIDsInDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if _, ok := chain.saved[id]; !ok {
+			problem(ManifestProblem{Kind: ProblemUnrecorded, JobID: id, Detail: "job has no save entry in the manifest"})
+		}
+	}
+	return nil
+}
+
+// checkLatestDay checks that the day recorded in LatestDayName still has
+// its manifest, so that removing the newest days is noticed.
+func checkLatestDay(basePath string, days []string, chains map[string]*dayChain, pub ed25519.PublicKey, report *ManifestReport) {
+	if len(days) == 0 {
+		return
+	}
+	problem := func(p ManifestProblem) {
+		p.File = ManifestArchiveDir + "/" + LatestDayName
+		report.Problems = append(report.Problems, p)
+	}
+
+	latest, err := readManifestHeadFile(filepath.Join(basePath, ManifestArchiveDir, LatestDayName))
+	if err != nil {
+		problem(ManifestProblem{Kind: ProblemBadHead, Detail: err.Error()})
+		return
+	}
+	if pub != nil {
+		if err := latest.verify(pub); err != nil {
+			problem(ManifestProblem{Kind: ProblemBadHead, Day: latest.Day, Detail: err.Error()})
+		}
+	}
+	chain, ok := chains[latest.Day]
+	switch {
+	case !ok:
+		problem(ManifestProblem{Kind: ProblemMissingDay, Day: latest.Day,
+			Detail: "the newest recorded day has no manifest"})
+	case chain.bySeq[latest.Seq] != latest.Hash:
+		problem(ManifestProblem{Kind: ProblemBadHead, Day: latest.Day,
+			Detail: "the newest recorded day's manifest does not start with the recorded entry"})
+	}
+}
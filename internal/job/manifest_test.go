@@ -0,0 +1,241 @@
+package job
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/marcenggist/kitchen-printer-tap/internal/config"
+)
+
+// newSignedTestStore returns a store that signs jobs and manifests with a
+// new device key.
+func newSignedTestStore(t *testing.T, basePath string) (*Store, *Signer) {
+	t.Helper()
+	signer, _, err := LoadOrCreateSigner(filepath.Join(t.TempDir(), "device.key"))
+	if err != nil {
+		t.Fatalf("LoadOrCreateSigner: %v", err)
+	}
+	cfg := config.DefaultConfig().Storage
+	cfg.BasePath = basePath
+	cfg.MinFreeMB = 0
+	cfg.IndexFile = ""
+	store, err := NewStore(&cfg, nil, signer, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatalf("NewStore: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store, signer
+}
+
+func TestVerifyManifests(t *testing.T) {
+	tests := []struct {
+		name string
+		// tamper changes the tree saved by saveTestJobs, whose jobs are on
+		// 2026-10-17 and 2026-10-18.
+		tamper func(t *testing.T, base string)
+		want   string
+	}{
+		{
+			name:   "untouched",
+			tamper: func(t *testing.T, base string) {},
+		},
+		{
+			name: "first day removed",
+			tamper: func(t *testing.T, base string) {
+				if err := os.RemoveAll(filepath.Join(base, "2026", "10", "17")); err != nil {
+					t.Fatal(err)
+				}
+			},
+			want: ProblemMissingDay,
+		},
+		{
+			name: "newest day removed",
+			tamper: func(t *testing.T, base string) {
+				if err := os.RemoveAll(filepath.Join(base, "2026", "10", "18")); err != nil {
+					t.Fatal(err)
+				}
+			},
+			want: ProblemMissingDay,
+		},
+		{
+			name: "last entry cut off with its files",
+			tamper: func(t *testing.T, base string) {
+				dir := filepath.Join(base, "2026", "10", "17")
+				lines := manifestLines(t, dir)
+				var last ManifestEntry
+				if err := json.Unmarshal(lines[len(lines)-1], &last); err != nil {
+					t.Fatal(err)
+				}
+				for name := range last.Files {
+					os.Remove(filepath.Join(dir, name))
+				}
+				writeManifestLines(t, dir, lines[:len(lines)-1])
+			},
+			want: ProblemBadHead,
+		},
+		{
+			name: "entry rewritten and chain recomputed",
+			tamper: func(t *testing.T, base string) {
+				dir := filepath.Join(base, "2026", "10", "18")
+				lines := manifestLines(t, dir)
+				var e ManifestEntry
+				if err := json.Unmarshal(lines[0], &e); err != nil {
+					t.Fatal(err)
+				}
+				e.SHA256 = "forged"
+				e.Hash = e.computeHash()
+				lines[0], _ = json.Marshal(e)
+				writeManifestLines(t, dir, lines)
+				head, err := readManifestHeadFile(filepath.Join(dir, ManifestHeadName))
+				if err != nil {
+					t.Fatal(err)
+				}
+				head.Hash = e.Hash
+				if err := writeManifestHead(osFS{}, filepath.Join(dir, ManifestHeadName), head); err != nil {
+					t.Fatal(err)
+				}
+			},
+			want: ProblemBadSignature,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			base := t.TempDir()
+			store, signer := newSignedTestStore(t, base)
+			if ids := saveTestJobs(store); len(ids) != 3 {
+				t.Fatalf("saved %d jobs, want 3", len(ids))
+			}
+			tt.tamper(t, base)
+
+			report, err := VerifyManifests(base, signer.Public())
+			if err != nil {
+				t.Fatalf("VerifyManifests: %v", err)
+			}
+			if tt.want == "" {
+				if !report.OK() {
+					t.Fatalf("problems in an untouched tree: %+v", report.Problems)
+				}
+				return
+			}
+			for _, p := range report.Problems {
+				if p.Kind == tt.want {
+					return
+				}
+			}
+			t.Errorf("no %s problem reported: %+v", tt.want, report.Problems)
+		})
+	}
+}
+
+func TestVerifyManifestsAfterRetention(t *testing.T) {
+	base := t.TempDir()
+	store, signer := newSignedTestStore(t, base)
+	if ids := saveTestJobs(store); len(ids) != 3 {
+		t.Fatalf("saved %d jobs, want 3", len(ids))
+	}
+
+	retention := NewRetentionWorker(store, 1, true, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	result, err := retention.Run(time.Date(2026, 10, 25, 0, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if result.DaysRemoved != 2 {
+		t.Fatalf("removed %d days, want 2", result.DaysRemoved)
+	}
+
+	// A later day links to the archived manifests of the removed days
+	j := New("kptap-001", "site-1", "10.0.0.5", 9100, "10.0.0.2", "raw")
+	j.Metadata.CaptureStartTS = time.Date(2026, 10, 24, 12, 0, 0, 0, time.UTC)
+	j.Append([]byte("TABLE 9\n"))
+	j.Close()
+	if err := store.Save(j); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+
+	report, err := VerifyManifests(base, signer.Public())
+	if err != nil {
+		t.Fatalf("VerifyManifests: %v", err)
+	}
+	if !report.OK() {
+		t.Fatalf("problems after retention: %+v", report.Problems)
+	}
+	if report.Days != 1 || report.ArchivedDays != 2 {
+		t.Errorf("days = %d, archived = %d, want 1 and 2", report.Days, report.ArchivedDays)
+	}
+
+	// Removing an archived day is noticed
+	if err := os.Remove(filepath.Join(base, ManifestArchiveDir, "2026-10-18.jsonl")); err != nil {
+		t.Fatal(err)
+	}
+	report, err = VerifyManifests(base, signer.Public())
+	if err != nil {
+		t.Fatalf("VerifyManifests: %v", err)
+	}
+	if report.OK() {
+		t.Error("removed archived day not reported")
+	}
+}
+
+func manifestLines(t *testing.T, dir string) [][]byte {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join(dir, ManifestName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bytes.Split(bytes.TrimSuffix(data, []byte("\n")), []byte("\n"))
+}
+
+func writeManifestLines(t *testing.T, dir string, lines [][]byte) {
+	t.Helper()
+	data := append(bytes.Join(lines, []byte("\n")), '\n')
+	if err := os.WriteFile(filepath.Join(dir, ManifestName), data, 0640); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVerifyManifestsDaysOutOfOrder(t *testing.T) {
+	base := t.TempDir()
+	store, signer := newSignedTestStore(t, base)
+
+	// A spooled job lands in an earlier day after a later day was started,
+	// and a second store in the process writes another tree meanwhile
+	other, _ := newSignedTestStore(t, t.TempDir())
+	for i, day := range []int{18, 17, 18, 16, 17} {
+		for _, s := range []*Store{store, other} {
+			j := New("kptap-001", "site-1", "10.0.0.5", 9100, "10.0.0.2", "raw")
+			j.Metadata.CaptureStartTS = time.Date(2026, 10, day, 12, i, 0, 0, time.UTC)
+			j.Append([]byte("TABLE 9\n"))
+			j.Close()
+			if err := s.Save(j); err != nil {
+				t.Fatalf("Save: %v", err)
+			}
+		}
+	}
+
+	report, err := VerifyManifests(base, signer.Public())
+	if err != nil {
+		t.Fatalf("VerifyManifests: %v", err)
+	}
+	if !report.OK() {
+		t.Fatalf("problems with days started out of order: %+v", report.Problems)
+	}
+
+	// The day started first cannot be dropped from the chain
+	if err := os.RemoveAll(filepath.Join(base, "2026", "10", "18")); err != nil {
+		t.Fatal(err)
+	}
+	report, err = VerifyManifests(base, signer.Public())
+	if err != nil {
+		t.Fatalf("VerifyManifests: %v", err)
+	}
+	if report.OK() {
+		t.Error("removed first day not reported")
+	}
+}
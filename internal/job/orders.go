@@ -0,0 +1,88 @@
+package job
+
+import (
+	"sync"
+	"time"
+)
+
+// OrderTracker remembers recently printed orders by order number so that
+// cancellation (void) tickets can be linked to the job they cancel.
+type OrderTracker struct {
+	mu          sync.Mutex
+	window      time.Duration
+	orders      map[string][]orderEntry
+	lastCleanup time.Time
+}
+
+type orderEntry struct {
+	jobID     string
+	printerIP string
+	timestamp time.Time
+}
+
+// NewOrderTracker creates an order tracker remembering orders for window.
+func NewOrderTracker(window time.Duration) *OrderTracker {
+	return &OrderTracker{
+		window:      window,
+		orders:      make(map[string][]orderEntry),
+		lastCleanup: time.Now(),
+	}
+}
+
+// Find returns the job ID of the most recent order with the given number,
+// preferring orders printed on printerIP. Returns an empty string if no
+// order is known within the window.
+func (ot *OrderTracker) Find(orderNumber, printerIP string) string {
+	ot.mu.Lock()
+	defer ot.mu.Unlock()
+
+	now := time.Now()
+	var fallback string
+	entries := ot.orders[orderNumber]
+	for i := len(entries) - 1; i >= 0; i-- {
+		e := entries[i]
+		if now.Sub(e.timestamp) > ot.window {
+			continue
+		}
+		if e.printerIP == printerIP {
+			return e.jobID
+		}
+		if fallback == "" {
+			fallback = e.jobID
+		}
+	}
+
+	return fallback
+}
+
+// Record stores an order for later lookup.
+func (ot *OrderTracker) Record(orderNumber, printerIP, jobID string) {
+	ot.mu.Lock()
+	defer ot.mu.Unlock()
+
+	now := time.Now()
+	ot.orders[orderNumber] = append(ot.orders[orderNumber], orderEntry{
+		jobID:     jobID,
+		printerIP: printerIP,
+		timestamp: now,
+	})
+
+	// Expire old orders lazily, at most once per window
+	if now.Sub(ot.lastCleanup) < ot.window {
+		return
+	}
+	ot.lastCleanup = now
+	for number, entries := range ot.orders {
+		var valid []orderEntry
+		for _, e := range entries {
+			if now.Sub(e.timestamp) <= ot.window {
+				valid = append(valid, e)
+			}
+		}
+		if len(valid) == 0 {
+			delete(ot.orders, number)
+		} else {
+			ot.orders[number] = valid
+		}
+	}
+}
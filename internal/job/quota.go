@@ -0,0 +1,230 @@
+package job
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// metadataSizeEstimate approximates the size of a job's metadata file.
+const metadataSizeEstimate = 2048
+
+// storedSize estimates the bytes a job with a stored payload of payloadLen
+// bytes occupies on disk.
+func (j *Job) storedSize(payloadLen int) int64 {
+	size := int64(payloadLen) + metadataSizeEstimate
+	for _, a := range j.Attachments {
+		size += int64(len(a.Data))
+	}
+	return size
+}
+
+// quotaRetryInterval is how long ensureSpace waits before measuring the
+// job tree again after it could not make room.
+const quotaRetryInterval = time.Minute
+
+// quotaRescanInterval is how often the tracked size of the job tree is
+// corrected by measuring it. Save, deletions and upload status changes
+// keep it current in between.
+const quotaRescanInterval = time.Hour
+
+// quotaLowWater is the share of the quota, in percent, that eviction frees
+// the store down to, so that the following saves fit without evicting.
+const quotaLowWater = 90
+
+// ensureSpace evicts the oldest jobs when a job of the given size does
+// not fit in the storage quota, until the store is below quotaLowWater
+// percent of the quota. Only jobs that have been uploaded are evicted,
+// unless evictUnuploaded is set; then the oldest jobs that were not
+// uploaded go after all uploaded ones. Nothing is evicted if that would
+// not make enough room for the job. Free disk space is not considered: the
+// job tree cannot be blamed for what else fills the disk. Must be called
+// with mu held.
+func (s *Store) ensureSpace(size int64) {
+	if s.maxStorageBytes == 0 {
+		return
+	}
+	// The tracked size drifts when files are changed outside the store,
+	// so it is measured again now and then
+	if time.Since(s.quotaMeasuredAt) >= quotaRescanInterval {
+		s.measureTree()
+	}
+	if s.fits(size) || time.Now().Before(s.quotaRetryAt) {
+		return
+	}
+
+	candidates, err := s.evictionCandidates(s.evictUnuploaded)
+	if err != nil {
+		s.quotaMeasuredAt = time.Time{}
+		s.logger.Error("failed to list jobs for eviction",
+			"error", err)
+		return
+	}
+
+	var evictable int64
+	for _, c := range candidates {
+		evictable += c.size
+	}
+	if need := s.usedBytes + size - s.maxStorageBytes; evictable < need {
+		s.quotaRetryAt = time.Now().Add(quotaRetryInterval)
+		// Measure again on the next attempt, in case the tree shrank
+		s.quotaMeasuredAt = time.Time{}
+		s.logger.Warn("storage quota exceeded, not enough evictable jobs",
+			"used_mb", s.usedBytes/(1024*1024),
+			"max_storage_mb", s.maxStorageBytes/(1024*1024),
+			"evictable_bytes", evictable,
+			"evict_unuploaded", s.evictUnuploaded)
+		return
+	}
+
+	lowWater := s.maxStorageBytes / 100 * quotaLowWater
+	for _, uploadedOnly := range []bool{true, false} {
+		for i := range candidates {
+			c := &candidates[i]
+			if c.evicted || (uploadedOnly && !c.uploaded) {
+				continue
+			}
+			if s.usedBytes+size <= lowWater {
+				return
+			}
+
+			freed, err := s.deleteJob(c.base, "quota")
+			if err != nil {
+				s.quotaMeasuredAt = time.Time{}
+				s.logger.Warn("failed to evict job",
+					"job_id", filepath.Base(c.base),
+					"error", err)
+				continue
+			}
+			c.evicted = true
+
+			if c.uploaded {
+				s.logger.Info("evicted uploaded job",
+					"job_id", filepath.Base(c.base),
+					"bytes", freed)
+			} else {
+				s.logger.Warn("evicted job that was not uploaded",
+					"job_id", filepath.Base(c.base),
+					"bytes", freed)
+			}
+		}
+	}
+}
+
+// measureTree sets the tracked size of the job tree to its measured size.
+func (s *Store) measureTree() {
+	used, err := s.treeSize()
+	if err != nil {
+		s.logger.Warn("failed to measure job storage",
+			"error", err)
+		return
+	}
+	s.usedBytes = used
+	s.quotaMeasuredAt = time.Now()
+}
+
+// fits reports whether a job of the given size fits within the storage
+// quota.
+func (s *Store) fits(size int64) bool {
+	return s.maxStorageBytes == 0 || s.usedBytes+size <= s.maxStorageBytes
+}
+
+type evictionCandidate struct {
+	base     string
+	size     int64
+	uploaded bool
+	evicted  bool
+}
+
+// evictionCandidates lists the stored jobs that have been uploaded, and
+// those that have not if includeUnuploaded is set, oldest first.
+func (s *Store) evictionCandidates(includeUnuploaded bool) ([]evictionCandidate, error) {
+	days, err := dayDirs(s.basePath)
+	if err != nil {
+		return nil, err
+	}
+
+	var candidates []evictionCandidate
+	for _, day := range days {
+		jobIDs, err := jobIDsInDir(day.path)
+		if err != nil {
+			continue
+		}
+
+		type dayJob struct {
+			base  string
+			mtime int64
+		}
+		var jobs []dayJob
+		for _, id := range jobIDs {
+			base := filepath.Join(day.path, id)
+			info, err := os.Stat(base + ".json")
+			if err != nil {
+				continue
+			}
+			jobs = append(jobs, dayJob{base: base, mtime: info.ModTime().UnixNano()})
+		}
+		sort.Slice(jobs, func(i, j int) bool {
+			return jobs[i].mtime < jobs[j].mtime
+		})
+
+		for _, j := range jobs {
+			uploaded := uploadDone(j.base)
+			if !uploaded && !includeUnuploaded {
+				continue
+			}
+			size, err := jobFilesSize(j.base)
+			if err != nil {
+				continue
+			}
+			candidates = append(candidates, evictionCandidate{
+				base:     j.base,
+				size:     size,
+				uploaded: uploaded,
+			})
+		}
+	}
+
+	return candidates, nil
+}
+
+// jobFilesSize returns the total size of the files of the job at base.
+func jobFilesSize(base string) (int64, error) {
+	files, err := filepath.Glob(base + ".*")
+	if err != nil {
+		return 0, err
+	}
+
+	var size int64
+	for _, path := range files {
+		if info, err := os.Stat(path); err == nil {
+			size += info.Size()
+		}
+	}
+	return size, nil
+}
+
+// treeSize returns the total size of the jobs in the day directories.
+// Other files below the base path (index, device key, quarantine,
+// segments) are not counted: eviction cannot free them.
+func (s *Store) treeSize() (int64, error) {
+	days, err := dayDirs(s.basePath)
+	if err != nil {
+		return 0, err
+	}
+
+	var size int64
+	for _, day := range days {
+		jobIDs, err := jobIDsInDir(day.path)
+		if err != nil {
+			continue
+		}
+		for _, id := range jobIDs {
+			if n, err := jobFilesSize(filepath.Join(day.path, id)); err == nil {
+				size += n
+			}
+		}
+	}
+	return size, nil
+}
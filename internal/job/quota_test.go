@@ -0,0 +1,56 @@
+package job
+
+import (
+	"testing"
+	"time"
+)
+
+// TestQuotaTracksSize checks that the tracked size of the job tree follows
+// saves, upload status changes and evictions without measuring it, and
+// that eviction frees the store down to the low-water mark.
+func TestQuotaTracksSize(t *testing.T) {
+	store := newTestStore(t, t.TempDir(), nil)
+	store.maxStorageBytes = 1 << 30
+	store.quotaMeasuredAt = time.Now()
+
+	ids := saveTestJobs(store)
+	if len(ids) != 3 {
+		t.Fatalf("saved %d jobs, want 3", len(ids))
+	}
+	if err := store.MarkUploaded(ids[0], UploadStatus{Status: UploadUploaded}); err != nil {
+		t.Fatalf("MarkUploaded: %v", err)
+	}
+	used, err := store.treeSize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if store.usedBytes != used {
+		t.Fatalf("tracked %d bytes, tree holds %d", store.usedBytes, used)
+	}
+
+	// Leave less room than the size estimate of the next job, so that it
+	// has to evict
+	store.maxStorageBytes = used + metadataSizeEstimate
+	store.evictUnuploaded = true
+	j := New("kptap-001", "site-1", "10.0.0.5", 9100, "10.0.0.2", "raw")
+	j.Metadata.CaptureStartTS = time.Date(2026, 10, 18, 9, 0, 0, 0, time.UTC)
+	j.Append([]byte("\x1b@TABLE 4\n"))
+	j.Close()
+	if err := store.Save(j); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+
+	used, err = store.treeSize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if store.usedBytes != used {
+		t.Errorf("tracked %d bytes after eviction, tree holds %d", store.usedBytes, used)
+	}
+	if lowWater := store.maxStorageBytes / 100 * quotaLowWater; used > lowWater {
+		t.Errorf("store holds %d bytes after eviction, want at most %d", used, lowWater)
+	}
+	if _, err := store.Get(ids[0]); err == nil {
+		t.Errorf("uploaded job %s not evicted first", ids[0])
+	}
+}
@@ -0,0 +1,345 @@
+package job
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/marcenggist/kitchen-printer-tap/internal/payload"
+)
+
+// jobTempFile matches the temporary files Save and MarkUploaded write a
+// job's payload, metadata, upload status and attachments through.
+var jobTempFile = regexp.MustCompile(`^[0-9a-f-]+\.(bin|json|upload\.json|raster-\d+\.png|pcap)\.tmp$`)
+
+// QuarantineDir is the directory below the base path that receives files
+// that cannot be recovered.
+const QuarantineDir = "quarantine"
+
+// RecoveryReport summarizes a startup recovery run.
+type RecoveryReport struct {
+	// Completed are jobs whose metadata was written to a temporary file
+	// but not yet renamed into place.
+	Completed []string
+	// Removed are jobs whose deletion was recorded in the manifest but
+	// interrupted; their remaining files were removed.
+	Removed []string
+	// Regenerated are jobs whose metadata was rebuilt from an orphaned
+	// payload.
+	Regenerated []string
+	// Quarantined are the files moved to the quarantine directory,
+	// relative to the base path.
+	Quarantined []string
+}
+
+// Recover repairs the day directories after a crash. writeFileAtomic can
+// leave .tmp files behind, and a crash between the payload and metadata renames
+// leaves a .bin without .json. Metadata temporary files that match their
+// payload are renamed into place; the files of jobs whose deletion the
+// manifest records are removed; other orphaned payloads get regenerated
+// metadata tagged "recovered", with deviceID and siteID filled in but the
+// printer and source unknown. Everything else is moved to the quarantine
+// directory. Must be called before capture starts.
+func (s *Store) Recover(deviceID, siteID string) (RecoveryReport, error) {
+	var report RecoveryReport
+	quarantine := filepath.Join(s.basePath, QuarantineDir, time.Now().UTC().Format("20060102T150405Z"))
+
+	days, err := dayDirs(s.basePath)
+	if err != nil {
+		return report, fmt.Errorf("scanning job tree: %w", err)
+	}
+
+	// Only temporary files of job files are ours to touch; the base path
+	// may also hold the index, device key or spool with their own
+	var tmpFiles []string
+	for _, day := range days {
+		entries, err := os.ReadDir(day.path)
+		if err != nil {
+			continue
+		}
+		for _, e := range entries {
+			if !e.IsDir() && jobTempFile.MatchString(e.Name()) {
+				tmpFiles = append(tmpFiles, filepath.Join(day.path, e.Name()))
+			}
+		}
+	}
+
+	moveAside := func(path string) {
+		if rel, err := s.quarantineFile(quarantine, path); err != nil {
+			s.logger.Warn("failed to quarantine file",
+				"path", path,
+				"error", err)
+		} else {
+			report.Quarantined = append(report.Quarantined, rel)
+		}
+	}
+
+	// Finish interrupted metadata writes; all other temporary files are
+	// incomplete by definition
+	for _, path := range tmpFiles {
+		final := strings.TrimSuffix(path, ".tmp")
+		if strings.HasSuffix(final, ".json") && !strings.HasSuffix(final, ".upload.json") {
+			if base := strings.TrimSuffix(final, ".json"); s.completeMetadata(path, base) {
+				report.Completed = append(report.Completed, filepath.Base(base))
+				continue
+			}
+		}
+		moveAside(path)
+	}
+
+	// Finish interrupted deletions, which are recorded before any file is
+	// removed, so that deleted jobs are not regenerated and uploaded again
+	sources, err := manifestFiles(s.basePath)
+	if err != nil {
+		return report, fmt.Errorf("scanning manifests: %w", err)
+	}
+	for _, day := range days {
+		src, ok := sources[day.date.Format("2006-01-02")]
+		if !ok {
+			continue
+		}
+		deleted, err := deletedJobs(src.manifest)
+		if err != nil {
+			s.logger.Warn("failed to read manifest",
+				"path", src.manifest,
+				"error", err)
+			continue
+		}
+		for _, jobID := range deleted {
+			base := filepath.Join(day.path, jobID)
+			if files, _ := filepath.Glob(base + ".*"); len(files) == 0 {
+				continue
+			}
+			if err := s.removeJobFiles(base); err != nil {
+				s.logger.Warn("failed to finish job deletion",
+					"job_id", jobID,
+					"error", err)
+				continue
+			}
+			s.index.Remove(jobID)
+			report.Removed = append(report.Removed, jobID)
+		}
+	}
+
+	// Rebuild metadata for payloads without it
+	for _, day := range days {
+		for _, base := range orphanedPayloads(day.path) {
+			// Attachments and upload status of the lost metadata are
+			// meaningless without it
+			files, _ := filepath.Glob(base + ".*")
+			for _, path := range files {
+				if path != base+".bin" {
+					moveAside(path)
+				}
+			}
+
+			if err := s.regenerate(base, day.date, deviceID, siteID); err != nil {
+				s.logger.Warn("failed to regenerate job metadata",
+					"job_id", filepath.Base(base),
+					"error", err)
+				moveAside(base + ".bin")
+				continue
+			}
+			report.Regenerated = append(report.Regenerated, filepath.Base(base))
+		}
+	}
+
+	return report, nil
+}
+
+// completeMetadata renames a metadata temporary file into place if it
+// parses and its payload matches. The job is then recorded in the manifest
+// and index, which happens after the rename in Save.
+func (s *Store) completeMetadata(tmpPath, base string) bool {
+	data, err := os.ReadFile(tmpPath)
+	if err != nil {
+		return false
+	}
+	meta, err := parseMetadata(data, s.keys)
+	if err != nil || meta.JobID != filepath.Base(base) {
+		return false
+	}
+	payloadData, err := LoadPayload(base, &meta, s.keys)
+	if err != nil || fileHash(payloadData) != meta.SHA256 {
+		return false
+	}
+	if err := os.Rename(tmpPath, base+".json"); err != nil {
+		return false
+	}
+	if err := syncDir(filepath.Dir(base)); err != nil {
+		s.logger.Warn("failed to sync job directory",
+			"path", filepath.Dir(base),
+			"error", err)
+	}
+
+	stored, _ := os.ReadFile(base + ".bin")
+	files := map[string]string{
+		filepath.Base(base) + ".bin":  fileHash(stored),
+		filepath.Base(base) + ".json": fileHash(data),
+	}
+	for _, file := range meta.AttachmentFiles() {
+		if att, err := os.ReadFile(filepath.Join(filepath.Dir(base), file)); err == nil {
+			files[file] = fileHash(att)
+		}
+	}
+	if err := s.appendManifest(filepath.Dir(base), ManifestEntry{
+		Op:     ManifestSave,
+		JobID:  meta.JobID,
+		SHA256: meta.SHA256,
+		Files:  files,
+	}); err != nil {
+		s.logger.Warn("failed to record job in manifest",
+			"job_id", meta.JobID,
+			"error", err)
+	}
+	if err := s.index.Add(&meta, base); err != nil {
+		s.logger.Warn("failed to index job",
+			"job_id", meta.JobID,
+			"error", err)
+	}
+	return true
+}
+
+// regenerate saves fresh metadata for an orphaned payload. The payload is
+// decrypted and decompressed if needed and saved again with the current
+// settings.
+func (s *Store) regenerate(base string, day time.Time, deviceID, siteID string) error {
+	stored, err := os.ReadFile(base + ".bin")
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(base + ".bin")
+	if err != nil {
+		return err
+	}
+
+	jobID := filepath.Base(base)
+	data, err := s.decodeOrphan(jobID, stored)
+	if err != nil {
+		return err
+	}
+
+	// The capture time is lost; the payload's modification time is close,
+	// but the job has to stay in its day directory
+	ts := info.ModTime().UTC()
+	if ts.Before(day) || !ts.Before(day.AddDate(0, 0, 1)) {
+		ts = day
+	}
+
+	j := &Job{
+		Metadata: Metadata{
+			JobID:          jobID,
+			DeviceID:       deviceID,
+			SiteID:         siteID,
+			CaptureStartTS: ts,
+			CaptureEndTS:   ts,
+			ContentType:    payload.Classify(data),
+			Tags:           []string{"recovered"},
+		},
+		Data: data,
+	}
+	j.Close()
+	j.Metadata.CaptureEndTS = ts
+
+	return s.Save(j)
+}
+
+// decodeOrphan turns a stored payload without metadata back into the raw
+// payload, decrypting it with the configured keys and detecting the
+// compression. With encryption configured, a payload that no key decrypts
+// is an error: it may be encrypted with a removed key or corrupt, and must
+// not be saved as a raw payload.
+func (s *Store) decodeOrphan(jobID string, data []byte) ([]byte, error) {
+	if s.keys != nil {
+		plain, ok := s.keys.openAny(data, sealAAD(jobID, "bin"))
+		if !ok {
+			return nil, errors.New("payload cannot be decrypted with any configured key")
+		}
+		data = plain
+	}
+
+	codec := CodecNone
+	switch {
+	case bytes.HasPrefix(data, []byte{0x1f, 0x8b}):
+		codec = CodecGzip
+	case bytes.HasPrefix(data, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		codec = CodecZstd
+	}
+	if codec == CodecNone {
+		return data, nil
+	}
+
+	decoded, err := decodeUnbounded(codec, data)
+	if err != nil {
+		return nil, fmt.Errorf("decoding %s payload: %w", codec, err)
+	}
+	return decoded, nil
+}
+
+// quarantineFile moves a file below dir, keeping its path relative to the
+// base path. Returns that relative path.
+func (s *Store) quarantineFile(dir, path string) (string, error) {
+	rel, err := filepath.Rel(s.basePath, path)
+	if err != nil {
+		return "", err
+	}
+	dest := filepath.Join(dir, rel)
+	if err := os.MkdirAll(filepath.Dir(dest), 0750); err != nil {
+		return "", err
+	}
+	if err := os.Rename(path, dest); err != nil {
+		return "", err
+	}
+	return rel, nil
+}
+
+// deletedJobs returns the jobs whose last entry in the manifest at path is
+// a deletion.
+func deletedJobs(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	last := make(map[string]string)
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		var e ManifestEntry
+		if len(line) == 0 || json.Unmarshal(line, &e) != nil {
+			continue
+		}
+		last[e.JobID] = e.Op
+	}
+
+	var deleted []string
+	for jobID, op := range last {
+		if op == ManifestDelete {
+			deleted = append(deleted, jobID)
+		}
+	}
+	sort.Strings(deleted)
+	return deleted, nil
+}
+
+// orphanedPayloads returns the jobs in dir with a payload but no metadata.
+func orphanedPayloads(dir string) []string {
+	bins, err := filepath.Glob(filepath.Join(dir, "*.bin"))
+	if err != nil {
+		return nil
+	}
+
+	var orphans []string
+	for _, bin := range bins {
+		base := strings.TrimSuffix(bin, ".bin")
+		if _, err := os.Stat(base + ".json"); os.IsNotExist(err) {
+			orphans = append(orphans, base)
+		}
+	}
+	return orphans
+}
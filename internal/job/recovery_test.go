@@ -0,0 +1,188 @@
+package job
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestRecover(t *testing.T) {
+	tests := []struct {
+		name string
+		// damage simulates a crash on the jobs saved by saveTestJobs and
+		// returns the report expected from Recover.
+		damage func(t *testing.T, base string, ids []string) RecoveryReport
+	}{
+		{
+			name: "metadata not renamed",
+			damage: func(t *testing.T, base string, ids []string) RecoveryReport {
+				path := jobTestPath(t, base, ids[0])
+				if err := os.Rename(path+".json", path+".json.tmp"); err != nil {
+					t.Fatal(err)
+				}
+				return RecoveryReport{Completed: []string{ids[0]}}
+			},
+		},
+		{
+			name: "metadata lost",
+			damage: func(t *testing.T, base string, ids []string) RecoveryReport {
+				path := jobTestPath(t, base, ids[1])
+				meta, err := ReadMetadata(path+".json", nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := os.Remove(path + ".json"); err != nil {
+					t.Fatal(err)
+				}
+				// The attachment belongs to the lost metadata
+				want := RecoveryReport{Regenerated: []string{ids[1]}}
+				for _, name := range meta.AttachmentFiles() {
+					rel, _ := filepath.Rel(base, filepath.Join(filepath.Dir(path), name))
+					want.Quarantined = append(want.Quarantined, rel)
+				}
+				if len(want.Quarantined) == 0 {
+					t.Fatal("test job has no attachment")
+				}
+				return want
+			},
+		},
+		{
+			name: "leftover temporary files",
+			damage: func(t *testing.T, base string, ids []string) RecoveryReport {
+				var want RecoveryReport
+				for _, name := range []string{ids[2] + ".bin.tmp", ids[0] + ".json.tmp"} {
+					path := filepath.Join(filepath.Dir(jobTestPath(t, base, strings.SplitN(name, ".", 2)[0])), name)
+					if err := os.WriteFile(path, []byte("{\"job_id\": \"partial"), 0640); err != nil {
+						t.Fatal(err)
+					}
+					rel, _ := filepath.Rel(base, path)
+					want.Quarantined = append(want.Quarantined, rel)
+				}
+				return want
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keys := newTestKeyring(t)
+			base := t.TempDir()
+			ids := saveTestJobs(newTestStore(t, base, keys))
+			if len(ids) != 3 {
+				t.Fatalf("saved %d jobs, want 3", len(ids))
+			}
+			want := tt.damage(t, base, ids)
+
+			report, err := newTestStore(t, base, keys).Recover("kptap-001", "site-1")
+			if err != nil {
+				t.Fatalf("Recover: %v", err)
+			}
+			sameStrings(t, "completed", report.Completed, want.Completed)
+			sameStrings(t, "regenerated", report.Regenerated, want.Regenerated)
+			sameStrings(t, "quarantined", report.Quarantined, want.Quarantined)
+			for _, rel := range want.Quarantined {
+				if _, err := os.Stat(filepath.Join(base, rel)); !os.IsNotExist(err) {
+					t.Errorf("%s left in the job tree", rel)
+				}
+			}
+
+			check, err := CheckStore(base, keys, nil)
+			if err != nil {
+				t.Fatalf("CheckStore: %v", err)
+			}
+			if !check.OK() {
+				t.Errorf("problems after recovery: %+v", check.Problems)
+			}
+
+			for _, id := range report.Regenerated {
+				meta, err := ReadMetadata(jobTestPath(t, base, id)+".json", keys)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !slices.Contains(meta.Tags, "recovered") {
+					t.Errorf("regenerated job %s not tagged recovered: %v", id, meta.Tags)
+				}
+			}
+		})
+	}
+}
+
+func TestRecoverUndecryptableOrphan(t *testing.T) {
+	base := t.TempDir()
+	ids := saveTestJobs(newTestStore(t, base, newTestKeyring(t)))
+	path := jobTestPath(t, base, ids[0])
+	if err := os.Remove(path + ".json"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The key the payload was encrypted with is gone
+	report, err := newTestStore(t, base, newTestKeyring(t)).Recover("kptap-001", "site-1")
+	if err != nil {
+		t.Fatalf("Recover: %v", err)
+	}
+	if len(report.Regenerated) != 0 {
+		t.Errorf("regenerated %v from a payload that cannot be decrypted", report.Regenerated)
+	}
+	rel, _ := filepath.Rel(base, path+".bin")
+	sameStrings(t, "quarantined", report.Quarantined, []string{rel})
+	if _, err := os.Stat(path + ".json"); !os.IsNotExist(err) {
+		t.Error("metadata written for a payload that cannot be decrypted")
+	}
+}
+
+func TestRecoverLeavesOtherTempFiles(t *testing.T) {
+	base := t.TempDir()
+	store := newTestStore(t, base, nil)
+	if ids := saveTestJobs(store); len(ids) != 3 {
+		t.Fatalf("saved %d jobs, want 3", len(ids))
+	}
+
+	// Files that are not job files, written by the signer, the index and
+	// a spool below the base path
+	others := []string{"device.key.tmp", "index.db.tmp", filepath.Join("spool", "job.tmp")}
+	for _, name := range others {
+		path := filepath.Join(base, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte("x"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	report, err := store.Recover("kptap-001", "site-1")
+	if err != nil {
+		t.Fatalf("Recover: %v", err)
+	}
+	sameStrings(t, "quarantined", report.Quarantined, nil)
+	for _, name := range others {
+		if _, err := os.Stat(filepath.Join(base, name)); err != nil {
+			t.Errorf("%s was touched: %v", name, err)
+		}
+	}
+}
+
+// jobTestPath returns the path of a job below basePath without extension.
+func jobTestPath(t *testing.T, basePath, jobID string) string {
+	t.Helper()
+	for _, pattern := range []string{jobID + ".bin", jobID + ".json"} {
+		matches, _ := filepath.Glob(filepath.Join(basePath, "*", "*", "*", pattern))
+		if len(matches) > 0 {
+			return strings.TrimSuffix(matches[0], filepath.Ext(matches[0]))
+		}
+	}
+	t.Fatalf("job %s not found", jobID)
+	return ""
+}
+
+func sameStrings(t *testing.T, what string, got, want []string) {
+	t.Helper()
+	got, want = slices.Clone(got), slices.Clone(want)
+	slices.Sort(got)
+	slices.Sort(want)
+	if !slices.Equal(got, want) {
+		t.Errorf("%s = %v, want %v", what, got, want)
+	}
+}
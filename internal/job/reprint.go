@@ -1,95 +1,308 @@
 package job
 
 import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
 	"sync"
 	"time"
+	"unicode"
 )
 
+// Reprint match kinds.
+const (
+	MatchExact      = "exact"
+	MatchNormalized = "normalized"
+)
+
+// DefaultReprintMaxEntries bounds the detector when no limit is configured.
+const DefaultReprintMaxEntries = 10000
+
+// Clock provides the current time. Tests replace it to control time.
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+// ReprintOptions configures a ReprintDetector.
+type ReprintOptions struct {
+	// Window is how long a job can be matched by later jobs.
+	Window time.Duration
+	// Masks are the volatile-field patterns used for normalized
+	// fingerprints.
+	Masks []string
+	// MaxEntries bounds the number of remembered jobs. When full, the
+	// least recently used job is evicted. Zero means
+	// DefaultReprintMaxEntries.
+	MaxEntries int
+	// Clock defaults to the system clock.
+	Clock Clock
+}
+
 // ReprintDetector tracks recent job hashes to detect reprints.
 type ReprintDetector struct {
-	mu       sync.Mutex
-	window   time.Duration
-	hashes   map[string][]hashEntry
-	cleanTTL time.Duration
+	mu         sync.Mutex
+	window     time.Duration
+	maxEntries int
+	clock      Clock
+	masks      []*regexp.Regexp
+
+	// lru orders entries from most (front) to least recently used
+	lru        *list.List
+	hashes     map[string][]*list.Element
+	normalized map[string][]*list.Element
+
+	done      chan struct{}
+	closeOnce sync.Once
 }
 
 type hashEntry struct {
-	jobID     string
-	printerIP string
-	timestamp time.Time
+	hash           string
+	normalizedHash string
+	jobID          string
+	printerIP      string
+	timestamp      time.Time
 }
 
-// NewReprintDetector creates a new reprint detector with the given window.
-func NewReprintDetector(windowSeconds int) *ReprintDetector {
+// NewReprintDetector creates a new reprint detector. Expired entries are
+// removed by a background goroutine until Close is called.
+func NewReprintDetector(opts ReprintOptions) (*ReprintDetector, error) {
 	rd := &ReprintDetector{
-		window:   time.Duration(windowSeconds) * time.Second,
-		hashes:   make(map[string][]hashEntry),
-		cleanTTL: time.Duration(windowSeconds*2) * time.Second,
+		window:     opts.Window,
+		maxEntries: opts.MaxEntries,
+		clock:      opts.Clock,
+		lru:        list.New(),
+		hashes:     make(map[string][]*list.Element),
+		normalized: make(map[string][]*list.Element),
+		done:       make(chan struct{}),
+	}
+	if rd.maxEntries <= 0 {
+		rd.maxEntries = DefaultReprintMaxEntries
+	}
+	if rd.clock == nil {
+		rd.clock = systemClock{}
+	}
+	for _, expr := range opts.Masks {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("compiling reprint mask %q: %w", expr, err)
+		}
+		rd.masks = append(rd.masks, re)
+	}
+
+	if rd.window > 0 {
+		go rd.cleanupLoop()
 	}
-	go rd.cleanupLoop()
-	return rd
+	return rd, nil
+}
+
+// Close stops the background cleanup. It is safe to call more than once.
+func (rd *ReprintDetector) Close() {
+	rd.closeOnce.Do(func() {
+		close(rd.done)
+	})
 }
 
-// Check looks for a previous job with the same hash and printer IP.
-// Returns the job ID of the original if this is a reprint, empty string otherwise.
-func (rd *ReprintDetector) Check(hash, printerIP string) string {
+// Len returns the number of remembered jobs.
+func (rd *ReprintDetector) Len() int {
 	rd.mu.Lock()
 	defer rd.mu.Unlock()
+	return rd.lru.Len()
+}
 
-	entries, ok := rd.hashes[hash]
-	if !ok {
+// Fingerprint returns the normalized fingerprint of rendered ticket text:
+// the SHA256 of the text with volatile fields masked and whitespace
+// collapsed. Returns an empty string if nothing printable remains.
+func (rd *ReprintDetector) Fingerprint(text string) string {
+	for _, re := range rd.masks {
+		text = re.ReplaceAllString(text, "#")
+	}
+
+	var lines []string
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.Join(strings.Fields(line), " ")
+		if hasContent(line) {
+			lines = append(lines, line)
+		}
+	}
+	if len(lines) == 0 {
 		return ""
 	}
 
-	now := time.Now()
-	for _, e := range entries {
-		if e.printerIP == printerIP && now.Sub(e.timestamp) <= rd.window {
-			return e.jobID
+	hash := sha256.Sum256([]byte(strings.Join(lines, "\n")))
+	return hex.EncodeToString(hash[:])
+}
+
+// hasContent reports whether a line has letters or digits left, so that
+// lines holding only masked fields and decoration are ignored.
+func hasContent(line string) bool {
+	return strings.IndexFunc(line, func(r rune) bool {
+		return unicode.IsLetter(r) || unicode.IsDigit(r)
+	}) >= 0
+}
+
+// Match describes an earlier job with the same content as a new one.
+type Match struct {
+	JobID     string
+	PrinterIP string
+	// Kind is MatchExact or MatchNormalized.
+	Kind string
+}
+
+// Check looks for a previous job within the window with the same hash, or
+// failing that the same normalized fingerprint. Jobs on the same printer
+// are preferred; a match on another printer indicates a job re-routed to
+// a different station. The matched job becomes the most recently used.
+func (rd *ReprintDetector) Check(hash, normalizedHash, printerIP string) (Match, bool) {
+	rd.mu.Lock()
+	defer rd.mu.Unlock()
+
+	now := rd.clock.Now()
+	for _, samePrinter := range []bool{true, false} {
+		if el := rd.find(rd.hashes[hash], printerIP, samePrinter, now); el != nil {
+			rd.lru.MoveToFront(el)
+			e := el.Value.(*hashEntry)
+			return Match{JobID: e.jobID, PrinterIP: e.printerIP, Kind: MatchExact}, true
+		}
+		if normalizedHash == "" {
+			continue
+		}
+		if el := rd.find(rd.normalized[normalizedHash], printerIP, samePrinter, now); el != nil {
+			rd.lru.MoveToFront(el)
+			e := el.Value.(*hashEntry)
+			return Match{JobID: e.jobID, PrinterIP: e.printerIP, Kind: MatchNormalized}, true
+		}
+	}
+
+	return Match{}, false
+}
+
+func (rd *ReprintDetector) find(elements []*list.Element, printerIP string, samePrinter bool, now time.Time) *list.Element {
+	for _, el := range elements {
+		e := el.Value.(*hashEntry)
+		if (e.printerIP == printerIP) == samePrinter && rd.inWindow(e, now) {
+			return el
 		}
 	}
+	return nil
+}
+
+func (rd *ReprintDetector) inWindow(e *hashEntry, now time.Time) bool {
+	return now.Sub(e.timestamp) <= rd.window
+}
+
+// Record stores a job hash and normalized fingerprint for reprint detection.
+func (rd *ReprintDetector) Record(hash, normalizedHash, printerIP, jobID string) {
+	rd.mu.Lock()
+	defer rd.mu.Unlock()
 
-	return ""
+	rd.add(&hashEntry{
+		hash:           hash,
+		normalizedHash: normalizedHash,
+		jobID:          jobID,
+		printerIP:      printerIP,
+		timestamp:      rd.clock.Now(),
+	})
 }
 
-// Record stores a job hash for reprint detection.
-func (rd *ReprintDetector) Record(hash, printerIP, jobID string) {
+// Restore rebuilds the detector state from the metadata of recently saved
+// jobs, so reprint detection survives a restart. Jobs older than the
+// window are ignored. Returns the number of jobs restored.
+func (rd *ReprintDetector) Restore(jobs []Metadata) int {
 	rd.mu.Lock()
 	defer rd.mu.Unlock()
 
-	entry := hashEntry{
-		jobID:     jobID,
-		printerIP: printerIP,
-		timestamp: time.Now(),
+	now := rd.clock.Now()
+	restored := 0
+	for _, m := range jobs {
+		if m.SHA256 == "" || slices.Contains(m.Tags, "poll") {
+			continue
+		}
+
+		e := &hashEntry{
+			hash:           m.SHA256,
+			normalizedHash: m.NormalizedSHA256,
+			jobID:          m.JobID,
+			printerIP:      m.PrinterIP,
+			timestamp:      m.CaptureEndTS,
+		}
+		if !rd.inWindow(e, now) {
+			continue
+		}
+		rd.add(e)
+		restored++
+	}
+
+	return restored
+}
+
+// add inserts an entry as most recently used, evicting the least recently
+// used entries beyond the bound. Must be called with mu held.
+func (rd *ReprintDetector) add(e *hashEntry) {
+	el := rd.lru.PushFront(e)
+	rd.hashes[e.hash] = append(rd.hashes[e.hash], el)
+	if e.normalizedHash != "" {
+		rd.normalized[e.normalizedHash] = append(rd.normalized[e.normalizedHash], el)
 	}
 
-	rd.hashes[hash] = append(rd.hashes[hash], entry)
+	for rd.lru.Len() > rd.maxEntries {
+		rd.remove(rd.lru.Back())
+	}
+}
+
+// remove deletes an entry from the list and both indexes. Must be called
+// with mu held.
+func (rd *ReprintDetector) remove(el *list.Element) {
+	e := rd.lru.Remove(el).(*hashEntry)
+	unindex(rd.hashes, e.hash, el)
+	if e.normalizedHash != "" {
+		unindex(rd.normalized, e.normalizedHash, el)
+	}
+}
+
+func unindex(index map[string][]*list.Element, key string, el *list.Element) {
+	elements := slices.DeleteFunc(index[key], func(x *list.Element) bool {
+		return x == el
+	})
+	if len(elements) == 0 {
+		delete(index, key)
+	} else {
+		index[key] = elements
+	}
 }
 
 func (rd *ReprintDetector) cleanupLoop() {
-	ticker := time.NewTicker(rd.cleanTTL)
+	ticker := time.NewTicker(rd.window)
 	defer ticker.Stop()
 
-	for range ticker.C {
-		rd.cleanup()
+	for {
+		select {
+		case <-rd.done:
+			return
+		case <-ticker.C:
+			rd.cleanup()
+		}
 	}
 }
 
+// cleanup removes entries that have left the window.
 func (rd *ReprintDetector) cleanup() {
 	rd.mu.Lock()
 	defer rd.mu.Unlock()
 
-	now := time.Now()
-	for hash, entries := range rd.hashes {
-		var valid []hashEntry
-		for _, e := range entries {
-			if now.Sub(e.timestamp) <= rd.cleanTTL {
-				valid = append(valid, e)
-			}
-		}
-		if len(valid) == 0 {
-			delete(rd.hashes, hash)
-		} else {
-			rd.hashes[hash] = valid
+	now := rd.clock.Now()
+	for el := rd.lru.Front(); el != nil; {
+		next := el.Next()
+		if now.Sub(el.Value.(*hashEntry).timestamp) > rd.window {
+			rd.remove(el)
 		}
+		el = next
 	}
 }
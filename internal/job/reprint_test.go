@@ -0,0 +1,228 @@
+package job
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time { return c.now }
+
+func (c *fakeClock) Advance(d time.Duration) { c.now = c.now.Add(d) }
+
+func newTestDetector(t *testing.T, window time.Duration, maxEntries int) (*ReprintDetector, *fakeClock) {
+	t.Helper()
+	clock := &fakeClock{now: time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)}
+	rd, err := NewReprintDetector(ReprintOptions{
+		Window:     window,
+		MaxEntries: maxEntries,
+		Clock:      clock,
+	})
+	if err != nil {
+		t.Fatalf("NewReprintDetector: %v", err)
+	}
+	t.Cleanup(rd.Close)
+	return rd, clock
+}
+
+func TestReprintDetectorWindow(t *testing.T) {
+	const window = 300 * time.Second
+
+	tests := []struct {
+		name      string
+		elapsed   time.Duration
+		printerIP string
+		hash      string
+		norm      string
+		wantMatch bool
+		wantKind  string
+		wantIP    string
+	}{
+		{"immediately", 0, "10.0.0.1", "h1", "n1", true, MatchExact, "10.0.0.1"},
+		{"inside window", window - time.Second, "10.0.0.1", "h1", "n1", true, MatchExact, "10.0.0.1"},
+		{"at window edge", window, "10.0.0.1", "h1", "n1", true, MatchExact, "10.0.0.1"},
+		{"just past window", window + time.Nanosecond, "10.0.0.1", "h1", "n1", false, "", ""},
+		{"normalized only", time.Minute, "10.0.0.1", "h2", "n1", true, MatchNormalized, "10.0.0.1"},
+		{"normalized past window", window + time.Second, "10.0.0.1", "h2", "n1", false, "", ""},
+		{"no normalized hash", time.Minute, "10.0.0.1", "h2", "", false, "", ""},
+		{"other printer", time.Minute, "10.0.0.2", "h1", "n1", true, MatchExact, "10.0.0.1"},
+		{"other printer past window", window + time.Second, "10.0.0.2", "h1", "n1", false, "", ""},
+		{"different content", time.Minute, "10.0.0.1", "h3", "n3", false, "", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rd, clock := newTestDetector(t, window, 0)
+			rd.Record("h1", "n1", "10.0.0.1", "job-1")
+			clock.Advance(tt.elapsed)
+
+			m, ok := rd.Check(tt.hash, tt.norm, tt.printerIP)
+			if ok != tt.wantMatch {
+				t.Fatalf("Check() matched = %v, want %v", ok, tt.wantMatch)
+			}
+			if !ok {
+				return
+			}
+			if m.JobID != "job-1" || m.Kind != tt.wantKind || m.PrinterIP != tt.wantIP {
+				t.Errorf("Check() = %+v, want job-1/%s/%s", m, tt.wantKind, tt.wantIP)
+			}
+		})
+	}
+}
+
+func TestReprintDetectorPrefersSamePrinter(t *testing.T) {
+	rd, clock := newTestDetector(t, time.Minute, 0)
+	rd.Record("h1", "n1", "10.0.0.2", "job-other")
+	clock.Advance(time.Second)
+	rd.Record("h2", "n1", "10.0.0.1", "job-same")
+
+	m, ok := rd.Check("h1", "n1", "10.0.0.1")
+	if !ok {
+		t.Fatal("Check() found no match")
+	}
+	if m.JobID != "job-same" || m.Kind != MatchNormalized {
+		t.Errorf("Check() = %+v, want normalized match on job-same", m)
+	}
+}
+
+func TestReprintDetectorEviction(t *testing.T) {
+	tests := []struct {
+		name       string
+		maxEntries int
+		records    int
+		touch      string
+		wantLen    int
+		wantGone   []string
+		wantKept   []string
+	}{
+		{"under bound", 3, 2, "", 2, nil, []string{"h0", "h1"}},
+		{"at bound", 3, 3, "", 3, nil, []string{"h0", "h1", "h2"}},
+		{"evicts oldest", 3, 5, "", 3, []string{"h0", "h1"}, []string{"h2", "h3", "h4"}},
+		{"match refreshes entry", 3, 4, "h1", 3, []string{"h0", "h2"}, []string{"h1", "h3", "h4"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rd, clock := newTestDetector(t, time.Hour, tt.maxEntries)
+			for i := 0; i < tt.records; i++ {
+				rd.Record(fmt.Sprintf("h%d", i), "", "10.0.0.1", fmt.Sprintf("job-%d", i))
+				clock.Advance(time.Second)
+				if tt.touch != "" && i == tt.maxEntries-1 {
+					if _, ok := rd.Check(tt.touch, "", "10.0.0.1"); !ok {
+						t.Fatalf("Check(%s) found no match", tt.touch)
+					}
+				}
+			}
+			if tt.touch != "" {
+				rd.Record("h4", "", "10.0.0.1", "job-4")
+			}
+
+			if got := rd.Len(); got != tt.wantLen {
+				t.Errorf("Len() = %d, want %d", got, tt.wantLen)
+			}
+			for _, h := range tt.wantGone {
+				if _, ok := rd.Check(h, "", "10.0.0.1"); ok {
+					t.Errorf("Check(%s) matched an evicted entry", h)
+				}
+			}
+			for _, h := range tt.wantKept {
+				if _, ok := rd.Check(h, "", "10.0.0.1"); !ok {
+					t.Errorf("Check(%s) found no match", h)
+				}
+			}
+		})
+	}
+}
+
+func TestReprintDetectorCleanup(t *testing.T) {
+	rd, clock := newTestDetector(t, time.Minute, 0)
+	rd.Record("h1", "n1", "10.0.0.1", "job-1")
+	clock.Advance(30 * time.Second)
+	rd.Record("h2", "n2", "10.0.0.1", "job-2")
+
+	clock.Advance(31 * time.Second)
+	rd.cleanup()
+
+	if got := rd.Len(); got != 1 {
+		t.Fatalf("Len() after cleanup = %d, want 1", got)
+	}
+	if len(rd.hashes) != 1 || len(rd.normalized) != 1 {
+		t.Errorf("indexes not cleaned: %d hashes, %d normalized", len(rd.hashes), len(rd.normalized))
+	}
+	if _, ok := rd.Check("h2", "", "10.0.0.1"); !ok {
+		t.Error("Check(h2) found no match")
+	}
+}
+
+func TestReprintDetectorRestore(t *testing.T) {
+	rd, clock := newTestDetector(t, 5*time.Minute, 0)
+	now := clock.Now()
+
+	restored := rd.Restore([]Metadata{
+		{JobID: "old", SHA256: "h-old", PrinterIP: "10.0.0.1", CaptureEndTS: now.Add(-6 * time.Minute)},
+		{JobID: "recent", SHA256: "h-recent", NormalizedSHA256: "n-recent", PrinterIP: "10.0.0.1", CaptureEndTS: now.Add(-time.Minute)},
+		{JobID: "poll", SHA256: "h-poll", PrinterIP: "10.0.0.1", CaptureEndTS: now, Tags: []string{"poll"}},
+	})
+	if restored != 1 {
+		t.Fatalf("Restore() = %d, want 1", restored)
+	}
+
+	if m, ok := rd.Check("h-other", "n-recent", "10.0.0.1"); !ok || m.JobID != "recent" {
+		t.Errorf("Check() = %+v, %v, want match on recent", m, ok)
+	}
+	if _, ok := rd.Check("h-old", "", "10.0.0.1"); ok {
+		t.Error("Check(h-old) matched a job outside the window")
+	}
+}
+
+func TestReprintDetectorFingerprint(t *testing.T) {
+	rd, err := NewReprintDetector(ReprintOptions{
+		Window: time.Minute,
+		Masks: []string{
+			`\b\d{1,2}:\d{2}(:\d{2})?\b`,
+			`(?i)\b(kopie|reprint)\b`,
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewReprintDetector: %v", err)
+	}
+	defer rd.Close()
+
+	original := rd.Fingerprint("Tisch 12\n19:42\n2 x Schnitzel\n")
+
+	tests := []struct {
+		name string
+		text string
+		same bool
+	}{
+		{"identical", "Tisch 12\n19:42\n2 x Schnitzel\n", true},
+		{"different time", "Tisch 12\n19:45:10\n2 x Schnitzel\n", true},
+		{"reprint banner", "*** KOPIE ***\nTisch 12\n19:45\n2 x Schnitzel\n", true},
+		{"whitespace", "Tisch  12\n\n19:42\n2 x   Schnitzel", true},
+		{"different table", "Tisch 13\n19:42\n2 x Schnitzel\n", false},
+		{"different quantity", "Tisch 12\n19:42\n3 x Schnitzel\n", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := rd.Fingerprint(tt.text)
+			if (got == original) != tt.same {
+				t.Errorf("Fingerprint(%q) same = %v, want %v", tt.text, got == original, tt.same)
+			}
+		})
+	}
+
+	if got := rd.Fingerprint("19:42\n\n"); got != "" {
+		t.Errorf("Fingerprint of masked-only text = %q, want empty", got)
+	}
+}
+
+func TestReprintDetectorCloseTwice(t *testing.T) {
+	rd, _ := newTestDetector(t, time.Minute, 0)
+	rd.Close()
+	rd.Close()
+}
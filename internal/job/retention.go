@@ -0,0 +1,297 @@
+package job
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RetentionWorker periodically deletes jobs in day directories older than
+// the retention period. Jobs are deleted through the store, so that
+// retention and quota eviction never delete the same job twice.
+type RetentionWorker struct {
+	store            *Store
+	retentionDays    int
+	deleteUnuploaded bool
+	interval         time.Duration
+	logger           *slog.Logger
+	done             chan struct{}
+	wg               sync.WaitGroup
+}
+
+// RetentionResult summarizes a retention run.
+type RetentionResult struct {
+	JobsRemoved int
+	JobsKept    int
+	DaysRemoved int
+}
+
+// NewRetentionWorker creates a retention worker. Jobs that have not been
+// uploaded are kept unless deleteUnuploaded is set.
+func NewRetentionWorker(store *Store, retentionDays int, deleteUnuploaded bool, logger *slog.Logger) *RetentionWorker {
+	return &RetentionWorker{
+		store:            store,
+		retentionDays:    retentionDays,
+		deleteUnuploaded: deleteUnuploaded,
+		interval:         time.Hour,
+		logger:           logger,
+		done:             make(chan struct{}),
+	}
+}
+
+// Start runs retention immediately and then once per interval.
+func (w *RetentionWorker) Start() {
+	if w.retentionDays <= 0 {
+		w.logger.Info("job retention disabled")
+		return
+	}
+
+	w.wg.Add(1)
+	go w.loop()
+
+	w.logger.Info("job retention started",
+		"retention_days", w.retentionDays,
+		"delete_unuploaded", w.deleteUnuploaded)
+}
+
+// Stop halts the retention worker.
+func (w *RetentionWorker) Stop() {
+	close(w.done)
+	w.wg.Wait()
+}
+
+func (w *RetentionWorker) loop() {
+	defer w.wg.Done()
+
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	for {
+		w.runAndLog()
+
+		select {
+		case <-w.done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (w *RetentionWorker) runAndLog() {
+	result, err := w.Run(time.Now())
+	if err != nil {
+		w.logger.Error("job retention failed",
+			"error", err)
+		return
+	}
+	if result.JobsRemoved > 0 || result.JobsKept > 0 {
+		w.logger.Info("job retention completed",
+			"jobs_removed", result.JobsRemoved,
+			"jobs_kept", result.JobsKept,
+			"days_removed", result.DaysRemoved)
+	}
+}
+
+// Run deletes expired jobs once. Day directories strictly before the
+// cutoff day (now minus the retention period, in UTC) are expired.
+func (w *RetentionWorker) Run(now time.Time) (RetentionResult, error) {
+	var result RetentionResult
+
+	cutoff := now.UTC().Truncate(24*time.Hour).AddDate(0, 0, -w.retentionDays)
+
+	days, err := dayDirs(w.store.basePath)
+	if err != nil {
+		return result, err
+	}
+
+	for _, day := range days {
+		if !day.date.Before(cutoff) {
+			break
+		}
+
+		select {
+		case <-w.done:
+			return result, nil
+		default:
+		}
+
+		removed, kept, err := w.expireDay(day.path)
+		if err != nil {
+			w.logger.Warn("failed to expire day directory",
+				"path", day.path,
+				"error", err)
+			continue
+		}
+		result.JobsRemoved += removed
+		result.JobsKept += kept
+
+		if removed > 0 || kept > 0 {
+			w.logger.Info("expired jobs removed",
+				"day", day.date.Format("2006-01-02"),
+				"jobs_removed", removed,
+				"jobs_kept", kept)
+		}
+		if kept == 0 && w.store.removeDay(day.path) {
+			result.DaysRemoved++
+		}
+	}
+
+	return result, nil
+}
+
+// expireDay deletes the jobs in a day directory, keeping jobs that still
+// need uploading unless deleteUnuploaded is set.
+func (w *RetentionWorker) expireDay(dir string) (removed, kept int, err error) {
+	jobIDs, err := jobIDsInDir(dir)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	for _, jobID := range jobIDs {
+		base := filepath.Join(dir, jobID)
+		if !w.deleteUnuploaded && !uploadDone(base) {
+			kept++
+			continue
+		}
+		deleted, err := w.store.deleteExpired(base)
+		if err != nil {
+			w.logger.Warn("failed to remove expired job",
+				"job_id", jobID,
+				"error", err)
+			kept++
+			continue
+		}
+		if deleted {
+			removed++
+		}
+	}
+
+	return removed, kept, nil
+}
+
+// deleteExpired deletes the job at base for retention. Reports false if
+// the job was already deleted, e.g. by quota eviction.
+func (s *Store) deleteExpired(base string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := os.Stat(base + ".json"); os.IsNotExist(err) {
+		return false, nil
+	}
+	if _, err := s.deleteJob(base, "retention"); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// removeDay removes an expired day directory once it has no jobs left,
+// and its month and year directories once they are empty. Reports whether
+// the day directory is gone.
+func (s *Store) removeDay(dir string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := os.Stat(dir); err == nil && !s.removeDayIfEmpty(dir) {
+		return false
+	}
+	removeIfEmpty(s.fs, filepath.Dir(dir))
+	removeIfEmpty(s.fs, filepath.Dir(filepath.Dir(dir)))
+	return true
+}
+
+// dayDir is a YYYY/MM/DD job directory.
+type dayDir struct {
+	date time.Time
+	path string
+}
+
+// dayDirs returns the day directories below basePath, oldest first.
+func dayDirs(basePath string) ([]dayDir, error) {
+	matches, err := filepath.Glob(filepath.Join(basePath, "[0-9][0-9][0-9][0-9]", "[0-9][0-9]", "[0-9][0-9]"))
+	if err != nil {
+		return nil, err
+	}
+
+	var days []dayDir
+	for _, path := range matches {
+		rel, err := filepath.Rel(basePath, path)
+		if err != nil {
+			continue
+		}
+		date, err := time.Parse("2006/01/02", filepath.ToSlash(rel))
+		if err != nil {
+			continue
+		}
+		days = append(days, dayDir{date: date, path: path})
+	}
+
+	sort.Slice(days, func(i, j int) bool {
+		return days[i].date.Before(days[j].date)
+	})
+
+	return days, nil
+}
+
+// jobIDsInDir returns the IDs of the jobs with metadata in dir.
+func jobIDsInDir(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []string
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasSuffix(name, ".json") || strings.HasSuffix(name, ".upload.json") {
+			continue
+		}
+		ids = append(ids, strings.TrimSuffix(name, ".json"))
+	}
+	return ids, nil
+}
+
+// uploadDone reports whether the job at base has been uploaded or was
+// skipped by the upload filter.
+func uploadDone(base string) bool {
+	return loadUploadStatus(base, "").Done()
+}
+
+// removeJobFiles deletes all files of the job at base: metadata, payload,
+// upload status and attachments. Metadata goes first and its removal is
+// synced, so that an interrupted removal never leaves metadata without its
+// payload. The deletion must already be recorded in the manifest, so that
+// Recover finishes it instead of regenerating the orphaned payload.
+func (s *Store) removeJobFiles(base string) error {
+	jsonPath := base + ".json"
+	if err := s.fs.Remove(jsonPath); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("removing metadata: %w", err)
+	}
+	if err := s.fs.SyncDir(filepath.Dir(base)); err != nil {
+		return fmt.Errorf("syncing job directory: %w", err)
+	}
+
+	files, err := filepath.Glob(base + ".*")
+	if err != nil {
+		return err
+	}
+	for _, path := range files {
+		if err := s.fs.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeIfEmpty removes dir if it has no entries left.
+func removeIfEmpty(fsys fileSystem, dir string) bool {
+	entries, err := os.ReadDir(dir)
+	if err != nil || len(entries) > 0 {
+		return false
+	}
+	return fsys.Remove(dir) == nil
+}
@@ -0,0 +1,1130 @@
+package job
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/marcenggist/kitchen-printer-tap/internal/config"
+)
+
+// SegmentDir is the directory below the base path that holds the files of
+// the segments backend.
+const SegmentDir = "segments"
+
+// A segment is a sequence of records, each a header followed by a body:
+//
+//	magic   [4]byte  "KPTR"
+//	kind    uint8
+//	length  uint32   body length, big endian
+//	crc     uint32   CRC-32C of kind and body, big endian
+//
+// A job record body holds the job's files exactly as the files backend
+// stores them, as a uint16 count followed by that many
+// (uint16 name length, name, uint32 data length, data) entries. An upload
+// record body is the JSON upload status, a delete record body the job ID.
+const (
+	recordMagic     = "KPTR"
+	recordHeaderLen = 13
+	// maxRecordLen rejects corrupt lengths before allocating.
+	maxRecordLen = 256 * 1024 * 1024
+)
+
+// Record kinds.
+const (
+	recordJob    = 1
+	recordUpload = 2
+	recordDelete = 3
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// segmentRecord describes a record of a segment. The index file written
+// when a segment is sealed lists its records, so that opening the store
+// does not have to read sealed segments.
+type segmentRecord struct {
+	Kind   uint8  `json:"kind"`
+	JobID  string `json:"job_id"`
+	Offset int64  `json:"offset"`
+	Length int64  `json:"length"`
+	// Start is the capture start of a job record.
+	Start time.Time `json:"start,omitempty"`
+	// Upload is the status of an upload record.
+	Upload *UploadStatus `json:"upload,omitempty"`
+}
+
+// segmentIndex is the on-disk index of a sealed segment.
+type segmentIndex struct {
+	Size    int64           `json:"size"`
+	Records []segmentRecord `json:"records"`
+}
+
+type segment struct {
+	num     int
+	size    int64
+	records []segmentRecord
+}
+
+// segmentJob locates a live job.
+type segmentJob struct {
+	segment int
+	offset  int64
+	length  int64
+	start   time.Time
+	upload  UploadStatus
+}
+
+// SegmentStore is the segments backend: jobs are appended to rotating
+// segment files instead of being written as separate files, which saves
+// inodes and eMMC wear. Each record carries a CRC; a torn record at the end
+// of the active segment is truncated when the store is opened. Retention
+// and the storage quota remove whole sealed segments, oldest first.
+type SegmentStore struct {
+	jobEncoder
+	dir              string
+	segmentSize      int64
+	minFreeMB        int
+	maxStorageBytes  int64
+	retention        time.Duration
+	deleteUnuploaded bool
+	evictUnuploaded  bool
+	readOnly         bool
+	// writer is the lock file a writable store holds until Close.
+	writer   *os.File
+	segments []*segment
+	active   *os.File
+	jobs     map[string]*segmentJob
+	logger   *slog.Logger
+	mu       sync.Mutex
+}
+
+var _ JobStore = (*SegmentStore)(nil)
+
+// ErrStoreLocked is returned when another process has the segment store
+// open for writing.
+var ErrStoreLocked = errors.New("segment store is open for writing by another process (is tapd running?)")
+
+// writerLockFile is the file below the segment directory that a writable
+// store locks until it is closed.
+const writerLockFile = "writer.lock"
+
+// OpenSegmentStore opens or creates the segment store below cfg.BasePath,
+// recovering from an unclean shutdown. Expired jobs that have not been
+// uploaded are kept unless deleteUnuploaded is set. Only one process can
+// open the store for writing; OpenSegmentStore fails with ErrStoreLocked
+// while another has it open.
+func OpenSegmentStore(cfg *config.StorageConfig, deleteUnuploaded bool, keys *Keyring, signer *Signer, logger *slog.Logger) (*SegmentStore, error) {
+	return openSegmentStore(cfg, deleteUnuploaded, keys, signer, logger, false)
+}
+
+// OpenSegmentStoreReadOnly opens an existing segment store for reading. It
+// never truncates, prunes or writes any file, and can be opened while tapd
+// writes to the store: it sees the sealed segments and the records of the
+// active segment that were complete when it was opened.
+func OpenSegmentStoreReadOnly(cfg *config.StorageConfig, keys *Keyring, logger *slog.Logger) (*SegmentStore, error) {
+	return openSegmentStore(cfg, false, keys, nil, logger, true)
+}
+
+func openSegmentStore(cfg *config.StorageConfig, deleteUnuploaded bool, keys *Keyring, signer *Signer, logger *slog.Logger, readOnly bool) (*SegmentStore, error) {
+	s := &SegmentStore{
+		jobEncoder:       newJobEncoder(cfg, keys, signer),
+		dir:              filepath.Join(cfg.BasePath, SegmentDir),
+		segmentSize:      int64(cfg.SegmentSizeMB) * 1024 * 1024,
+		minFreeMB:        cfg.MinFreeMB,
+		maxStorageBytes:  int64(cfg.MaxStorageMB) * 1024 * 1024,
+		retention:        time.Duration(cfg.RetentionDays) * 24 * time.Hour,
+		deleteUnuploaded: deleteUnuploaded,
+		evictUnuploaded:  cfg.QuotaEvictUnuploaded,
+		readOnly:         readOnly,
+		jobs:             make(map[string]*segmentJob),
+		logger:           logger,
+	}
+	if !readOnly {
+		if err := os.MkdirAll(s.dir, 0750); err != nil {
+			return nil, fmt.Errorf("creating segment directory: %w", err)
+		}
+		if err := s.lockWriter(); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := s.loadLocked(); err != nil {
+		if s.writer != nil {
+			s.writer.Close()
+		}
+		return nil, err
+	}
+
+	logger.Info("segment store opened",
+		"path", s.dir,
+		"segments", len(s.segments),
+		"jobs", len(s.jobs),
+		"read_only", readOnly)
+	return s, nil
+}
+
+// lockWriter locks the writer lock file, so that only one process appends
+// to the store.
+func (s *SegmentStore) lockWriter() error {
+	f, err := os.OpenFile(filepath.Join(s.dir, writerLockFile), os.O_RDWR|os.O_CREATE, 0640)
+	if err != nil {
+		return fmt.Errorf("opening segment lock file: %w", err)
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return ErrStoreLocked
+		}
+		return fmt.Errorf("locking segment store: %w", err)
+	}
+	s.writer = f
+	return nil
+}
+
+// loadLocked loads the store holding a lock on the segment directory: an
+// exclusive one while a writable store recovers, which may truncate the
+// active segment and write indexes, and a shared one while a read-only
+// store reads them. Appending and pruning later need no lock: readers
+// only look at complete records, and a reader that finds a pruned segment
+// gone fails to read its jobs.
+func (s *SegmentStore) loadLocked() error {
+	f, err := os.Open(s.dir)
+	if err != nil {
+		return fmt.Errorf("opening segment directory: %w", err)
+	}
+	defer f.Close()
+	how := syscall.LOCK_EX
+	if s.readOnly {
+		how = syscall.LOCK_SH
+	}
+	if err := syscall.Flock(int(f.Fd()), how); err != nil {
+		return fmt.Errorf("locking segment directory: %w", err)
+	}
+	// Closing the directory releases the lock
+	return s.load()
+}
+
+// load reads the segments and opens the active one.
+func (s *SegmentStore) load() error {
+	nums, err := s.segmentNumbers()
+	if err != nil {
+		return err
+	}
+	for i, num := range nums {
+		seg, err := s.loadSegment(num, i == len(nums)-1)
+		if err != nil {
+			return err
+		}
+		s.segments = append(s.segments, seg)
+		for _, r := range seg.records {
+			s.apply(seg.num, r)
+		}
+	}
+	if s.readOnly {
+		return nil
+	}
+
+	if len(s.segments) == 0 {
+		err = s.createSegment(1)
+	} else {
+		last := s.segments[len(s.segments)-1]
+		s.active, err = os.OpenFile(s.segmentPath(last.num), os.O_WRONLY|os.O_APPEND, 0640)
+	}
+	if err != nil {
+		return fmt.Errorf("opening active segment: %w", err)
+	}
+
+	s.prune()
+	return nil
+}
+
+// Close closes the active segment and releases the lock on the store.
+func (s *SegmentStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var err error
+	if s.active != nil {
+		err = s.active.Close()
+	}
+	// Closing the lock file releases the lock
+	if s.writer != nil {
+		if cerr := s.writer.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+func (s *SegmentStore) segmentPath(num int) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%08d.seg", num))
+}
+
+func (s *SegmentStore) indexPath(num int) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%08d.idx", num))
+}
+
+// segmentNumbers returns the numbers of the segment files, in order.
+func (s *SegmentStore) segmentNumbers() ([]int, error) {
+	paths, err := filepath.Glob(filepath.Join(s.dir, "*.seg"))
+	if err != nil {
+		return nil, err
+	}
+	var nums []int
+	for _, path := range paths {
+		num, err := strconv.Atoi(strings.TrimSuffix(filepath.Base(path), ".seg"))
+		if err != nil {
+			continue
+		}
+		nums = append(nums, num)
+	}
+	sort.Ints(nums)
+	return nums, nil
+}
+
+// loadSegment reads the records of a segment from its index file or, if it
+// has none or is the active segment, by scanning it. Damage that runs to
+// the end of the active segment is a record torn by a crash and is
+// truncated. Damage followed by intact records is skipped and logged, and
+// the file is kept as it is.
+func (s *SegmentStore) loadSegment(num int, active bool) (*segment, error) {
+	path := s.segmentPath(num)
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if !active {
+		if data, err := os.ReadFile(s.indexPath(num)); err == nil {
+			var idx segmentIndex
+			if json.Unmarshal(data, &idx) == nil && idx.Size == info.Size() {
+				return &segment{num: num, size: idx.Size, records: idx.Records}, nil
+			}
+		}
+	}
+
+	scan, err := s.scanSegment(path, info.Size())
+	if err != nil {
+		return nil, fmt.Errorf("reading segment %s: %w", path, err)
+	}
+	seg := &segment{num: num, size: scan.end, records: scan.records}
+
+	for _, d := range scan.damaged {
+		s.logger.Error("skipped damaged records in segment",
+			"path", path,
+			"offset", d.offset,
+			"bytes", d.length,
+			"error", d.err)
+	}
+
+	switch {
+	case scan.tailErr == nil:
+	case active && !s.readOnly:
+		if err := truncateSegment(path, scan.end); err != nil {
+			return nil, fmt.Errorf("truncating segment %s: %w", path, err)
+		}
+		s.logger.Warn("truncated torn record at end of segment",
+			"path", path,
+			"offset", scan.end,
+			"bytes", info.Size()-scan.end,
+			"error", scan.tailErr)
+	case active:
+		// Most likely a record tapd is writing right now
+		s.logger.Debug("ignoring incomplete record at end of active segment",
+			"path", path,
+			"offset", scan.end,
+			"bytes", info.Size()-scan.end,
+			"error", scan.tailErr)
+	default:
+		// Keep the file for inspection and the index describing the
+		// intact part
+		s.logger.Error("damaged records at end of sealed segment",
+			"path", path,
+			"offset", scan.end,
+			"bytes", info.Size()-scan.end,
+			"error", scan.tailErr)
+		seg.size = info.Size()
+	}
+
+	if !active && !s.readOnly {
+		if err := s.writeIndex(seg); err != nil {
+			s.logger.Warn("failed to write segment index",
+				"path", s.indexPath(num),
+				"error", err)
+		}
+	}
+	return seg, nil
+}
+
+// segmentScan is the result of reading a segment file.
+type segmentScan struct {
+	records []segmentRecord
+	// end is the offset after the last intact record.
+	end int64
+	// damaged lists the damaged ranges that intact records follow.
+	damaged []damagedRange
+	// tailErr describes the damage from end to the end of the file, if
+	// any.
+	tailErr error
+}
+
+type damagedRange struct {
+	offset int64
+	length int64
+	err    error
+}
+
+// scanSegment reads the records of a segment file of the given size. When
+// it hits a damaged record it resynchronizes on the next intact record.
+func (s *SegmentStore) scanSegment(path string, size int64) (*segmentScan, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scan := &segmentScan{}
+	var offset int64
+	for offset < size {
+		rec, err := s.readRecordAt(f, offset, size)
+		if err == nil {
+			scan.records = append(scan.records, *rec)
+			offset += rec.Length
+			scan.end = offset
+			continue
+		}
+
+		next, ok, rerr := s.resync(f, offset+1, size)
+		if rerr != nil {
+			return nil, rerr
+		}
+		if !ok {
+			scan.tailErr = fmt.Errorf("offset %d: %w", offset, err)
+			break
+		}
+		scan.damaged = append(scan.damaged, damagedRange{offset: offset, length: next - offset, err: err})
+		offset = next
+	}
+	return scan, nil
+}
+
+// readRecordAt reads and describes the record at offset.
+func (s *SegmentStore) readRecordAt(f *os.File, offset, size int64) (*segmentRecord, error) {
+	// Check the length against the file before readRecord allocates it
+	var header [recordHeaderLen]byte
+	if _, err := f.ReadAt(header[:], offset); err != nil {
+		return nil, fmt.Errorf("reading record header: %w", err)
+	}
+	if length := binary.BigEndian.Uint32(header[5:9]); int64(length) > size-offset-recordHeaderLen {
+		return nil, fmt.Errorf("record length %d runs past end of segment", length)
+	}
+
+	kind, body, err := readRecord(io.NewSectionReader(f, offset, size-offset))
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return nil, err
+	}
+	rec := &segmentRecord{Kind: kind, Offset: offset, Length: int64(recordHeaderLen + len(body))}
+	if err := s.describeRecord(rec, body); err != nil {
+		return nil, err
+	}
+	return rec, nil
+}
+
+// resync returns the offset of the first intact record at or after from,
+// and false if there is none.
+func (s *SegmentStore) resync(f *os.File, from, size int64) (int64, bool, error) {
+	buf := make([]byte, 64*1024)
+	magic := []byte(recordMagic)
+	for from < size {
+		n, err := f.ReadAt(buf, from)
+		if err != nil && err != io.EOF {
+			return 0, false, err
+		}
+		chunk := buf[:n]
+		for i := 0; ; i++ {
+			k := bytes.Index(chunk[i:], magic)
+			if k < 0 {
+				break
+			}
+			i += k
+			if _, err := s.readRecordAt(f, from+int64(i), size); err == nil {
+				return from + int64(i), true, nil
+			}
+		}
+		if int64(n) < int64(len(buf)) {
+			break
+		}
+		// Overlap the chunks so that a magic across their border is found
+		from += int64(n - len(magic) + 1)
+	}
+	return 0, false, nil
+}
+
+// describeRecord fills in the job ID and status of a record from its body.
+func (s *SegmentStore) describeRecord(rec *segmentRecord, body []byte) error {
+	switch rec.Kind {
+	case recordJob:
+		files, err := decodeJobRecord(body)
+		if err != nil {
+			return err
+		}
+		for name, data := range files {
+			if strings.HasSuffix(name, ".json") {
+				rec.JobID = strings.TrimSuffix(name, ".json")
+				// Without the key the capture time is unknown; such jobs
+				// cannot be read either
+				if meta, err := parseMetadata(data, s.keys); err == nil {
+					rec.Start = meta.CaptureStartTS
+				}
+			}
+		}
+		if rec.JobID == "" {
+			return errors.New("job record without metadata")
+		}
+	case recordUpload:
+		var status UploadStatus
+		if err := json.Unmarshal(body, &status); err != nil {
+			return err
+		}
+		rec.JobID = status.JobID
+		rec.Upload = &status
+	case recordDelete:
+		rec.JobID = string(body)
+	default:
+		return fmt.Errorf("unknown record kind %d", rec.Kind)
+	}
+	return nil
+}
+
+// readRecord reads and verifies the next record. It returns io.EOF at a
+// clean end of the segment.
+func readRecord(r io.Reader) (uint8, []byte, error) {
+	var header [recordHeaderLen]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		if err == io.EOF {
+			return 0, nil, io.EOF
+		}
+		return 0, nil, fmt.Errorf("reading record header: %w", err)
+	}
+	if string(header[:4]) != recordMagic {
+		return 0, nil, errors.New("bad record magic")
+	}
+	kind := header[4]
+	length := binary.BigEndian.Uint32(header[5:9])
+	if length > maxRecordLen {
+		return 0, nil, fmt.Errorf("record length %d too large", length)
+	}
+
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, nil, fmt.Errorf("reading record body: %w", err)
+	}
+	if recordCRC(kind, body) != binary.BigEndian.Uint32(header[9:13]) {
+		return 0, nil, errors.New("record checksum mismatch")
+	}
+	return kind, body, nil
+}
+
+func recordCRC(kind uint8, body []byte) uint32 {
+	crc := crc32.Update(0, crcTable, []byte{kind})
+	return crc32.Update(crc, crcTable, body)
+}
+
+// encodeRecord returns a record with its header.
+func encodeRecord(kind uint8, body []byte) []byte {
+	buf := make([]byte, recordHeaderLen, recordHeaderLen+len(body))
+	copy(buf, recordMagic)
+	buf[4] = kind
+	binary.BigEndian.PutUint32(buf[5:9], uint32(len(body)))
+	binary.BigEndian.PutUint32(buf[9:13], recordCRC(kind, body))
+	return append(buf, body...)
+}
+
+// encodeJobRecord returns the body of a job record.
+func encodeJobRecord(jobID string, enc *encodedJob) []byte {
+	files := []Attachment{{Name: jobID + ".bin", Data: enc.payload}}
+	files = append(files, enc.attachments...)
+	files = append(files, Attachment{Name: jobID + ".json", Data: enc.metadata})
+
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, uint16(len(files)))
+	for _, f := range files {
+		binary.Write(&buf, binary.BigEndian, uint16(len(f.Name)))
+		buf.WriteString(f.Name)
+		binary.Write(&buf, binary.BigEndian, uint32(len(f.Data)))
+		buf.Write(f.Data)
+	}
+	return buf.Bytes()
+}
+
+// decodeJobRecord returns the files of a job record by name.
+func decodeJobRecord(body []byte) (map[string][]byte, error) {
+	r := bytes.NewReader(body)
+	var count uint16
+	if err := binary.Read(r, binary.BigEndian, &count); err != nil {
+		return nil, err
+	}
+
+	files := make(map[string][]byte, count)
+	for i := 0; i < int(count); i++ {
+		var nameLen uint16
+		if err := binary.Read(r, binary.BigEndian, &nameLen); err != nil {
+			return nil, err
+		}
+		name := make([]byte, nameLen)
+		if _, err := io.ReadFull(r, name); err != nil {
+			return nil, err
+		}
+		var dataLen uint32
+		if err := binary.Read(r, binary.BigEndian, &dataLen); err != nil {
+			return nil, err
+		}
+		if int64(dataLen) > int64(r.Len()) {
+			return nil, errors.New("file extends past record")
+		}
+		data := make([]byte, dataLen)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+		files[string(name)] = data
+	}
+	return files, nil
+}
+
+// truncateSegment cuts a segment file to size and syncs it.
+func truncateSegment(path string, size int64) error {
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	err = f.Truncate(size)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// writeIndex writes the index file of a sealed segment.
+func (s *SegmentStore) writeIndex(seg *segment) error {
+	data, err := json.Marshal(segmentIndex{Size: seg.size, Records: seg.records})
+	if err != nil {
+		return err
+	}
+	path := s.indexPath(seg.num)
+	return writeFileAtomic(osFS{}, path+".tmp", path, data)
+}
+
+// createSegment creates and activates a new empty segment.
+func (s *SegmentStore) createSegment(num int) error {
+	f, err := os.OpenFile(s.segmentPath(num), os.O_WRONLY|os.O_CREATE|os.O_EXCL|os.O_APPEND, 0640)
+	if err != nil {
+		return err
+	}
+	if err := syncDir(s.dir); err != nil {
+		f.Close()
+		return err
+	}
+	s.active = f
+	s.segments = append(s.segments, &segment{num: num})
+	return nil
+}
+
+// rotate seals the active segment and starts the next one.
+func (s *SegmentStore) rotate() error {
+	sealed := s.segments[len(s.segments)-1]
+	if err := s.active.Close(); err != nil {
+		return fmt.Errorf("closing segment: %w", err)
+	}
+	if err := s.writeIndex(sealed); err != nil {
+		s.logger.Warn("failed to write segment index",
+			"path", s.indexPath(sealed.num),
+			"error", err)
+	}
+	if err := s.createSegment(sealed.num + 1); err != nil {
+		return fmt.Errorf("creating segment: %w", err)
+	}
+	s.logger.Info("segment sealed",
+		"path", s.segmentPath(sealed.num),
+		"records", len(sealed.records),
+		"bytes", sealed.size)
+
+	s.prune()
+	return nil
+}
+
+// append writes a record to the active segment, starting a new segment if
+// it would grow beyond the segment size, and syncs it.
+func (s *SegmentStore) append(kind uint8, body []byte, rec segmentRecord) error {
+	data := encodeRecord(kind, body)
+	seg := s.segments[len(s.segments)-1]
+	if seg.size > 0 && seg.size+int64(len(data)) > s.segmentSize {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+		seg = s.segments[len(s.segments)-1]
+	}
+
+	if _, err := s.active.Write(data); err != nil {
+		// Cut off the partial record so later records stay readable
+		s.active.Truncate(seg.size)
+		return fmt.Errorf("writing segment: %w", err)
+	}
+	if err := s.active.Sync(); err != nil {
+		s.active.Truncate(seg.size)
+		return fmt.Errorf("syncing segment: %w", err)
+	}
+
+	rec.Kind = kind
+	rec.Offset = seg.size
+	rec.Length = int64(len(data))
+	seg.size += rec.Length
+	seg.records = append(seg.records, rec)
+	s.apply(seg.num, rec)
+	return nil
+}
+
+// apply updates the live jobs with a record.
+func (s *SegmentStore) apply(num int, rec segmentRecord) {
+	switch rec.Kind {
+	case recordJob:
+		// A job record for a live job replaces its files but keeps its
+		// upload status
+		upload := UploadStatus{JobID: rec.JobID, Status: UploadPending}
+		if old, ok := s.jobs[rec.JobID]; ok {
+			upload = old.upload
+		}
+		if rec.Start.IsZero() {
+			s.logger.Warn("job without capture start, retention keeps it",
+				"job_id", rec.JobID,
+				"segment", s.segmentPath(num))
+		}
+		s.jobs[rec.JobID] = &segmentJob{
+			segment: num,
+			offset:  rec.Offset,
+			length:  rec.Length,
+			start:   rec.Start,
+			upload:  upload,
+		}
+	case recordUpload:
+		if j, ok := s.jobs[rec.JobID]; ok {
+			j.upload = *rec.Upload
+		}
+	case recordDelete:
+		delete(s.jobs, rec.JobID)
+	}
+}
+
+// prune removes sealed segments, oldest first, while all their jobs have
+// expired or been deleted, or while the store exceeds its quota. Segments
+// holding jobs that were not uploaded are only removed for the quota if
+// evictUnuploaded is set. Low free disk space never removes segments, as
+// the job store may not be what fills the disk. Segments are removed in
+// order so that upload and delete records never outlive the records before
+// them.
+func (s *SegmentStore) prune() {
+	if s.readOnly {
+		return
+	}
+	now := time.Now()
+	for len(s.segments) > 1 {
+		seg := s.segments[0]
+
+		var live []string
+		expired, pending := true, 0
+		for id, j := range s.jobs {
+			if j.segment != seg.num {
+				continue
+			}
+			live = append(live, id)
+			// A job whose capture start could not be read is never
+			// expired; apply logged it
+			if s.retention == 0 || j.start.IsZero() || !j.start.Before(now.Add(-s.retention)) {
+				expired = false
+			}
+			if !j.upload.Done() {
+				pending++
+				if !s.deleteUnuploaded {
+					expired = false
+				}
+			}
+		}
+
+		var reason string
+		switch {
+		case len(live) == 0:
+			reason = "deleted"
+		case expired:
+			reason = "retention"
+		case s.maxStorageBytes > 0 && s.storedBytes() > s.maxStorageBytes &&
+			(pending == 0 || s.evictUnuploaded):
+			reason = "quota"
+		default:
+			return
+		}
+
+		if err := os.Remove(s.segmentPath(seg.num)); err != nil && !os.IsNotExist(err) {
+			s.logger.Error("failed to remove segment",
+				"path", s.segmentPath(seg.num),
+				"error", err)
+			return
+		}
+		os.Remove(s.indexPath(seg.num))
+		syncDir(s.dir)
+		for _, id := range live {
+			delete(s.jobs, id)
+		}
+		s.segments = s.segments[1:]
+
+		if pending > 0 {
+			s.logger.Warn("removed segment with jobs that were not uploaded",
+				"path", s.segmentPath(seg.num),
+				"reason", reason,
+				"jobs", len(live),
+				"not_uploaded", pending)
+		} else {
+			s.logger.Info("removed segment",
+				"path", s.segmentPath(seg.num),
+				"reason", reason,
+				"jobs", len(live))
+		}
+	}
+}
+
+// storedBytes returns the total size of all segments.
+func (s *SegmentStore) storedBytes() int64 {
+	var total int64
+	for _, seg := range s.segments {
+		total += seg.size
+	}
+	return total
+}
+
+// Save appends a job to the active segment.
+func (s *SegmentStore) Save(job *Job) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.readOnly {
+		return errReadOnlyStore
+	}
+	if !job.IsClosed() {
+		return fmt.Errorf("cannot save unclosed job")
+	}
+
+	enc, err := s.encode(job)
+	if err != nil {
+		return err
+	}
+
+	s.prune()
+	if !hasFreeSpace(s.dir, s.minFreeMB) {
+		return fmt.Errorf("insufficient disk space (min %d MB required)", s.minFreeMB)
+	}
+
+	return s.append(recordJob, encodeJobRecord(job.Metadata.JobID, enc), segmentRecord{
+		JobID: job.Metadata.JobID,
+		Start: job.Metadata.CaptureStartTS,
+	})
+}
+
+// readFiles reads the files of a live job from its segment.
+func (s *SegmentStore) readFiles(j *segmentJob) (map[string][]byte, error) {
+	f, err := os.Open(s.segmentPath(j.segment))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	kind, body, err := readRecord(io.NewSectionReader(f, j.offset, j.length))
+	if err != nil {
+		return nil, fmt.Errorf("reading segment %d at offset %d: %w", j.segment, j.offset, err)
+	}
+	if kind != recordJob {
+		return nil, fmt.Errorf("segment %d at offset %d: not a job record", j.segment, j.offset)
+	}
+	return decodeJobRecord(body)
+}
+
+// lookup returns a live job. Must be called with mu held.
+func (s *SegmentStore) lookup(jobID string) (*segmentJob, error) {
+	j, ok := s.jobs[jobID]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrJobNotFound, jobID)
+	}
+	return j, nil
+}
+
+// Get returns a stored job.
+func (s *SegmentStore) Get(jobID string) (*StoredJob, error) {
+	s.mu.Lock()
+	j, err := s.lookup(jobID)
+	var located segmentJob
+	if err == nil {
+		located = *j
+	}
+	s.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := s.readFiles(&located)
+	if err != nil {
+		return nil, err
+	}
+	meta, err := parseMetadata(files[jobID+".json"], s.keys)
+	if err != nil {
+		return nil, err
+	}
+	payload, err := openPayload(files[jobID+".bin"], &meta, s.keys)
+	if err != nil {
+		return nil, fmt.Errorf("reading payload: %w", err)
+	}
+
+	stored := &StoredJob{
+		Metadata: meta,
+		Payload:  payload,
+		Upload:   located.upload,
+	}
+	for _, img := range meta.RasterImages {
+		data, ok := files[img.File]
+		if !ok {
+			continue
+		}
+		data, err := openAttachment(data, img.File, &meta, s.keys)
+		if err != nil {
+			s.logger.Warn("failed to read raster image",
+				"job_id", jobID,
+				"file", img.File,
+				"error", err)
+			continue
+		}
+		stored.Attachments = append(stored.Attachments, Attachment{Name: img.File, Data: data})
+	}
+	return stored, nil
+}
+
+// List returns the metadata of the selected jobs in capture order.
+func (s *SegmentStore) List(opts ListOptions) ([]Metadata, error) {
+	s.mu.Lock()
+	var selected []segmentJob
+	for _, j := range s.jobs {
+		if j.start.Before(opts.Since) || (opts.PendingUpload && j.upload.Done()) {
+			continue
+		}
+		selected = append(selected, *j)
+	}
+	s.mu.Unlock()
+
+	sort.Slice(selected, func(i, k int) bool {
+		return selected[i].start.Before(selected[k].start)
+	})
+
+	jobs := make([]Metadata, 0, len(selected))
+	for i := range selected {
+		files, err := s.readFiles(&selected[i])
+		if err != nil {
+			continue
+		}
+		for name, data := range files {
+			if strings.HasSuffix(name, ".json") {
+				if meta, err := parseMetadata(data, s.keys); err == nil {
+					jobs = append(jobs, meta)
+				}
+			}
+		}
+	}
+	return jobs, nil
+}
+
+// Delete appends a delete record for a job. Its data is removed with its
+// segment.
+func (s *SegmentStore) Delete(jobID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.readOnly {
+		return errReadOnlyStore
+	}
+	if _, err := s.lookup(jobID); err != nil {
+		return err
+	}
+	return s.append(recordDelete, []byte(jobID), segmentRecord{JobID: jobID})
+}
+
+// MarkUploaded appends an upload record for a job.
+func (s *SegmentStore) MarkUploaded(jobID string, status UploadStatus) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.readOnly {
+		return errReadOnlyStore
+	}
+	if _, err := s.lookup(jobID); err != nil {
+		return err
+	}
+	status.JobID = jobID
+	body, err := json.Marshal(status)
+	if err != nil {
+		return fmt.Errorf("marshaling upload status: %w", err)
+	}
+	return s.append(recordUpload, body, segmentRecord{JobID: jobID, Upload: &status})
+}
+
+// AttachPcap appends a job record with the job's files, the packets and
+// the updated metadata. The job's earlier record becomes dead space that
+// is freed with its segment.
+func (s *SegmentStore) AttachPcap(jobID string, pcapData []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.readOnly {
+		return errReadOnlyStore
+	}
+	j, err := s.lookup(jobID)
+	if err != nil {
+		return err
+	}
+	files, err := s.readFiles(j)
+	if err != nil {
+		return err
+	}
+	meta, err := parseMetadata(files[jobID+".json"], s.keys)
+	if err != nil {
+		return err
+	}
+	if meta.PcapFile != "" {
+		return fmt.Errorf("%w: %s", ErrPcapExists, meta.PcapFile)
+	}
+
+	a, metaBytes, err := s.encodePcap(&meta, pcapData)
+	if err != nil {
+		return err
+	}
+	enc := &encodedJob{payload: files[jobID+".bin"], metadata: metaBytes}
+	for _, name := range meta.AttachmentFiles() {
+		if name == a.Name {
+			enc.attachments = append(enc.attachments, a)
+		} else if data, ok := files[name]; ok {
+			enc.attachments = append(enc.attachments, Attachment{Name: name, Data: data})
+		}
+	}
+	return s.append(recordJob, encodeJobRecord(jobID, enc), segmentRecord{
+		JobID: jobID,
+		Start: meta.CaptureStartTS,
+	})
+}
+
+// ExportFiles writes the live jobs to basePath in the files backend layout,
+// byte for byte as the files backend would have stored them, with upload
+// status files and day manifests signed by signer unless it is nil. Jobs
+// already present are skipped. Returns the number of jobs written.
+func (s *SegmentStore) ExportFiles(basePath string, signer *Signer) (int, error) {
+	s.mu.Lock()
+	jobs := make(map[string]segmentJob, len(s.jobs))
+	for id, j := range s.jobs {
+		jobs[id] = *j
+	}
+	s.mu.Unlock()
+
+	ids := make([]string, 0, len(jobs))
+	for id := range jobs {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, k int) bool {
+		return jobs[ids[i]].start.Before(jobs[ids[k]].start)
+	})
+
+	// The exported tree gets its own manifests, written like Store.Save
+	target := &Store{
+		jobEncoder: jobEncoder{signer: signer},
+		basePath:   basePath,
+		fs:         osFS{},
+		logger:     s.logger,
+	}
+
+	exported := 0
+	for _, id := range ids {
+		j := jobs[id]
+		if j.start.IsZero() {
+			s.logger.Warn("skipping job with unreadable metadata",
+				"job_id", id)
+			continue
+		}
+		ts := j.start.UTC()
+		dir := filepath.Join(basePath, ts.Format("2006"), ts.Format("01"), ts.Format("02"))
+		if _, err := os.Stat(filepath.Join(dir, id+".json")); err == nil {
+			continue
+		}
+
+		files, err := s.readFiles(&j)
+		if err != nil {
+			return exported, fmt.Errorf("reading job %s: %w", id, err)
+		}
+		if err := mkdirAllDurable(osFS{}, basePath, dir); err != nil {
+			return exported, fmt.Errorf("creating job directory: %w", err)
+		}
+
+		// Metadata last, as in Store.Save
+		names := make([]string, 0, len(files))
+		for name := range files {
+			if name != id+".json" {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		names = append(names, id+".json")
+
+		hashes := make(map[string]string, len(files))
+		for _, name := range names {
+			path := filepath.Join(dir, name)
+			if err := writeFileAtomic(osFS{}, path+".tmp", path, files[name]); err != nil {
+				return exported, fmt.Errorf("writing %s: %w", path, err)
+			}
+			hashes[name] = fileHash(files[name])
+		}
+
+		if j.upload.Status != UploadPending {
+			data, err := json.MarshalIndent(j.upload, "", "  ")
+			if err != nil {
+				return exported, err
+			}
+			path := filepath.Join(dir, id+".upload.json")
+			if err := writeFileAtomic(osFS{}, path+".tmp", path, data); err != nil {
+				return exported, fmt.Errorf("writing %s: %w", path, err)
+			}
+		}
+
+		var sha string
+		if meta, err := parseMetadata(files[id+".json"], s.keys); err == nil {
+			sha = meta.SHA256
+		}
+		if err := target.appendManifest(dir, ManifestEntry{
+			Op:     ManifestSave,
+			JobID:  id,
+			SHA256: sha,
+			Files:  hashes,
+		}); err != nil {
+			return exported, fmt.Errorf("recording job %s in manifest: %w", id, err)
+		}
+		exported++
+	}
+	return exported, nil
+}
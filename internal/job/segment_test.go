@@ -0,0 +1,494 @@
+package job
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/marcenggist/kitchen-printer-tap/internal/config"
+)
+
+func testSegmentConfig(basePath string) *config.StorageConfig {
+	cfg := config.DefaultConfig().Storage
+	cfg.BasePath = basePath
+	cfg.Backend = "segments"
+	cfg.MinFreeMB = 0
+	cfg.RetentionDays = 0
+	return &cfg
+}
+
+func openTestSegmentStore(t *testing.T, basePath string) *SegmentStore {
+	t.Helper()
+	s, err := OpenSegmentStore(testSegmentConfig(basePath), false, nil, nil, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatalf("OpenSegmentStore: %v", err)
+	}
+	return s
+}
+
+// liveJobs returns the IDs and upload states of the jobs in a store.
+func liveJobs(t *testing.T, s *SegmentStore) map[string]string {
+	t.Helper()
+	jobs, err := s.List(ListOptions{})
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	live := make(map[string]string, len(jobs))
+	for _, meta := range jobs {
+		stored, err := s.Get(meta.JobID)
+		if err != nil {
+			t.Fatalf("Get %s: %v", meta.JobID, err)
+		}
+		if fileHash(stored.Payload) != meta.SHA256 {
+			t.Errorf("job %s: payload does not match sha256", meta.JobID)
+		}
+		live[meta.JobID] = stored.Upload.Status
+	}
+	return live
+}
+
+func sameJobs(t *testing.T, got, want map[string]string) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("jobs = %v, want %v", got, want)
+	}
+	for id, status := range want {
+		if got[id] != status {
+			t.Errorf("job %s: status %q, want %q", id, got[id], status)
+		}
+	}
+}
+
+func activeSegmentPath(t *testing.T, basePath string) string {
+	t.Helper()
+	paths, err := filepath.Glob(filepath.Join(basePath, SegmentDir, "*.seg"))
+	if err != nil || len(paths) == 0 {
+		t.Fatalf("no segments: %v", err)
+	}
+	sort.Strings(paths)
+	return paths[len(paths)-1]
+}
+
+func TestSegmentStoreReplay(t *testing.T) {
+	tests := []struct {
+		name        string
+		segmentSize int64
+		dropIndex   bool
+	}{
+		{"single segment", 64 * 1024 * 1024, false},
+		{"one record per segment", 1, false},
+		{"segments without index", 1, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			s := openTestSegmentStore(t, dir)
+			s.segmentSize = tt.segmentSize
+			ids := mustSaveTestJobs(t, s)
+			if err := s.MarkUploaded(ids[1], UploadStatus{Status: UploadUploaded, UploadedAt: time.Now().UTC()}); err != nil {
+				t.Fatalf("MarkUploaded: %v", err)
+			}
+			if err := s.Delete(ids[2]); err != nil {
+				t.Fatalf("Delete: %v", err)
+			}
+			want := map[string]string{ids[0]: UploadPending, ids[1]: UploadUploaded}
+			sameJobs(t, liveJobs(t, s), want)
+			s.Close()
+
+			if tt.dropIndex {
+				paths, _ := filepath.Glob(filepath.Join(dir, SegmentDir, "*.idx"))
+				if len(paths) == 0 {
+					t.Fatal("no segment index written")
+				}
+				for _, path := range paths {
+					os.Remove(path)
+				}
+			}
+
+			s = openTestSegmentStore(t, dir)
+			defer s.Close()
+			sameJobs(t, liveJobs(t, s), want)
+		})
+	}
+}
+
+func TestSegmentStoreTornTail(t *testing.T) {
+	dir := t.TempDir()
+	s := openTestSegmentStore(t, dir)
+	ids := mustSaveTestJobs(t, s)
+	s.Close()
+
+	path := activeSegmentPath(t, dir)
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{ids[0]: UploadPending, ids[1]: UploadPending, ids[2]: UploadPending}
+
+	// Every prefix of a record cut off by a power cut
+	record := encodeRecord(recordDelete, []byte(ids[0]))
+	for _, n := range []int{1, 4, recordHeaderLen, len(record) - 1} {
+		t.Run(fmt.Sprintf("%d bytes", n), func(t *testing.T) {
+			f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			f.Write(record[:n])
+			f.Close()
+
+			s := openTestSegmentStore(t, dir)
+			defer s.Close()
+			after, err := os.Stat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if after.Size() != info.Size() {
+				t.Errorf("segment size = %d, want %d", after.Size(), info.Size())
+			}
+			sameJobs(t, liveJobs(t, s), want)
+		})
+	}
+
+	// Records appended after the truncation are read back
+	s = openTestSegmentStore(t, dir)
+	for _, id := range mustSaveTestJobs(t, s) {
+		want[id] = UploadPending
+	}
+	s.Close()
+
+	s = openTestSegmentStore(t, dir)
+	defer s.Close()
+	sameJobs(t, liveJobs(t, s), want)
+}
+
+func TestSegmentStoreDamagedRecord(t *testing.T) {
+	dir := t.TempDir()
+	s := openTestSegmentStore(t, dir)
+	ids := mustSaveTestJobs(t, s)
+	second := s.jobs[ids[1]]
+	s.Close()
+
+	// Flip a byte in the body of the second record
+	path := activeSegmentPath(t, dir)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[second.offset+second.length/2] ^= 0xFF
+	if err := os.WriteFile(path, data, 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	s = openTestSegmentStore(t, dir)
+	want := map[string]string{ids[0]: UploadPending, ids[2]: UploadPending}
+	sameJobs(t, liveJobs(t, s), want)
+	for _, id := range mustSaveTestJobs(t, s) {
+		want[id] = UploadPending
+	}
+	s.Close()
+
+	after, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(after) <= len(data) || string(after[:len(data)]) != string(data) {
+		t.Error("damaged segment was rewritten")
+	}
+
+	s = openTestSegmentStore(t, dir)
+	defer s.Close()
+	sameJobs(t, liveJobs(t, s), want)
+}
+
+func TestSegmentStoreLock(t *testing.T) {
+	dir := t.TempDir()
+	cfg := testSegmentConfig(dir)
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	s := openTestSegmentStore(t, dir)
+	ids := mustSaveTestJobs(t, s)
+	want := map[string]string{ids[0]: UploadPending, ids[1]: UploadPending, ids[2]: UploadPending}
+	if _, err := OpenSegmentStore(cfg, false, nil, nil, logger); !errors.Is(err, ErrStoreLocked) {
+		t.Errorf("second OpenSegmentStore: %v, want ErrStoreLocked", err)
+	}
+
+	// Readers see the jobs saved so far while the store is open for
+	// writing
+	ro, err := OpenSegmentStoreReadOnly(cfg, nil, logger)
+	if err != nil {
+		t.Fatalf("OpenSegmentStoreReadOnly while open for writing: %v", err)
+	}
+	sameJobs(t, liveJobs(t, ro), want)
+	if _, err := ro.Get(ids[1]); err != nil {
+		t.Errorf("Get from the active segment: %v", err)
+	}
+	ro.Close()
+	s.Close()
+
+	// A read-only store leaves a torn tail alone
+	path := activeSegmentPath(t, dir)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte(recordMagic))
+	f.Close()
+	before, _ := os.Stat(path)
+
+	ro, err = OpenSegmentStoreReadOnly(cfg, nil, logger)
+	if err != nil {
+		t.Fatalf("OpenSegmentStoreReadOnly: %v", err)
+	}
+	sameJobs(t, liveJobs(t, ro), want)
+	if saved := saveTestJobs(ro); len(saved) != 0 {
+		t.Error("Save on read-only store succeeded")
+	}
+	ro.Close()
+
+	after, _ := os.Stat(path)
+	if after.Size() != before.Size() {
+		t.Errorf("read-only store changed segment size from %d to %d", before.Size(), after.Size())
+	}
+}
+
+func TestSegmentStoreQuotaKeepsUnuploaded(t *testing.T) {
+	dir := t.TempDir()
+	s := openTestSegmentStore(t, dir)
+	defer s.Close()
+	s.segmentSize = 1
+	s.maxStorageBytes = 1
+	ids := mustSaveTestJobs(t, s)
+
+	if got := len(liveJobs(t, s)); got != 3 {
+		t.Fatalf("quota evicted jobs that were not uploaded: %d of 3 left", got)
+	}
+
+	for _, id := range ids[:2] {
+		if err := s.MarkUploaded(id, UploadStatus{Status: UploadUploaded, UploadedAt: time.Now().UTC()}); err != nil {
+			t.Fatalf("MarkUploaded: %v", err)
+		}
+	}
+	mustSaveTestJobs(t, s)
+	live := liveJobs(t, s)
+	if _, ok := live[ids[0]]; ok {
+		t.Error("uploaded job was not evicted")
+	}
+	if _, ok := live[ids[2]]; !ok {
+		t.Error("job that was not uploaded was evicted")
+	}
+}
+
+func TestSegmentStoreRetentionKeepsUndatedJobs(t *testing.T) {
+	tests := []struct {
+		name  string
+		start time.Time
+		kept  bool
+	}{
+		{name: "expired", start: time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC), kept: false},
+		{name: "no capture start", start: time.Time{}, kept: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := openTestSegmentStore(t, t.TempDir())
+			defer s.Close()
+			s.segmentSize = 1
+			s.retention = 24 * time.Hour
+			s.deleteUnuploaded = true
+
+			j := New("kptap-001", "site-1", "10.0.0.5", 9100, "10.0.0.2", "raw")
+			j.Append([]byte("\x1b@TABLE 1\n"))
+			j.Close()
+			j.Metadata.CaptureStartTS = tt.start
+			if err := s.Save(j); err != nil {
+				t.Fatalf("Save: %v", err)
+			}
+			// Seal the job's segment and prune
+			mustSaveTestJobs(t, s)
+
+			if _, err := s.Get(j.Metadata.JobID); (err == nil) != tt.kept {
+				t.Errorf("Get after retention: %v, want kept = %v", err, tt.kept)
+			}
+		})
+	}
+}
+
+func TestAttachPcapBothBackends(t *testing.T) {
+	keys := newTestKeyring(t)
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	tests := []struct {
+		name  string
+		open  func(t *testing.T, basePath string) BundleStore
+		check func(t *testing.T, basePath string, store BundleStore) (*FsckReport, error)
+	}{
+		{
+			name: "files",
+			open: func(t *testing.T, basePath string) BundleStore {
+				return newTestStore(t, basePath, keys)
+			},
+			check: func(t *testing.T, basePath string, store BundleStore) (*FsckReport, error) {
+				manifests, err := VerifyManifests(basePath, nil)
+				if err != nil {
+					t.Fatalf("VerifyManifests: %v", err)
+				}
+				if !manifests.OK() {
+					t.Errorf("manifest problems: %+v", manifests.Problems)
+				}
+				return CheckStore(basePath, keys, nil)
+			},
+		},
+		{
+			name: "segments",
+			open: func(t *testing.T, basePath string) BundleStore {
+				s, err := OpenSegmentStore(testSegmentConfig(basePath), false, keys, nil, logger)
+				if err != nil {
+					t.Fatalf("OpenSegmentStore: %v", err)
+				}
+				t.Cleanup(func() { s.Close() })
+				return s
+			},
+			check: func(t *testing.T, basePath string, store BundleStore) (*FsckReport, error) {
+				return store.(*SegmentStore).Check(nil)
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			base := t.TempDir()
+			store := tt.open(t, base)
+			ids := saveTestJobs(store)
+			if len(ids) != 3 {
+				t.Fatalf("saved %d jobs, want 3", len(ids))
+			}
+			if err := store.MarkUploaded(ids[1], UploadStatus{Status: UploadUploaded}); err != nil {
+				t.Fatalf("MarkUploaded: %v", err)
+			}
+
+			pcapData := []byte("\xd4\xc3\xb2\xa1 packets")
+			if err := store.AttachPcap(ids[1], pcapData); err != nil {
+				t.Fatalf("AttachPcap: %v", err)
+			}
+			if err := store.AttachPcap(ids[1], pcapData); !errors.Is(err, ErrPcapExists) {
+				t.Errorf("second AttachPcap: %v, want ErrPcapExists", err)
+			}
+			if err := store.AttachPcap("unknown", pcapData); !errors.Is(err, ErrJobNotFound) {
+				t.Errorf("AttachPcap of unknown job: %v, want ErrJobNotFound", err)
+			}
+
+			stored, err := store.Get(ids[1])
+			if err != nil {
+				t.Fatalf("Get: %v", err)
+			}
+			if stored.Metadata.PcapFile != ids[1]+".pcap" {
+				t.Errorf("pcap_file = %q", stored.Metadata.PcapFile)
+			}
+			if stored.Upload.Status != UploadUploaded {
+				t.Errorf("upload status %q after AttachPcap, want %q", stored.Upload.Status, UploadUploaded)
+			}
+			if len(stored.Attachments) != 1 {
+				t.Errorf("job has %d raster images after AttachPcap, want 1", len(stored.Attachments))
+			}
+			_, attachments, err := store.Contents(&stored.Metadata)
+			if err != nil {
+				t.Fatalf("Contents: %v", err)
+			}
+			var found bool
+			for _, a := range attachments {
+				if a.Name == stored.Metadata.PcapFile {
+					found = string(a.Data) == string(pcapData)
+				}
+			}
+			if !found {
+				t.Error("saved packets not returned by Contents")
+			}
+
+			report, err := tt.check(t, base, store)
+			if err != nil {
+				t.Fatalf("check: %v", err)
+			}
+			if !report.OK() {
+				t.Errorf("problems after AttachPcap: %+v", report.Problems)
+			}
+		})
+	}
+}
+
+func TestBundleAndCheckBothBackends(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	tests := []struct {
+		name string
+		open func(t *testing.T, basePath string) (BundleStore, func(pub ed25519.PublicKey) (*FsckReport, error))
+	}{
+		{
+			name: "files",
+			open: func(t *testing.T, basePath string) (BundleStore, func(ed25519.PublicKey) (*FsckReport, error)) {
+				saveTestJobs(newTestStore(t, basePath, nil))
+				cfg := testSegmentConfig(basePath)
+				cfg.Backend = "files"
+				store, err := OpenStoreReadOnly(cfg, nil, logger)
+				if err != nil {
+					t.Fatalf("OpenStoreReadOnly: %v", err)
+				}
+				return store, func(pub ed25519.PublicKey) (*FsckReport, error) {
+					return CheckStore(basePath, nil, pub)
+				}
+			},
+		},
+		{
+			name: "segments",
+			open: func(t *testing.T, basePath string) (BundleStore, func(ed25519.PublicKey) (*FsckReport, error)) {
+				s := openTestSegmentStore(t, basePath)
+				saveTestJobs(s)
+				s.Close()
+				store, err := OpenSegmentStoreReadOnly(testSegmentConfig(basePath), nil, logger)
+				if err != nil {
+					t.Fatalf("OpenSegmentStoreReadOnly: %v", err)
+				}
+				t.Cleanup(func() { store.Close() })
+				return store, store.Check
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store, check := tt.open(t, t.TempDir())
+
+			report, err := check(nil)
+			if err != nil {
+				t.Fatalf("check: %v", err)
+			}
+			if report.Jobs != 3 || !report.OK() {
+				t.Errorf("check found %d jobs, problems %+v; want 3 jobs and none", report.Jobs, report.Problems)
+			}
+
+			if err := store.Delete("x"); !errors.Is(err, errReadOnlyStore) {
+				t.Errorf("Delete on read-only store: %v", err)
+			}
+
+			from := time.Date(2026, 10, 17, 21, 31, 0, 0, time.UTC)
+			manifest, err := WriteBundle(io.Discard, store, BundleOptions{From: from, PrinterIP: "10.0.0.5"})
+			if err != nil {
+				t.Fatalf("WriteBundle: %v", err)
+			}
+			if len(manifest.Jobs) != 2 || len(manifest.Skipped) != 0 {
+				t.Fatalf("bundled %d jobs, skipped %+v; want 2 and none", len(manifest.Jobs), manifest.Skipped)
+			}
+			if !manifest.Jobs[0].CaptureStartTS.Before(manifest.Jobs[1].CaptureStartTS) {
+				t.Error("bundle jobs not in capture order")
+			}
+			if got := len(manifest.Jobs[0].Files); got != 3 {
+				t.Errorf("first job has %d files, want payload, metadata and raster image", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,199 @@
+package job
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Signer signs job metadata with the device's Ed25519 key, so that a
+// backend can verify which tap captured a job.
+type Signer struct {
+	key       ed25519.PrivateKey
+	publicKey string
+}
+
+// LoadOrCreateSigner loads the device key from path, generating and saving
+// a new key on first start. The public key is also written to path.pub in
+// PEM format for registering the device with the backend. Reports whether
+// a new key was created.
+func LoadOrCreateSigner(path string) (*Signer, bool, error) {
+	signer, err := LoadSigner(path)
+	if err == nil {
+		return signer, false, nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return nil, false, err
+	}
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, false, fmt.Errorf("generating device key: %w", err)
+	}
+	if err := writeKeyPair(path, key); err != nil {
+		return nil, false, err
+	}
+	return newSigner(key), true, nil
+}
+
+// LoadSigner loads an existing device key.
+func LoadSigner(path string) (*Signer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading device key: %w", err)
+	}
+	key, err := parsePrivateKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("parsing device key %s: %w", path, err)
+	}
+	return newSigner(key), nil
+}
+
+func newSigner(key ed25519.PrivateKey) *Signer {
+	return &Signer{
+		key:       key,
+		publicKey: base64.StdEncoding.EncodeToString(key.Public().(ed25519.PublicKey)),
+	}
+}
+
+func parsePrivateKey(data []byte) (ed25519.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "PRIVATE KEY" {
+		return nil, fmt.Errorf("no PEM private key")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := parsed.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("not an Ed25519 key")
+	}
+	return key, nil
+}
+
+func writeKeyPair(path string, key ed25519.PrivateKey) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+		return fmt.Errorf("creating key directory: %w", err)
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return fmt.Errorf("encoding device key: %w", err)
+	}
+	pubDER, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		return fmt.Errorf("encoding device public key: %w", err)
+	}
+
+	// Write the private key under a temporary name so that a crash never
+	// leaves a truncated key behind
+	tmp := path + ".tmp"
+	privPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	if err := os.WriteFile(tmp, privPEM, 0600); err != nil {
+		return fmt.Errorf("writing device key: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("writing device key: %w", err)
+	}
+
+	pubPEM := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubDER})
+	if err := os.WriteFile(path+".pub", pubPEM, 0644); err != nil {
+		return fmt.Errorf("writing device public key: %w", err)
+	}
+	return nil
+}
+
+// PublicKey returns the base64 encoded Ed25519 public key.
+func (s *Signer) PublicKey() string {
+	return s.publicKey
+}
+
+// Public returns the Ed25519 public key.
+func (s *Signer) Public() ed25519.PublicKey {
+	return s.key.Public().(ed25519.PublicKey)
+}
+
+// Sign sets the signing key and signature of meta. The signature covers
+// the output of SignedMetadata, which includes the payload SHA256.
+func (s *Signer) Sign(meta *Metadata) error {
+	meta.SigningKey = s.publicKey
+	data, err := SignedMetadata(*meta)
+	if err != nil {
+		return err
+	}
+	meta.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(s.key, data))
+	return nil
+}
+
+// SignedMetadata returns the bytes a metadata signature covers: the
+// compact JSON encoding of the metadata without the signature. The
+// uploader sends exactly these bytes, so the backend can check the
+// signature without re-encoding the metadata.
+func SignedMetadata(meta Metadata) ([]byte, error) {
+	meta.Signature = ""
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return nil, fmt.Errorf("marshaling metadata: %w", err)
+	}
+	return data, nil
+}
+
+// VerifySignature checks the signature of meta against the trusted key
+// pub. The signing key recorded in the metadata is not trusted: anyone who
+// edits a job can re-sign it with a key of their own.
+func VerifySignature(meta Metadata, pub ed25519.PublicKey) error {
+	if meta.Signature == "" {
+		return fmt.Errorf("job is not signed")
+	}
+	sig, err := base64.StdEncoding.DecodeString(meta.Signature)
+	if err != nil {
+		return fmt.Errorf("invalid signature encoding")
+	}
+	data, err := SignedMetadata(meta)
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(pub, data, sig) {
+		if meta.SigningKey != base64.StdEncoding.EncodeToString(pub) {
+			return fmt.Errorf("signature does not match the trusted key (signed by %s)", meta.SigningKey)
+		}
+		return fmt.Errorf("signature does not match")
+	}
+	return nil
+}
+
+// ParsePublicKey parses an Ed25519 public key given in base64, as printed
+// by tapctl pubkey, or in PEM format, as in the device key's .pub file.
+func ParsePublicKey(data []byte) (ed25519.PublicKey, error) {
+	if block, _ := pem.Decode(data); block != nil {
+		if block.Type != "PUBLIC KEY" {
+			return nil, fmt.Errorf("no PEM public key")
+		}
+		parsed, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		pub, ok := parsed.(ed25519.PublicKey)
+		if !ok {
+			return nil, fmt.Errorf("not an Ed25519 key")
+		}
+		return pub, nil
+	}
+
+	pub, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(pub) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("not a base64 Ed25519 public key")
+	}
+	return ed25519.PublicKey(pub), nil
+}
@@ -0,0 +1,76 @@
+package job
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVerifySignatureTrustedKey(t *testing.T) {
+	dir := t.TempDir()
+	device, _, err := LoadOrCreateSigner(filepath.Join(dir, "device.key"))
+	if err != nil {
+		t.Fatalf("LoadOrCreateSigner: %v", err)
+	}
+	forger, _, err := LoadOrCreateSigner(filepath.Join(dir, "other.key"))
+	if err != nil {
+		t.Fatalf("LoadOrCreateSigner: %v", err)
+	}
+
+	meta := Metadata{
+		JobID:          "job-1",
+		DeviceID:       "kptap-001",
+		CaptureStartTS: time.Date(2026, 10, 17, 12, 0, 0, 0, time.UTC),
+		SHA256:         strings.Repeat("ab", 32),
+	}
+	if err := device.Sign(&meta); err != nil {
+		t.Fatalf("Sign: %v", err)
+	}
+	if err := VerifySignature(meta, device.Public()); err != nil {
+		t.Fatalf("VerifySignature with the device key: %v", err)
+	}
+
+	// An edited job re-signed with another key carries a valid signature
+	// for its own signing_key, but not for the trusted one
+	meta.SHA256 = strings.Repeat("cd", 32)
+	if err := forger.Sign(&meta); err != nil {
+		t.Fatalf("Sign: %v", err)
+	}
+	if err := VerifySignature(meta, device.Public()); err == nil {
+		t.Fatal("VerifySignature accepted a job re-signed with another key")
+	}
+
+	pub, err := ParsePublicKey([]byte(device.PublicKey()))
+	if err != nil {
+		t.Fatalf("ParsePublicKey: %v", err)
+	}
+	if !pub.Equal(device.Public()) {
+		t.Fatal("ParsePublicKey returned a different key")
+	}
+}
+
+func TestCheckStoreUnsignedJob(t *testing.T) {
+	base := t.TempDir()
+	device, _, err := LoadOrCreateSigner(filepath.Join(t.TempDir(), "device.key"))
+	if err != nil {
+		t.Fatalf("LoadOrCreateSigner: %v", err)
+	}
+	if saved := saveTestJobs(newTestStore(t, base, nil)); len(saved) != 3 {
+		t.Fatalf("saved %d jobs, want 3", len(saved))
+	}
+
+	report, err := CheckStore(base, nil, device.Public())
+	if err != nil {
+		t.Fatalf("CheckStore: %v", err)
+	}
+	var missing int
+	for _, p := range report.Problems {
+		if p.Kind == FsckMissingSignature {
+			missing++
+		}
+	}
+	if missing != 3 {
+		t.Errorf("reported %d unsigned jobs, want 3: %+v", missing, report.Problems)
+	}
+}
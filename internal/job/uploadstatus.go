@@ -0,0 +1,54 @@
+package job
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+)
+
+// Upload states of a job.
+const (
+	UploadPending  = "pending"
+	UploadUploaded = "uploaded"
+	UploadFailed   = "failed"
+	UploadSkipped  = "skipped"
+)
+
+// UploadStatus represents the upload status for a job.
+type UploadStatus struct {
+	JobID       string    `json:"job_id"`
+	Status      string    `json:"status"`
+	Attempts    int       `json:"attempts"`
+	LastAttempt time.Time `json:"last_attempt,omitempty"`
+	LastError   string    `json:"last_error,omitempty"`
+	UploadedAt  time.Time `json:"uploaded_at,omitempty"`
+}
+
+// Done reports whether the job has been uploaded or was skipped by the
+// upload filter, so that it needs no further attempts.
+func (st UploadStatus) Done() bool {
+	return st.Status == UploadUploaded || st.Status == UploadSkipped
+}
+
+// loadUploadStatus reads the upload status file of the job at base. A job
+// without a readable status file is pending.
+func loadUploadStatus(base, jobID string) UploadStatus {
+	data, err := os.ReadFile(base + ".upload.json")
+	if err == nil {
+		var status UploadStatus
+		if json.Unmarshal(data, &status) == nil && status.Status != "" {
+			status.JobID = jobID
+			return status
+		}
+	}
+	return UploadStatus{
+		JobID:  jobID,
+		Status: UploadPending,
+	}
+}
+
+// readUploadStatus returns the upload status of the job at base, or
+// "pending" if it has none.
+func readUploadStatus(base string) string {
+	return loadUploadStatus(base, "").Status
+}
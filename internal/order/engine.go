@@ -0,0 +1,169 @@
+package order
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/marcenggist/kitchen-printer-tap/internal/job"
+)
+
+// Engine applies ticket templates to rendered ticket text.
+type Engine struct {
+	templates []*Template
+}
+
+// NewEngine creates an engine trying templates in the given order.
+func NewEngine(templates []*Template) *Engine {
+	return &Engine{templates: templates}
+}
+
+// Templates returns the number of loaded templates.
+func (e *Engine) Templates() int {
+	return len(e.templates)
+}
+
+// Extract applies the first template that matches the ticket text and
+// returns the extracted order, or nil if no template matches.
+func (e *Engine) Extract(text, printerIP string) *job.Order {
+	for _, t := range e.templates {
+		if t.Matches(text, printerIP) {
+			return t.Extract(text)
+		}
+	}
+	return nil
+}
+
+// Matches reports whether the template applies to the ticket.
+func (t *Template) Matches(text, printerIP string) bool {
+	if len(t.Printers) > 0 {
+		found := false
+		for _, ip := range t.Printers {
+			if ip == printerIP {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	for _, re := range t.Match {
+		if !re.MatchString(text) {
+			return false
+		}
+	}
+	return true
+}
+
+// Extract applies the template to the ticket text.
+func (t *Template) Extract(text string) *job.Order {
+	o := &job.Order{
+		Template:    t.Name,
+		Vendor:      t.Vendor,
+		OrderNumber: firstGroup(t.OrderNumber, text),
+		Table:       firstGroup(t.Table, text),
+		Waiter:      firstGroup(t.Waiter, text),
+	}
+
+	if covers := firstGroup(t.Covers, text); covers != "" {
+		if n, err := strconv.Atoi(covers); err == nil {
+			o.Covers = n
+		}
+	}
+
+	if printed := firstGroup(t.PrintedAt, text); printed != "" {
+		o.PrintedAtRaw = printed
+		for _, layout := range t.PrintedAtLayouts {
+			if ts, err := time.ParseInLocation(layout, printed, time.Local); err == nil {
+				ts = ts.UTC()
+				o.PrintedAt = &ts
+				break
+			}
+		}
+	}
+
+	o.Items = t.extractItems(text)
+
+	if t.Void != nil && t.Void.MatchString(text) {
+		o.Void = true
+		o.CancelsOrderNumber = firstGroup(t.CancelsOrder, text)
+		if o.CancelsOrderNumber == "" {
+			o.CancelsOrderNumber = o.OrderNumber
+		}
+	}
+
+	return o
+}
+
+func (t *Template) extractItems(text string) []job.OrderItem {
+	if t.ItemLine == nil {
+		return nil
+	}
+
+	var items []job.OrderItem
+	inBlock := t.ItemStart == nil
+
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimRight(line, " \t\r")
+		if line == "" {
+			continue
+		}
+
+		if !inBlock {
+			inBlock = t.ItemStart.MatchString(line)
+			continue
+		}
+		if t.ItemEnd != nil && t.ItemEnd.MatchString(line) {
+			break
+		}
+
+		// Modifiers are checked first since they are usually indented item
+		// lines that the item pattern would also accept.
+		if t.ItemModifier != nil && len(items) > 0 {
+			if m := t.ItemModifier.FindStringSubmatch(line); m != nil {
+				last := &items[len(items)-1]
+				last.Modifiers = append(last.Modifiers, strings.TrimSpace(namedGroup(t.ItemModifier, m, "name", m[0])))
+				continue
+			}
+		}
+
+		m := t.ItemLine.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+
+		item := job.OrderItem{
+			Quantity: 1,
+			Name:     strings.TrimSpace(namedGroup(t.ItemLine, m, "name", m[0])),
+		}
+		if qty := namedGroup(t.ItemLine, m, "qty", ""); qty != "" {
+			if n, err := strconv.Atoi(strings.TrimSpace(qty)); err == nil {
+				item.Quantity = n
+			}
+		}
+		items = append(items, item)
+	}
+
+	return items
+}
+
+func firstGroup(re *regexp.Regexp, text string) string {
+	if re == nil {
+		return ""
+	}
+	m := re.FindStringSubmatch(text)
+	if len(m) < 2 {
+		return ""
+	}
+	return strings.TrimSpace(m[1])
+}
+
+func namedGroup(re *regexp.Regexp, m []string, name, fallback string) string {
+	if i := re.SubexpIndex(name); i > 0 && i < len(m) {
+		return m[i]
+	}
+	return fallback
+}
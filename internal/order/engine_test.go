@@ -0,0 +1,181 @@
+package order
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/marcenggist/kitchen-printer-tap/internal/job"
+)
+
+// printedAt returns a printed_at value as Extract stores it: read in the
+// device's time zone and converted to UTC.
+func printedAt(year int, month time.Month, day, hour, min, sec int) *time.Time {
+	ts := time.Date(year, month, day, hour, min, sec, 0, time.Local).UTC()
+	return &ts
+}
+
+func TestEngineExtractShippedTemplates(t *testing.T) {
+	templates, err := LoadTemplates("../../configs/templates")
+	if err != nil {
+		t.Fatalf("LoadTemplates: %v", err)
+	}
+	engine := NewEngine(templates)
+
+	tests := []struct {
+		name string
+		text string
+		want *job.Order
+	}{
+		{
+			name: "vectron",
+			text: "Tisch: 12\n" +
+				"Bon-Nr: 4711\n" +
+				"Pers.: 4\n" +
+				"Bed.: Anna\n" +
+				"17.10.2026 21:30:15\n" +
+				"----------\n" +
+				"2x Schnitzel\n" +
+				"  + Pommes\n" +
+				"  - ohne Salat\n" +
+				"1x Bier\n" +
+				"----------\n" +
+				"Danke\n",
+			want: &job.Order{
+				Template:     "vectron-kitchen",
+				Vendor:       "vectron",
+				OrderNumber:  "4711",
+				Table:        "12",
+				Covers:       4,
+				Waiter:       "Anna",
+				PrintedAt:    printedAt(2026, 10, 17, 21, 30, 15),
+				PrintedAtRaw: "17.10.2026 21:30:15",
+				Items: []job.OrderItem{
+					{Quantity: 2, Name: "Schnitzel", Modifiers: []string{"Pommes", "ohne Salat"}},
+					{Quantity: 1, Name: "Bier"},
+				},
+			},
+		},
+		{
+			name: "vectron two-digit year without seconds",
+			text: "Tresen\n" +
+				"Bon Nr. 12\n" +
+				"17.10.26 21:30\n" +
+				"-----\n" +
+				"3X Espresso\n" +
+				"-----\n",
+			want: &job.Order{
+				Template:     "vectron-kitchen",
+				Vendor:       "vectron",
+				OrderNumber:  "12",
+				PrintedAt:    printedAt(2026, 10, 17, 21, 30, 0),
+				PrintedAtRaw: "17.10.26 21:30",
+				Items:        []job.OrderItem{{Quantity: 3, Name: "Espresso"}},
+			},
+		},
+		{
+			name: "vectron storno",
+			text: "*** STORNO ***\n" +
+				"Tisch: 12\n" +
+				"Bon-Nr: 4712\n" +
+				"17.10.2026 21:45\n" +
+				"----------\n" +
+				"1x Bier\n" +
+				"----------\n",
+			want: &job.Order{
+				Template:           "vectron-kitchen",
+				Vendor:             "vectron",
+				OrderNumber:        "4712",
+				Table:              "12",
+				PrintedAt:          printedAt(2026, 10, 17, 21, 45, 0),
+				PrintedAtRaw:       "17.10.2026 21:45",
+				Items:              []job.OrderItem{{Quantity: 1, Name: "Bier"}},
+				Void:               true,
+				CancelsOrderNumber: "4712",
+			},
+		},
+		{
+			name: "tcpos",
+			text: "Order No. 815\n" +
+				"Table: 7\n" +
+				"Covers: 2\n" +
+				"Waiter: Marco\n" +
+				"18/10/2026 12:05\n" +
+				"3 Rösti\n" +
+				"  > extra Speck\n" +
+				"  > ohne Zwiebeln\n" +
+				"1 Apfelstrudel\n" +
+				"Total\n" +
+				"2 not an item\n",
+			want: &job.Order{
+				Template:     "tcpos-kitchen",
+				Vendor:       "tcpos",
+				OrderNumber:  "815",
+				Table:        "7",
+				Covers:       2,
+				Waiter:       "Marco",
+				PrintedAt:    printedAt(2026, 10, 18, 12, 5, 0),
+				PrintedAtRaw: "18/10/2026 12:05",
+				Items: []job.OrderItem{
+					{Quantity: 3, Name: "Rösti", Modifiers: []string{"extra Speck", "ohne Zwiebeln"}},
+					{Quantity: 1, Name: "Apfelstrudel"},
+				},
+			},
+		},
+		{
+			name: "tcpos german with seconds",
+			text: "Bestellung Nr: 816\n" +
+				"Tisch 3\n" +
+				"Gedecke: 5\n" +
+				"Bediener: Eva\n" +
+				"18.10.2026 12:06:30\n" +
+				"2 Suppe\n" +
+				"===\n",
+			want: &job.Order{
+				Template:     "tcpos-kitchen",
+				Vendor:       "tcpos",
+				OrderNumber:  "816",
+				Table:        "3",
+				Covers:       5,
+				Waiter:       "Eva",
+				PrintedAt:    printedAt(2026, 10, 18, 12, 6, 30),
+				PrintedAtRaw: "18.10.2026 12:06:30",
+				Items:        []job.OrderItem{{Quantity: 2, Name: "Suppe"}},
+			},
+		},
+		{
+			name: "tcpos storno",
+			text: "STORNO\n" +
+				"Order No. 817\n" +
+				"Table: 7\n" +
+				"18/10/2026 12:10:00\n" +
+				"1 Apfelstrudel\n" +
+				"Total\n",
+			want: &job.Order{
+				Template:           "tcpos-kitchen",
+				Vendor:             "tcpos",
+				OrderNumber:        "817",
+				Table:              "7",
+				PrintedAt:          printedAt(2026, 10, 18, 12, 10, 0),
+				PrintedAtRaw:       "18/10/2026 12:10:00",
+				Items:              []job.OrderItem{{Quantity: 1, Name: "Apfelstrudel"}},
+				Void:               true,
+				CancelsOrderNumber: "817",
+			},
+		},
+		{
+			name: "unknown layout",
+			text: "Hello\nworld\n",
+			want: nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := engine.Extract(tt.text, "10.0.0.5")
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Extract =\n%+v\nwant\n%+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,164 @@
+package order
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// TemplateSpec is the YAML form of a ticket layout template.
+type TemplateSpec struct {
+	// Name identifies the template in the extracted order.
+	Name   string `yaml:"name"`
+	Vendor string `yaml:"vendor"`
+	// Priority orders templates; higher priorities are tried first.
+	Priority int `yaml:"priority"`
+	// Printers optionally restricts the template to these printer IPs.
+	Printers []string `yaml:"printers"`
+	// Match lists patterns that must all match the ticket text.
+	Match []string `yaml:"match"`
+
+	// Field patterns. The first capture group is the value.
+	OrderNumber string `yaml:"order_number"`
+	Table       string `yaml:"table"`
+	Covers      string `yaml:"covers"`
+	Waiter      string `yaml:"waiter"`
+	PrintedAt   string `yaml:"printed_at"`
+	// PrintedAtLayouts are Go time layouts tried in order to parse
+	// the printed_at value, interpreted in the device's local time zone.
+	PrintedAtLayouts []string `yaml:"printed_at_layouts"`
+
+	Items ItemsSpec `yaml:"items"`
+
+	// Void matches cancellation tickets (STORNO, VOID, CANCEL).
+	Void string `yaml:"void"`
+	// CancelsOrder captures the cancelled order number on a void ticket.
+	// If unset, the ticket's own order number is used.
+	CancelsOrder string `yaml:"cancels_order"`
+}
+
+// ItemsSpec describes how line items are laid out on the ticket.
+type ItemsSpec struct {
+	// Start and End optionally delimit the item block. The lines matching
+	// Start and End are not part of it.
+	Start string `yaml:"start"`
+	End   string `yaml:"end"`
+	// Line matches an item line; named groups "qty" and "name" are used.
+	Line string `yaml:"line"`
+	// Modifier matches a modifier line belonging to the preceding item;
+	// the named group "name" (or the whole match) is used.
+	Modifier string `yaml:"modifier"`
+}
+
+// Template is a compiled ticket layout template.
+type Template struct {
+	Name             string
+	Vendor           string
+	Priority         int
+	Printers         []string
+	Match            []*regexp.Regexp
+	OrderNumber      *regexp.Regexp
+	Table            *regexp.Regexp
+	Covers           *regexp.Regexp
+	Waiter           *regexp.Regexp
+	PrintedAt        *regexp.Regexp
+	PrintedAtLayouts []string
+	ItemStart        *regexp.Regexp
+	ItemEnd          *regexp.Regexp
+	ItemLine         *regexp.Regexp
+	ItemModifier     *regexp.Regexp
+	Void             *regexp.Regexp
+	CancelsOrder     *regexp.Regexp
+}
+
+// Compile validates the spec and compiles its patterns.
+func (s *TemplateSpec) Compile() (*Template, error) {
+	if s.Name == "" {
+		return nil, fmt.Errorf("template name is required")
+	}
+
+	t := &Template{
+		Name:             s.Name,
+		Vendor:           s.Vendor,
+		Priority:         s.Priority,
+		Printers:         s.Printers,
+		PrintedAtLayouts: s.PrintedAtLayouts,
+	}
+
+	var err error
+	compile := func(field, expr string) *regexp.Regexp {
+		if expr == "" || err != nil {
+			return nil
+		}
+		re, cerr := regexp.Compile(expr)
+		if cerr != nil {
+			err = fmt.Errorf("template %s: %s: %w", s.Name, field, cerr)
+		}
+		return re
+	}
+
+	for i, expr := range s.Match {
+		t.Match = append(t.Match, compile(fmt.Sprintf("match[%d]", i), expr))
+	}
+	t.OrderNumber = compile("order_number", s.OrderNumber)
+	t.Table = compile("table", s.Table)
+	t.Covers = compile("covers", s.Covers)
+	t.Waiter = compile("waiter", s.Waiter)
+	t.PrintedAt = compile("printed_at", s.PrintedAt)
+	t.ItemStart = compile("items.start", s.Items.Start)
+	t.ItemEnd = compile("items.end", s.Items.End)
+	t.ItemLine = compile("items.line", s.Items.Line)
+	t.ItemModifier = compile("items.modifier", s.Items.Modifier)
+	t.Void = compile("void", s.Void)
+	t.CancelsOrder = compile("cancels_order", s.CancelsOrder)
+	if err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+// LoadTemplates reads and compiles all *.yaml and *.yml templates in dir.
+// Templates are returned in priority order, then by file name.
+func LoadTemplates(dir string) ([]*Template, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("reading template directory: %w", err)
+	}
+
+	var templates []*Template
+	for _, e := range entries {
+		ext := strings.ToLower(filepath.Ext(e.Name()))
+		if e.IsDir() || (ext != ".yaml" && ext != ".yml") {
+			continue
+		}
+
+		path := filepath.Join(dir, e.Name())
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("reading template %s: %w", path, err)
+		}
+
+		var spec TemplateSpec
+		if err := yaml.Unmarshal(data, &spec); err != nil {
+			return nil, fmt.Errorf("parsing template %s: %w", path, err)
+		}
+
+		t, err := spec.Compile()
+		if err != nil {
+			return nil, fmt.Errorf("compiling template %s: %w", path, err)
+		}
+		templates = append(templates, t)
+	}
+
+	sort.SliceStable(templates, func(i, j int) bool {
+		return templates[i].Priority > templates[j].Priority
+	})
+
+	return templates, nil
+}
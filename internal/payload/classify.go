@@ -0,0 +1,199 @@
+package payload
+
+import (
+	"bytes"
+	"regexp"
+
+	"github.com/marcenggist/kitchen-printer-tap/internal/escpos"
+)
+
+// Content types reported by Classify.
+const (
+	ESCPOS     = "escpos"
+	StarLine   = "star_line"
+	PCL        = "pcl"
+	PostScript = "postscript"
+	PDF        = "pdf"
+	ZPL        = "zpl"
+	Text       = "text"
+	StatusPoll = "status_poll"
+	Unknown    = "unknown"
+)
+
+// ContentTypes lists all content types, for validating configuration.
+var ContentTypes = []string{ESCPOS, StarLine, PCL, PostScript, PDF, ZPL, Text, StatusPoll, Unknown}
+
+var (
+	pjlHeader = []byte("\x1b%-12345X")
+	// PCL 5 parameterized escape sequence, e.g. ESC & l 1 O or ESC * r 0 F
+	pclCommand = regexp.MustCompile(`\x1b[&*(%)][a-z` + "`" + `]-?[0-9.]*[A-Za-z@]`)
+	zplCommand = regexp.MustCompile(`\^(FO|FD|FS|A0|BC|BQ|CF|PW|LH|LL|PQ)`)
+)
+
+// Classify identifies the printer language of a job payload.
+func Classify(data []byte) string {
+	body := data
+
+	// Skip a PJL job header; the language follows it
+	if bytes.HasPrefix(body, pjlHeader) {
+		if lang := pjlLanguage(body); lang != "" {
+			return lang
+		}
+		body = skipPJL(body)
+	}
+	// Skip Ctrl-D job separators some drivers send before PostScript
+	body = bytes.TrimLeft(body, "\x04\r\n\t ")
+
+	switch {
+	case bytes.HasPrefix(body, []byte("%PDF-")):
+		return PDF
+	case bytes.HasPrefix(body, []byte("%!")):
+		return PostScript
+	case bytes.Contains(body, []byte("^XA")) && (bytes.Contains(body, []byte("^XZ")) || zplCommand.Match(body)):
+		return ZPL
+	}
+
+	if isStatusPoll(body) {
+		return StatusPoll
+	}
+	if len(pclCommand.FindAllIndex(body, 3)) >= 3 && !bytes.Contains(body, []byte{escpos.GS}) {
+		return PCL
+	}
+	if starCommands(body) > 0 {
+		return StarLine
+	}
+
+	known, unknown, text, binary := escposStats(body)
+	switch {
+	case known > 0 && known >= unknown:
+		return ESCPOS
+	case known == 0 && unknown == 0 && binary == 0 && text > 0:
+		return Text
+	default:
+		return Unknown
+	}
+}
+
+func pjlLanguage(data []byte) string {
+	upper := bytes.ToUpper(data[:min(len(data), 4096)])
+	i := bytes.Index(upper, []byte("ENTER LANGUAGE"))
+	if i < 0 {
+		return ""
+	}
+	line := upper[i:]
+	if end := bytes.IndexAny(line, "\r\n"); end >= 0 {
+		line = line[:end]
+	}
+	switch {
+	case bytes.Contains(line, []byte("PCL")):
+		return PCL
+	case bytes.Contains(line, []byte("POSTSCRIPT")):
+		return PostScript
+	case bytes.Contains(line, []byte("PDF")):
+		return PDF
+	}
+	return ""
+}
+
+// skipPJL returns data after the PJL header lines.
+func skipPJL(data []byte) []byte {
+	body := data[len(pjlHeader):]
+	for bytes.HasPrefix(body, []byte("@PJL")) {
+		end := bytes.IndexByte(body, '\n')
+		if end < 0 {
+			return nil
+		}
+		body = body[end+1:]
+	}
+	return body
+}
+
+// Star Line Mode commands that do not exist in ESC/POS: ESC GS x, ESC RS x
+// and the ESC ACK SOH status request.
+func starCommands(data []byte) int {
+	n := 0
+	for i := 0; i+1 < len(data); i++ {
+		if data[i] != escpos.ESC {
+			continue
+		}
+		switch data[i+1] {
+		case escpos.GS, 0x1E:
+			n++
+		case 0x06:
+			if i+2 < len(data) && data[i+2] == 0x01 {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+// escposStats counts known and unknown ESC/POS commands, printable text
+// bytes and stray binary bytes.
+func escposStats(data []byte) (known, unknown, text, binary int) {
+	s := escpos.NewScanner(data)
+	for s.Scan() {
+		tok := s.Token()
+		switch tok.Kind {
+		case escpos.KindCommand:
+			if tok.Known {
+				known++
+			} else {
+				unknown++
+			}
+		case escpos.KindText:
+			text += len(tok.Raw)
+		case escpos.KindControl:
+			if tok.Name == "CTL" {
+				binary++
+			}
+		}
+	}
+	return known, unknown, text, binary
+}
+
+// status and initialization commands that POS drivers send on otherwise
+// empty connections to poll the printer
+var pollCommands = map[string]bool{
+	"DLE EOT": true,
+	"DLE ENQ": true,
+	"ESC @":   true,
+	"ESC v":   true,
+	"ESC u":   true,
+	"GS a":    true,
+	"GS r":    true,
+	"GS I":    true,
+}
+
+// isStatusPoll reports whether data consists only of status queries and
+// printer initialization, with no printable content.
+func isStatusPoll(data []byte) bool {
+	if len(data) == 0 {
+		return false
+	}
+
+	// Star ASB / status request: ESC ACK SOH
+	if len(bytes.ReplaceAll(data, []byte{escpos.ESC, 0x06, 0x01}, nil)) == 0 {
+		return true
+	}
+
+	commands := 0
+	s := escpos.NewScanner(data)
+	for s.Scan() {
+		tok := s.Token()
+		switch tok.Kind {
+		case escpos.KindCommand:
+			if !pollCommands[tok.Name] {
+				return false
+			}
+			commands++
+		case escpos.KindControl:
+			if tok.Name != "CR" && tok.Name != "LF" {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+	return commands > 0
+}
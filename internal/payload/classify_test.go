@@ -0,0 +1,37 @@
+package payload
+
+import "testing"
+
+func TestClassify(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want string
+	}{
+		{"PJL entering PCL", "\x1b%-12345X@PJL JOB\r\n@PJL ENTER LANGUAGE = PCL\r\n\x1bE\x1b&l1O", PCL},
+		{"PJL entering PostScript", "\x1b%-12345X@PJL JOB\r\n@PJL ENTER LANGUAGE=POSTSCRIPT\r\n%!PS-Adobe-3.0\n", PostScript},
+		{"PJL without language", "\x1b%-12345X@PJL JOB NAME=\"ticket\"\n%PDF-1.7\n1 0 obj\n", PDF},
+		{"PDF", "%PDF-1.4\n%\xe2\xe3\xcf\xd3\n1 0 obj\n", PDF},
+		{"PostScript", "%!PS-Adobe-3.0\n/Helvetica findfont 12 scalefont setfont\n", PostScript},
+		{"PostScript after Ctrl-D", "\x04\r\n%!PS\nshowpage\n", PostScript},
+		{"ZPL", "^XA\n^FO50,50^A0N,30,30^FDTisch 5^FS\n^XZ\n", ZPL},
+		{"PCL", "\x1bE\x1b&l1O\x1b&l26A\x1b(s0p12h10v0s0b3TTisch 5\r\n\x0c", PCL},
+		{"Star Line Mode", "\x1b@\x1b\x1d\x61\x01Tisch 5\n2x Schnitzel\n\x1bd\x02", StarLine},
+		{"ESC/POS", "\x1b@\x1b!\x30Tisch 5\n\x1b!\x00" + "2x Schnitzel\n\x1dV\x00", ESCPOS},
+		{"text", "Tisch 5\r\n2x Schnitzel\r\n", Text},
+		{"status poll DLE EOT", "\x10\x04\x01", StatusPoll},
+		{"status poll init and ASB", "\x1b@\x1da\xff", StatusPoll},
+		{"Star status request", "\x1b\x06\x01\x1b\x06\x01", StatusPoll},
+		{"poll prefix followed by ticket", "\x10\x04\x01\x1b@Tisch 5\n2x Schnitzel\n\x1dV\x00", ESCPOS},
+		{"binary", "\x00\x01\x02\xff\xfe\x7f", Unknown},
+		{"empty", "", Unknown},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Classify([]byte(tt.data)); got != tt.want {
+				t.Errorf("Classify(%q) = %s, want %s", tt.data, got, tt.want)
+			}
+		})
+	}
+}
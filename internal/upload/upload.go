@@ -3,15 +3,12 @@ package upload
 import (
 	"bytes"
 	"context"
-	"encoding/json"
 	"fmt"
 	"io"
 	"log/slog"
 	"mime/multipart"
 	"net/http"
-	"os"
-	"path/filepath"
-	"strings"
+	"slices"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -20,34 +17,24 @@ import (
 	"github.com/marcenggist/kitchen-printer-tap/internal/job"
 )
 
-// UploadStatus represents the upload status for a job.
-type UploadStatus struct {
-	JobID       string    `json:"job_id"`
-	Status      string    `json:"status"` // pending, uploaded, failed
-	Attempts    int       `json:"attempts"`
-	LastAttempt time.Time `json:"last_attempt,omitempty"`
-	LastError   string    `json:"last_error,omitempty"`
-	UploadedAt  time.Time `json:"uploaded_at,omitempty"`
-}
-
 // Uploader handles uploading jobs to the webhook.
 type Uploader struct {
-	cfg        *config.UploadConfig
-	basePath   string
-	logger     *slog.Logger
-	client     *http.Client
-	queue      chan string
-	queueSize  atomic.Int64
-	done       chan struct{}
-	wg         sync.WaitGroup
+	cfg       *config.UploadConfig
+	store     job.JobStore
+	logger    *slog.Logger
+	client    *http.Client
+	queue     chan string
+	queueSize atomic.Int64
+	done      chan struct{}
+	wg        sync.WaitGroup
 }
 
-// New creates a new uploader.
-func New(cfg *config.UploadConfig, basePath string, logger *slog.Logger) *Uploader {
+// New creates a new uploader for the jobs in store.
+func New(cfg *config.UploadConfig, store job.JobStore, logger *slog.Logger) *Uploader {
 	return &Uploader{
-		cfg:      cfg,
-		basePath: basePath,
-		logger:   logger,
+		cfg:    cfg,
+		store:  store,
+		logger: logger,
 		client: &http.Client{
 			Timeout: cfg.Timeout,
 		},
@@ -81,17 +68,17 @@ func (u *Uploader) Stop() {
 }
 
 // Enqueue adds a job to the upload queue.
-func (u *Uploader) Enqueue(jobPath string) {
+func (u *Uploader) Enqueue(jobID string) {
 	if !u.cfg.Enabled {
 		return
 	}
 
 	select {
-	case u.queue <- jobPath:
+	case u.queue <- jobID:
 		u.queueSize.Add(1)
 	default:
 		u.logger.Warn("upload queue full, dropping job",
-			"path", jobPath)
+			"job_id", jobID)
 	}
 }
 
@@ -107,48 +94,36 @@ func (u *Uploader) worker() {
 		select {
 		case <-u.done:
 			return
-		case jobPath := <-u.queue:
+		case jobID := <-u.queue:
 			u.queueSize.Add(-1)
-			u.processJob(jobPath)
+			u.processJob(jobID)
 		}
 	}
 }
 
-func (u *Uploader) processJob(basePath string) {
-	binPath := basePath + ".bin"
-	jsonPath := basePath + ".json"
-	statusPath := basePath + ".upload.json"
-
-	// Load existing status or create new
-	status := u.loadOrCreateStatus(statusPath, filepath.Base(basePath))
-
-	if status.Status == "uploaded" {
-		return
-	}
-
-	// Read metadata
-	metaBytes, err := os.ReadFile(jsonPath)
+func (u *Uploader) processJob(jobID string) {
+	// Read the job with its payload and upload status
+	stored, err := u.store.Get(jobID)
 	if err != nil {
-		u.logger.Error("failed to read metadata",
-			"path", jsonPath,
+		u.logger.Error("failed to read job",
+			"job_id", jobID,
 			"error", err)
 		return
 	}
 
-	var meta job.Metadata
-	if err := json.Unmarshal(metaBytes, &meta); err != nil {
-		u.logger.Error("failed to parse metadata",
-			"path", jsonPath,
-			"error", err)
+	status := &stored.Upload
+	if status.Done() {
 		return
 	}
-
-	// Read binary data
-	binData, err := os.ReadFile(binPath)
-	if err != nil {
-		u.logger.Error("failed to read binary",
-			"path", binPath,
-			"error", err)
+	meta := stored.Metadata
+
+	// Apply content type filter
+	if len(u.cfg.ContentTypes) > 0 && !slices.Contains(u.cfg.ContentTypes, meta.ContentType) {
+		status.Status = job.UploadSkipped
+		u.saveStatus(status)
+		u.logger.Debug("job skipped by content type filter",
+			"job_id", meta.JobID,
+			"content_type", meta.ContentType)
 		return
 	}
 
@@ -158,11 +133,11 @@ func (u *Uploader) processJob(basePath string) {
 		status.Attempts = attempt
 		status.LastAttempt = time.Now().UTC()
 
-		err := u.upload(meta, binData)
+		err := u.upload(meta, stored.Payload, stored.Attachments)
 		if err == nil {
-			status.Status = "uploaded"
+			status.Status = job.UploadUploaded
 			status.UploadedAt = time.Now().UTC()
-			u.saveStatus(statusPath, status)
+			u.saveStatus(status)
 			u.logger.Info("job uploaded",
 				"job_id", meta.JobID,
 				"attempts", attempt)
@@ -171,7 +146,7 @@ func (u *Uploader) processJob(basePath string) {
 
 		lastErr = err
 		status.LastError = err.Error()
-		u.saveStatus(statusPath, status)
+		u.saveStatus(status)
 
 		if attempt < u.cfg.MaxRetries {
 			backoff := time.Duration(attempt) * u.cfg.RetryBackoff
@@ -183,27 +158,37 @@ func (u *Uploader) processJob(basePath string) {
 		}
 	}
 
-	status.Status = "failed"
-	u.saveStatus(statusPath, status)
+	status.Status = job.UploadFailed
+	u.saveStatus(status)
 	u.logger.Error("job upload failed",
 		"job_id", meta.JobID,
 		"attempts", status.Attempts,
 		"error", lastErr)
 }
 
-func (u *Uploader) upload(meta job.Metadata, binData []byte) error {
+func (u *Uploader) upload(meta job.Metadata, binData []byte, rasters []job.Attachment) error {
 	// Build multipart request
 	var buf bytes.Buffer
 	writer := multipart.NewWriter(&buf)
 
-	// Add metadata JSON
-	metaBytes, _ := json.Marshal(meta)
+	// Add metadata JSON. For signed jobs these are exactly the bytes the
+	// signature covers, and the signature is sent alongside.
+	metaBytes, err := job.SignedMetadata(meta)
+	if err != nil {
+		return err
+	}
 	metaPart, err := writer.CreateFormField("metadata")
 	if err != nil {
 		return fmt.Errorf("creating metadata field: %w", err)
 	}
 	metaPart.Write(metaBytes)
 
+	if meta.Signature != "" {
+		if err := writer.WriteField("signature", meta.Signature); err != nil {
+			return fmt.Errorf("creating signature field: %w", err)
+		}
+	}
+
 	// Add binary file
 	binPart, err := writer.CreateFormFile("payload", meta.JobID+".bin")
 	if err != nil {
@@ -211,6 +196,15 @@ func (u *Uploader) upload(meta job.Metadata, binData []byte) error {
 	}
 	binPart.Write(binData)
 
+	// Add raster images in metadata order
+	for _, img := range rasters {
+		imgPart, err := writer.CreateFormFile("raster", img.Name)
+		if err != nil {
+			return fmt.Errorf("creating raster field: %w", err)
+		}
+		imgPart.Write(img.Data)
+	}
+
 	writer.Close()
 
 	// Create request
@@ -242,57 +236,31 @@ func (u *Uploader) upload(meta job.Metadata, binData []byte) error {
 	return nil
 }
 
-func (u *Uploader) loadOrCreateStatus(path, jobID string) *UploadStatus {
-	data, err := os.ReadFile(path)
-	if err == nil {
-		var status UploadStatus
-		if json.Unmarshal(data, &status) == nil {
-			return &status
-		}
-	}
-
-	return &UploadStatus{
-		JobID:  jobID,
-		Status: "pending",
+func (u *Uploader) saveStatus(status *job.UploadStatus) {
+	if err := u.store.MarkUploaded(status.JobID, *status); err != nil {
+		u.logger.Warn("failed to save upload status",
+			"job_id", status.JobID,
+			"error", err)
 	}
 }
 
-func (u *Uploader) saveStatus(path string, status *UploadStatus) {
-	data, _ := json.MarshalIndent(status, "", "  ")
-	os.WriteFile(path, data, 0640)
-}
-
 func (u *Uploader) scanPending() {
 	defer u.wg.Done()
 
-	// Scan for jobs that need uploading
-	err := filepath.Walk(u.basePath, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return nil
-		}
+	// Queue jobs that need uploading
+	jobs, err := u.store.List(job.ListOptions{PendingUpload: true})
+	if err != nil {
+		u.logger.Error("scan pending failed",
+			"error", err)
+		return
+	}
 
+	for _, meta := range jobs {
 		select {
 		case <-u.done:
-			return filepath.SkipAll
+			return
 		default:
 		}
-
-		if !info.IsDir() && strings.HasSuffix(path, ".json") && !strings.HasSuffix(path, ".upload.json") {
-			// Check if already uploaded
-			basePath := strings.TrimSuffix(path, ".json")
-			statusPath := basePath + ".upload.json"
-
-			status := u.loadOrCreateStatus(statusPath, filepath.Base(basePath))
-			if status.Status != "uploaded" {
-				u.Enqueue(basePath)
-			}
-		}
-
-		return nil
-	})
-
-	if err != nil {
-		u.logger.Error("scan pending failed",
-			"error", err)
+		u.Enqueue(meta.JobID)
 	}
 }
@@ -62,6 +62,10 @@ mkdir -p "$INSTALL_DIR"
 echo "Installing binary..."
 cp "$BINARY_PATH" "$INSTALL_DIR/tapd"
 chmod 755 "$INSTALL_DIR/tapd"
+if [[ -f "$PROJECT_DIR/bin/tapctl" ]]; then
+    cp "$PROJECT_DIR/bin/tapctl" "$INSTALL_DIR/tapctl"
+    chmod 755 "$INSTALL_DIR/tapctl"
+fi
 
 # Set capabilities for packet capture (instead of running as root)
 echo "Setting capabilities..."
@@ -78,6 +82,20 @@ else
     echo "  Installed config.yaml.example for reference"
 fi
 
+# Install order extraction templates (existing templates are kept)
+echo "Installing order templates..."
+mkdir -p "$CONFIG_DIR/templates"
+for template in "$PROJECT_DIR"/configs/templates/*.yaml; do
+    name="$(basename "$template")"
+    if [[ ! -f "$CONFIG_DIR/templates/$name" ]]; then
+        cp "$template" "$CONFIG_DIR/templates/$name"
+        echo "  Installed $name"
+    else
+        cp "$template" "$CONFIG_DIR/templates/$name.example"
+        echo "  $name already exists, installed $name.example for reference"
+    fi
+done
+
 # Set permissions
 echo "Setting permissions..."
 chown -R "$SERVICE_USER:$SERVICE_GROUP" "$DATA_DIR"
@@ -86,6 +104,8 @@ chown root:$SERVICE_GROUP "$CONFIG_DIR"
 chmod 750 "$CONFIG_DIR"
 chown root:$SERVICE_GROUP "$CONFIG_DIR/config.yaml"
 chmod 640 "$CONFIG_DIR/config.yaml"
+chown -R root:$SERVICE_GROUP "$CONFIG_DIR/templates"
+chmod 750 "$CONFIG_DIR/templates"
 
 # Install systemd service
 echo "Installing systemd service..."